@@ -1,12 +1,15 @@
 package main
 
 import (
+	"os"
+
 	"github.com/tcfw/test-contactcache/pkg/contactcache/cmd"
 )
 
 func main() {
 	cmd := cmd.NewContactCacheCmd()
 	if err := cmd.Execute(); err != nil {
-		panic(err)
+		//Error already printed by cobra
+		os.Exit(1)
 	}
 }
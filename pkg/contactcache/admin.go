@@ -0,0 +1,296 @@
+package contactcache
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//adminServer provides the admin API server if an admin address has been configured. The
+//admin API is served over TLS with its own certificate, or the servers certificate when
+//only mTLS has been configured
+func (s *Server) adminServer(serverCerts *certReloader) (*http.Server, error) {
+	cfg := s.cfg()
+	if cfg.Admin.Address == "" {
+		return nil, nil
+	}
+
+	if cfg.Admin.Token == "" && cfg.Admin.TLS.ClientCA == "" {
+		return nil, fmt.Errorf("admin API requires admin.token or admin.tls.client_ca")
+	}
+
+	srv := &http.Server{
+		Addr:    cfg.Admin.Address,
+		Handler: s.adminHandler(),
+	}
+
+	if cfg.Admin.TLS.Cert == "" && cfg.Admin.TLS.ClientCA == "" {
+		return srv, nil
+	}
+
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	certs := serverCerts
+	if cfg.Admin.TLS.Cert == "" && certs == nil {
+		return nil, fmt.Errorf("admin.tls.cert is required without a https listener")
+	}
+	if cfg.Admin.TLS.Cert != "" {
+		certs, err = newCertReloader(cfg.Admin.TLS.Cert, cfg.Admin.TLS.Key, "", cfg.TLS.ReloadInterval, s.metrics)
+		if err != nil {
+			return nil, err
+		}
+		s.reloadMu.Lock()
+		s.certs = append(s.certs, certs)
+		s.reloadMu.Unlock()
+	}
+	tlsConfig.GetCertificate = certs.GetCertificate
+
+	if cfg.Admin.TLS.ClientCA != "" {
+		pool, err := loadCertPool(cfg.Admin.TLS.ClientCA, "admin client CA")
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	srv.TLSConfig = tlsConfig
+
+	return srv, nil
+}
+
+//listenAndServeAdmin serves the admin API over TLS if configured
+func listenAndServeAdmin(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+
+	return srv.ListenAndServe()
+}
+
+//adminHandler http mux for cache inspection and purging
+func (s *Server) adminHandler() http.Handler {
+	r := mux.NewRouter()
+
+	api := r.PathPrefix("/admin/v1").Subrouter()
+
+	api.HandleFunc("/contacts/{idOrEmail}", s.handleAdminLookupByKey).Methods(http.MethodGet)
+
+	api.HandleFunc("/outbox", s.handleAdminOutbox).Methods(http.MethodGet)
+	api.HandleFunc("/outbox/dead/requeue", s.handleAdminOutboxRequeue).Methods(http.MethodPost)
+	api.HandleFunc("/outbox/dead", s.handleAdminOutboxDiscard).Methods(http.MethodDelete)
+
+	tenant := api.PathPrefix("/tenants/{tenant}").Subrouter()
+	tenant.HandleFunc("/contacts/{idOrEmail}", s.handleAdminLookup).Methods(http.MethodGet)
+	tenant.HandleFunc("/contacts/{idOrEmail}", s.handleAdminPurgeContact).Methods(http.MethodDelete)
+	tenant.HandleFunc("/lists", s.handleAdminPurgeLists).Methods(http.MethodDelete)
+	tenant.HandleFunc("/keys", s.handleAdminKeys).Methods(http.MethodGet)
+	tenant.HandleFunc("/stats", s.handleAdminStats).Methods(http.MethodGet)
+	tenant.HandleFunc("", s.handleAdminPurgeTenant).Methods(http.MethodDelete)
+	tenant.Use(s.adminTenantCheck)
+
+	r.Use(s.adminAuth)
+
+	return r
+}
+
+//adminAuth requires either a verified client certificate or the admin bearer token
+func (s *Server) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := s.cfg().Admin.Token
+		auth := r.Header.Get("Authorization")
+
+		if token != "" && strings.HasPrefix(auth, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("content-type", "application/json")
+		httpJSONError(w, "Admin credentials required.", http.StatusUnauthorized)
+	})
+}
+
+//adminTenantCheck validates the tenant is a hashed API key so it can't be used as a key pattern
+func (s *Server) adminTenantCheck(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ValidTenant(mux.Vars(r)["tenant"]) {
+			w.Header().Add("content-type", "application/json")
+			httpJSONError(w, "Tenant must be the sha256 hash of the API key.", http.StatusBadRequest)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+//handleAdminLookupByKey provides the cached entry for the API key in the autopilotapikey header
+func (s *Server) handleAdminLookupByKey(w http.ResponseWriter, r *http.Request) {
+	apiKey := r.Header.Get(apiKeyHeader)
+	if apiKey == "" {
+		w.Header().Add("content-type", "application/json")
+		httpJSONError(w, "No autopilotapikey header provided.", http.StatusBadRequest)
+		return
+	}
+
+	s.adminLookup(w, r, tenantHash(apiKey))
+}
+
+//handleAdminLookup provides the cached entry for a tenant
+func (s *Server) handleAdminLookup(w http.ResponseWriter, r *http.Request) {
+	s.adminLookup(w, r, mux.Vars(r)["tenant"])
+}
+
+func (s *Server) adminLookup(w http.ResponseWriter, r *http.Request, tenant string) {
+	entry, err := s.manager().Lookup(r.Context(), tenant, mux.Vars(r)["idOrEmail"])
+	if errors.Is(err, ErrCacheMiss) {
+		w.Header().Add("content-type", "application/json")
+		httpJSONError(w, "Contact not cached.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.adminError(w, err)
+		return
+	}
+
+	adminJSON(w, entry)
+}
+
+//handleAdminPurgeContact removes a contact and the tenants list responses
+func (s *Server) handleAdminPurgeContact(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	//Recorded before deleting so in flight populates are discarded
+	if err := s.markInvalidated(r.Context(), vars["tenant"], vars["idOrEmail"], listsInvalidated); err != nil {
+		s.adminError(w, err)
+		return
+	}
+
+	n, err := s.manager().PurgeContact(r.Context(), vars["tenant"], vars["idOrEmail"])
+	if err != nil {
+		s.adminError(w, err)
+		return
+	}
+	s.notifyContact(r.Context(), vars["tenant"], noticeInvalidated, vars["idOrEmail"])
+
+	adminJSON(w, map[string]int64{"deleted": n})
+}
+
+//handleAdminPurgeLists removes the tenants list responses
+func (s *Server) handleAdminPurgeLists(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+
+	if err := s.markInvalidated(r.Context(), tenant, listsInvalidated); err != nil {
+		s.adminError(w, err)
+		return
+	}
+
+	n, err := s.manager().PurgeLists(r.Context(), tenant)
+	if err != nil {
+		s.adminError(w, err)
+		return
+	}
+
+	adminJSON(w, map[string]int64{"deleted": n})
+}
+
+//handleAdminPurgeTenant removes all of the tenants cache entries
+func (s *Server) handleAdminPurgeTenant(w http.ResponseWriter, r *http.Request) {
+	n, err := s.manager().PurgeTenant(r.Context(), mux.Vars(r)["tenant"])
+	if err != nil {
+		s.adminError(w, err)
+		return
+	}
+
+	adminJSON(w, map[string]int64{"deleted": n})
+}
+
+//handleAdminKeys lists the tenants cached keys and their TTLs
+func (s *Server) handleAdminKeys(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.manager().Keys(r.Context(), mux.Vars(r)["tenant"])
+	if err != nil {
+		s.adminError(w, err)
+		return
+	}
+
+	adminJSON(w, map[string]interface{}{"keys": entries})
+}
+
+//handleAdminStats provides the tenants hit/miss stats
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	//Include this replicas pending counts
+	if err := s.tenantCounters.flush(r.Context(), s.rdb); err != nil {
+		s.log.WithError(err).Error("failed to flush tenant stats")
+	}
+
+	stats, err := s.manager().Stats(r.Context(), mux.Vars(r)["tenant"])
+	if err != nil {
+		s.adminError(w, err)
+		return
+	}
+
+	adminJSON(w, stats)
+}
+
+//handleAdminOutbox lists the queued and dead lettered operations
+func (s *Server) handleAdminOutbox(w http.ResponseWriter, r *http.Request) {
+	pending, dead := s.outbox.entries()
+	if pending == nil {
+		pending = []outboxEntry{}
+	}
+	if dead == nil {
+		dead = []outboxEntry{}
+	}
+
+	adminJSON(w, map[string]interface{}{"pending": pending, "dead": dead})
+}
+
+//handleAdminOutboxRequeue retries the dead lettered operations
+func (s *Server) handleAdminOutboxRequeue(w http.ResponseWriter, r *http.Request) {
+	n, err := s.outbox.requeueDead()
+	if err != nil {
+		s.adminError(w, err)
+		return
+	}
+
+	adminJSON(w, map[string]int{"requeued": n})
+}
+
+//handleAdminOutboxDiscard removes the dead lettered operations
+func (s *Server) handleAdminOutboxDiscard(w http.ResponseWriter, r *http.Request) {
+	n, err := s.outbox.discardDead()
+	if err != nil {
+		s.adminError(w, err)
+		return
+	}
+
+	adminJSON(w, map[string]int{"discarded": n})
+}
+
+func (s *Server) manager() *CacheManager {
+	return NewCacheManager(s.rdb)
+}
+
+func (s *Server) adminError(w http.ResponseWriter, err error) {
+	s.log.WithError(err).Error("admin request failed")
+	w.Header().Add("content-type", "application/json")
+	httpJSONError(w, "Failed to query cache.", http.StatusInternalServerError)
+}
+
+func adminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
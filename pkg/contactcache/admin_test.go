@@ -0,0 +1,172 @@
+package contactcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method string, path string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "https://admin.local"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "Bearer secret")
+	req.Header.Add(apiKeyHeader, "1234")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	srv := &Server{metrics: NewMetrics()}
+	srv.applyConfig(DefaultConfig())
+	srv.cfg().Admin.Token = "secret"
+	handler := srv.adminHandler()
+
+	req, _ := http.NewRequest("GET", "https://admin.local/admin/v1/contacts/chris@autopilothq.com", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	req.Header.Add("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+}
+
+func TestAdminInspectAndPurge(t *testing.T) {
+	contact := `{"contact_id": "person_1234", "Email": "chris@autopilothq.com"}`
+
+	srv, _, close, s := setupTestServer(t, contact)
+	defer close()
+
+	srv.cfg().Admin.Token = "secret"
+
+	apiKey := "1234"
+	tenant := tenantHash(apiKey)
+
+	//Populate the cache
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contact/chris@autopilothq.com", nil)
+	req.Header.Add(apiKeyHeader, apiKey)
+	srv.httpHandler().ServeHTTP(httptest.NewRecorder(), req)
+
+	s.Set(srv.prefixKey(apiKey, "lists:"), `{"contacts": []}`)
+
+	handler := srv.adminHandler()
+
+	//Lookup by API key
+	w := adminRequest(t, handler, "GET", "/admin/v1/contacts/person_1234")
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	entry := &CacheEntry{}
+	json.NewDecoder(w.Body).Decode(entry)
+	assert.Equal(t, srv.prefixKey(apiKey, "chris@autopilothq.com"), entry.Key)
+	assert.Equal(t, srv.prefixKey(apiKey, "person_1234"), entry.Alias)
+	assert.JSONEq(t, contact, string(entry.Value))
+	assert.True(t, entry.TTL > 0)
+
+	//List keys
+	w = adminRequest(t, handler, "GET", "/admin/v1/tenants/"+tenant+"/keys")
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	keys := map[string][]*CacheEntry{}
+	json.NewDecoder(w.Body).Decode(&keys)
+	assert.Len(t, keys["keys"], 5)
+
+	//Stats
+	w = adminRequest(t, handler, "GET", "/admin/v1/tenants/"+tenant+"/stats")
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	stats := &TenantStats{}
+	json.NewDecoder(w.Body).Decode(stats)
+	assert.Equal(t, int64(1), stats.Counts["miss"]["contact"])
+
+	//Purge contact
+	w = adminRequest(t, handler, "DELETE", "/admin/v1/tenants/"+tenant+"/contacts/chris@autopilothq.com")
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.False(t, s.Exists(srv.prefixKey(apiKey, "chris@autopilothq.com")))
+	assert.False(t, s.Exists(srv.prefixKey(apiKey, "lists:")))
+
+	w = adminRequest(t, handler, "GET", "/admin/v1/tenants/"+tenant+"/contacts/chris@autopilothq.com")
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	//Purge tenant, keeping its rate limits, stats and recorded invalidations
+	rateLimitKey := fmt.Sprintf("%s:ratelimit:%s", tenant, budgetBackend)
+	s.Set(rateLimitKey, "1")
+
+	w = adminRequest(t, handler, "DELETE", "/admin/v1/tenants/"+tenant)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.ElementsMatch(t, []string{
+		rateLimitKey,
+		tenantStatsKey(tenant),
+		invalidatedKey(srv.prefixKey(apiKey, "chris@autopilothq.com")),
+		invalidatedKey(srv.prefixKey(apiKey, listsInvalidated)),
+	}, s.Keys())
+}
+
+func TestAdminPurgeRacingPopulate(t *testing.T) {
+	reading := make(chan struct{})
+	release := make(chan struct{})
+	var gets int32
+
+	srv, close, s := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&gets, 1) == 1 {
+			close(reading)
+			<-release
+		}
+		fmt.Fprintln(w, `{"contacts": [], "contact_id": "person_1234", "Email": "chris@autopilothq.com"}`)
+	})
+	defer close()
+
+	srv.cfg().Admin.Token = "secret"
+
+	apiKey := "1234"
+	tenant := tenantHash(apiKey)
+
+	send := func(path string) {
+		req, _ := http.NewRequest("GET", "https://anywhere.local"+path, nil)
+		req.Header.Add(apiKeyHeader, apiKey)
+		srv.httpHandler().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for _, tc := range []struct{ path, purge, key string }{
+		{"/v1/contact/chris@autopilothq.com", "/contacts/person_1234", "chris@autopilothq.com"},
+		{"/v1/contacts", "/lists", "lists:"},
+	} {
+		reading, release = make(chan struct{}), make(chan struct{})
+		atomic.StoreInt32(&gets, 0)
+
+		//The purge lands while the request is waiting on the backend
+		done := make(chan struct{})
+		go func() {
+			send(tc.path)
+			done <- struct{}{}
+		}()
+
+		<-reading
+		w := adminRequest(t, srv.adminHandler(), "DELETE", "/admin/v1/tenants/"+tenant+tc.purge)
+		assert.Equal(t, 200, w.Result().StatusCode)
+		release <- struct{}{}
+		<-done
+
+		//The populate finishing after the purge doesn't restore the entry
+		assert.False(t, s.Exists(srv.prefixKey(apiKey, tc.key)), tc.purge)
+		assert.False(t, s.Exists(staleKey(srv.prefixKey(apiKey, tc.key))), tc.purge)
+	}
+}
+
+func TestAdminRejectsTenantPatterns(t *testing.T) {
+	srv := &Server{metrics: NewMetrics()}
+	srv.applyConfig(DefaultConfig())
+	srv.cfg().Admin.Token = "secret"
+
+	w := adminRequest(t, srv.adminHandler(), "DELETE", "/admin/v1/tenants/*")
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
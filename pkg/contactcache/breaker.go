@@ -0,0 +1,189 @@
+package contactcache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	errCircuitOpen = errors.New("circuit breaker open")
+)
+
+//breakerState the state of the circuit breaker, exported as a metric value
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (bs breakerState) String() string {
+	switch bs {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+//breakerOutcome the result of a request through the breaker
+type breakerOutcome int
+
+const (
+	outcomeSuccess breakerOutcome = iota
+	outcomeFailure
+	outcomeIgnored
+)
+
+//breakerOpts configures when the breaker trips and recovers
+type breakerOpts struct {
+	//Window period over which the error rate is calculated
+	Window time.Duration
+	//MinRequests minimum requests within the window before the breaker can trip
+	MinRequests int
+	//ErrorRate ratio of failed requests which trips the breaker
+	ErrorRate float64
+	//OpenDuration how long the breaker stays open before allowing probes
+	OpenDuration time.Duration
+	//HalfOpenRequests concurrent probe requests allowed while half-open
+	HalfOpenRequests int
+}
+
+//circuitBreaker trips on high error rates to fast-fail requests to a degraded upstream
+type circuitBreaker struct {
+	upstream string
+	opts     breakerOpts
+	metrics  *Metrics
+
+	mu          sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+
+	now func() time.Time
+}
+
+func newCircuitBreaker(upstream string, opts breakerOpts, metrics *Metrics) *circuitBreaker {
+	if opts.HalfOpenRequests < 1 {
+		opts.HalfOpenRequests = 1
+	}
+
+	metrics.upstreamCircuitState.WithLabelValues(upstream).Set(float64(breakerClosed))
+
+	return &circuitBreaker{upstream: upstream, opts: opts, metrics: metrics, now: time.Now}
+}
+
+//State provides the current breaker state
+func (cb *circuitBreaker) State() breakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.checkOpenExpiry()
+
+	return cb.state
+}
+
+//allow checks if a request may be sent to the backend
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.checkOpenExpiry()
+
+	switch cb.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if cb.probes >= cb.opts.HalfOpenRequests {
+			return false
+		}
+		cb.probes++
+	}
+
+	return true
+}
+
+//record records the outcome of an allowed request
+func (cb *circuitBreaker) record(outcome breakerOutcome) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == breakerHalfOpen {
+		cb.probes--
+
+		switch outcome {
+		case outcomeSuccess:
+			cb.transition(breakerClosed)
+		case outcomeFailure:
+			cb.transition(breakerOpen)
+		}
+		return
+	}
+
+	if outcome == outcomeIgnored || cb.state != breakerClosed {
+		return
+	}
+
+	now := cb.now()
+	if now.Sub(cb.windowStart) > cb.opts.Window {
+		cb.windowStart = now
+		cb.requests = 0
+		cb.failures = 0
+	}
+
+	cb.requests++
+	if outcome == outcomeFailure {
+		cb.failures++
+	}
+
+	if cb.requests >= cb.opts.MinRequests && float64(cb.failures)/float64(cb.requests) >= cb.opts.ErrorRate {
+		cb.transition(breakerOpen)
+	}
+}
+
+//checkOpenExpiry moves an open breaker to half-open once the open duration has passed
+func (cb *circuitBreaker) checkOpenExpiry() {
+	if cb.state == breakerOpen && cb.now().Sub(cb.openedAt) >= cb.opts.OpenDuration {
+		cb.transition(breakerHalfOpen)
+	}
+}
+
+func (cb *circuitBreaker) transition(state breakerState) {
+	cb.state = state
+
+	switch state {
+	case breakerOpen:
+		cb.openedAt = cb.now()
+	case breakerClosed:
+		cb.windowStart = cb.now()
+		cb.requests = 0
+		cb.failures = 0
+	}
+
+	cb.metrics.upstreamCircuitState.WithLabelValues(cb.upstream).Set(float64(state))
+	cb.metrics.upstreamCircuitTransitions.WithLabelValues(cb.upstream, state.String()).Add(1)
+}
+
+//breakerOutcomeOf classifies the result of an attempt for the breaker, ignoring attempts
+//cancelled by the client
+func breakerOutcomeOf(req *http.Request, resp *http.Response, err error) breakerOutcome {
+	switch {
+	case err != nil && errors.Is(req.Context().Err(), context.Canceled):
+		return outcomeIgnored
+	case err != nil:
+		return outcomeFailure
+	case resp.StatusCode >= 500:
+		return outcomeFailure
+	default:
+		return outcomeSuccess
+	}
+}
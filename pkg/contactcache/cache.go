@@ -2,15 +2,24 @@ package contactcache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
-	"github.com/spf13/viper"
+)
+
+var (
+	//ErrCacheMiss the key does not exist in the cache
+	ErrCacheMiss = errors.New("cache miss")
+
+	//ErrCacheUnavailable the cache is failing and calls are being bypassed
+	ErrCacheUnavailable = errors.New("cache unavailable")
 )
 
 //Cacher interfaces to a caching server such as redis/memcached etc.
+//Get returns ErrCacheMiss if the key does not exist
 type Cacher interface {
 	Set(ctx context.Context, key, value string, ttl time.Duration) error
 	Get(ctx context.Context, key string) (string, error)
@@ -18,25 +27,31 @@ type Cacher interface {
 }
 
 //NewRedisCache provides a redis backed cacher
-func NewRedisCache() (Cacher, error) {
-	redisCache := &RedisCache{}
+func NewRedisCache(cfg CacheConfig) (Cacher, error) {
+	rdb, err := newRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisCache{rdb: rdb}, nil
+}
 
-	endpoint := viper.GetString("cache.address")
-	if endpoint == "" {
+//newRedisClient creates a redis client from the cache config
+func newRedisClient(cfg CacheConfig) (*redis.Client, error) {
+	if cfg.Address == "" {
 		return nil, fmt.Errorf("no cache endpoint provided")
 	}
-	pass := viper.GetString("cache.password")
-	db := viper.GetInt("cache.db")
 
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     endpoint,
-		Password: pass,
-		DB:       db,
+		Addr:         cfg.Address,
+		Password:     cfg.Password,
+		DB:           cfg.DB,
+		DialTimeout:  cfg.DialTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
 	})
 
-	redisCache.rdb = rdb
-
-	return redisCache, nil
+	return rdb, nil
 }
 
 //RedisCache basic redis backend driver
@@ -51,7 +66,11 @@ func (rc *RedisCache) Set(ctx context.Context, key, value string, ttl time.Durat
 
 //Get gets a value from the cache
 func (rc *RedisCache) Get(ctx context.Context, key string) (string, error) {
-	return rc.rdb.Get(ctx, key).Result()
+	val, err := rc.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrCacheMiss
+	}
+	return val, err
 }
 
 //Delete removes a value by key
@@ -62,11 +81,52 @@ func (rc *RedisCache) Delete(ctx context.Context, key string) error {
 	return rc.rdb.Del(ctx, key).Err()
 }
 
+//GetWithTTL gets a value along with its remaining TTL in a single round trip, the TTL
+//is negative if the key has no expiry
+func (rc *RedisCache) GetWithTTL(ctx context.Context, key string) (string, time.Duration, error) {
+	pipe := rc.rdb.Pipeline()
+	get := pipe.Get(ctx, key)
+	pttl := pipe.PTTL(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return "", 0, err
+	}
+
+	val, err := get.Result()
+	if err == redis.Nil {
+		return "", 0, ErrCacheMiss
+	} else if err != nil {
+		return "", 0, err
+	}
+	return val, pttl.Val(), nil
+}
+
+//TTL provides the remaining TTL of a key
+func (rc *RedisCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := rc.rdb.TTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	//Negative values are returned for keys which don't exist or have no expiry
+	if ttl < 0 {
+		return 0, ErrCacheMiss
+	}
+	return ttl, nil
+}
+
+//Ping checks the redis server is reachable
+func (rc *RedisCache) Ping(ctx context.Context) error {
+	return rc.rdb.Ping(ctx).Err()
+}
+
 func (rc *RedisCache) deletePrefix(ctx context.Context, pattern string) error {
 	keys, err := rc.rdb.Keys(ctx, pattern).Result()
 	if err != nil {
 		return err
 	}
+	if len(keys) == 0 {
+		return nil
+	}
 
 	return rc.rdb.Del(ctx, keys...).Err()
 }
@@ -6,7 +6,6 @@ import (
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
-	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,9 +18,10 @@ func TestRedisCache(t *testing.T) {
 	defer s.Close()
 
 	//Set config to test redis
-	viper.Set("cache.address", s.Addr())
+	cfg := DefaultConfig()
+	cfg.Cache.Address = s.Addr()
 
-	cache, err := NewRedisCache()
+	cache, err := NewRedisCache(cfg.Cache)
 	if assert.NoError(t, err) {
 		ctx := context.Background()
 
@@ -0,0 +1,212 @@
+package contactcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	cacheStatusHeader = "X-Cache"
+	cacheDebugHeader  = "X-Cache-Debug"
+	cacheKeyHeader    = "X-Cache-Key"
+	cacheTTLHeader    = "X-Cache-TTL"
+)
+
+//cacheStatuses maps cache decisions to X-Cache values, anything else is a bypass
+var cacheStatuses = map[string]string{
+	"hit":      "HIT",
+	"miss":     "MISS",
+	"stale":    "STALE",
+	"negative": "NEGATIVE",
+}
+
+//ttler caches which can provide the remaining TTL of a key
+type ttler interface {
+	TTL(ctx context.Context, key string) (time.Duration, error)
+}
+
+//ttlGetter caches which can provide a value along with its remaining TTL in a single
+//round trip
+type ttlGetter interface {
+	GetWithTTL(ctx context.Context, key string) (string, time.Duration, error)
+}
+
+//cacheHeaders explains the cache decision for each response with X-Cache, Age and
+//Server-Timing headers, plus the cache key and TTL for authorised debug requests
+func (s *Server) cacheHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, ok := requestInfoFromContext(r.Context())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(&cacheHeaderWriter{
+			ResponseWriter: w,
+			info:           info,
+			debug:          s.cacheDebugAllowed(r),
+		}, r)
+	})
+}
+
+//cacheDebugAllowed checks the debug header carries the admin token
+func (s *Server) cacheDebugAllowed(r *http.Request) bool {
+	debug := r.Header.Get(cacheDebugHeader)
+	token := s.cfg().Admin.Token
+
+	return debug != "" && token != "" && subtle.ConstantTimeCompare([]byte(debug), []byte(token)) == 1
+}
+
+//cacheHeaderWriter sets the cache headers once the response headers are written
+type cacheHeaderWriter struct {
+	http.ResponseWriter
+	info        *requestInfo
+	debug       bool
+	wroteHeader bool
+}
+
+//WriteHeader adds the cache headers before writing the status
+func (cw *cacheHeaderWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		cw.setHeaders(cw.Header())
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+//Write ensures the headers are written first
+func (cw *cacheHeaderWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+//Flush ensures the headers are written before flushing, for streamed responses
+func (cw *cacheHeaderWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//Unwrap provides the underlying writer to http.ResponseController
+func (cw *cacheHeaderWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *cacheHeaderWriter) setHeaders(h http.Header) {
+	info := cw.info
+
+	status, ok := cacheStatuses[info.cache]
+	if !ok {
+		status = "BYPASS"
+	}
+	h.Set(cacheStatusHeader, status)
+
+	//Cached entries are aged from their remaining TTL, backend responses may carry their own
+	if info.hasTTL {
+		h.Set("Age", fmt.Sprintf("%d", int64(info.age/time.Second)))
+	} else if h.Get("Age") == "" {
+		h.Set("Age", "0")
+	}
+
+	var timings []string
+	if info.cacheTime > 0 {
+		timings = append(timings, fmt.Sprintf("cache;dur=%.3f", durationMs(info.cacheTime)))
+	}
+	if info.upstream > 0 {
+		timings = append(timings, fmt.Sprintf("upstream;dur=%.3f", durationMs(info.upstream)))
+	}
+	if len(timings) > 0 {
+		h.Set("Server-Timing", strings.Join(timings, ", "))
+	}
+
+	if !cw.debug {
+		return
+	}
+
+	if info.key != "" {
+		sum := sha256.Sum256([]byte(info.key))
+		h.Set(cacheKeyHeader, hex.EncodeToString(sum[:]))
+	}
+	if info.hasTTL {
+		h.Set(cacheTTLHeader, fmt.Sprintf("%d", int64(info.ttl/time.Second)))
+	}
+}
+
+//setCacheKey records the resolved cache key of the request
+func setCacheKey(ctx context.Context, key string) {
+	if info, ok := requestInfoFromContext(ctx); ok {
+		info.key = key
+	}
+}
+
+//getEntry gets a cache entry along with its remaining TTL when the cache can provide both
+//in one round trip, the TTL is negative otherwise
+func (s *Server) getEntry(ctx context.Context, key string) (string, time.Duration, error) {
+	if g, ok := s.cache.(ttlGetter); ok {
+		return g.GetWithTTL(ctx, key)
+	}
+
+	val, err := s.cache.Get(ctx, key)
+	return val, -1, err
+}
+
+//recordEntryAge records the served cache entry with its age, derived from the remaining
+//TTL it was fetched with
+func (s *Server) recordEntryAge(ctx context.Context, key string, setTTL time.Duration, ttl time.Duration) {
+	info, ok := requestInfoFromContext(ctx)
+	if !ok {
+		return
+	}
+	info.key = key
+
+	if ttl < 0 {
+		return
+	}
+
+	info.hasTTL = true
+	info.ttl = ttl
+	info.age = ageFromTTL(setTTL, ttl)
+}
+
+//entryAge looks up the remaining TTL of a cache entry, deriving its age from the TTL it
+//was set with
+func (s *Server) entryAge(ctx context.Context, key string, setTTL time.Duration) (age time.Duration, ttl time.Duration, ok bool) {
+	t, ok := s.cache.(ttler)
+	if !ok {
+		return 0, 0, false
+	}
+
+	ttl, err := t.TTL(ctx, key)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return ageFromTTL(setTTL, ttl), ttl, true
+}
+
+//ageFromTTL derives the age of an entry from the TTL it was set with and its remaining
+//TTL. The age is approximate for entries set before the TTL was reloaded
+func ageFromTTL(setTTL time.Duration, ttl time.Duration) time.Duration {
+	if age := setTTL - ttl; age > 0 {
+		return age
+	}
+	return 0
+}
+
+//addCacheTime accumulates time spent on cache operations for the request
+func addCacheTime(ctx context.Context, d time.Duration) {
+	if info, ok := requestInfoFromContext(ctx); ok {
+		info.cacheTime += d
+	}
+}
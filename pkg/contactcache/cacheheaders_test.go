@@ -0,0 +1,157 @@
+package contactcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheHeaders(t *testing.T) {
+	contact := `{"contact_id": "person_1234", "Email": "chris@autopilothq.com"}`
+
+	srv, close, s := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, contact)
+	})
+	defer close()
+
+	srv.cfg().Admin.Token = "secret"
+	handler := srv.httpHandler()
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contact/chris@autopilothq.com", nil)
+	req.Header.Add(apiKeyHeader, "1234")
+
+	//Miss
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, "MISS", w.Result().Header.Get(cacheStatusHeader))
+	assert.Equal(t, "0", w.Result().Header.Get("Age"))
+	assert.Regexp(t, `^cache;dur=[0-9.]+, upstream;dur=[0-9.]+$`, w.Result().Header.Get("Server-Timing"))
+	assert.Empty(t, w.Result().Header.Get(cacheKeyHeader))
+
+	//Hit
+	s.FastForward(time.Minute)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	//Hits are aged without debugging
+	assert.Equal(t, "HIT", w.Result().Header.Get(cacheStatusHeader))
+	assert.Equal(t, "60", w.Result().Header.Get("Age"))
+	assert.Regexp(t, `^cache;dur=[0-9.]+$`, w.Result().Header.Get("Server-Timing"))
+	assert.Empty(t, w.Result().Header.Get(cacheKeyHeader))
+	assert.Empty(t, w.Result().Header.Get(cacheTTLHeader))
+
+	//Debug requires the admin token
+	req.Header.Set(cacheDebugHeader, "wrong")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Empty(t, w.Result().Header.Get(cacheKeyHeader))
+
+	req.Header.Set(cacheDebugHeader, "secret")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	sum := sha256.Sum256([]byte(srv.prefixKey("1234", "chris@autopilothq.com")))
+	assert.Equal(t, hex.EncodeToString(sum[:]), w.Result().Header.Get(cacheKeyHeader))
+	assert.Equal(t, "240", w.Result().Header.Get(cacheTTLHeader))
+	assert.Equal(t, "60", w.Result().Header.Get("Age"))
+
+	//List hits
+	listReq, _ := http.NewRequest("GET", "https://anywhere.local/v1/contacts", nil)
+	listReq.Header.Add(apiKeyHeader, "1234")
+	s.Set(srv.prefixKey("1234", "lists:"), `{"contacts": []}`)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, listReq)
+	assert.Equal(t, "HIT", w.Result().Header.Get(cacheStatusHeader))
+	assert.Equal(t, "0", w.Result().Header.Get("Age"))
+
+	//Uncached routes bypass the cache
+	passReq, _ := http.NewRequest("GET", "https://anywhere.local/v1/journeys", nil)
+	passReq.Header.Add(apiKeyHeader, "1234")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, passReq)
+	assert.Equal(t, "BYPASS", w.Result().Header.Get(cacheStatusHeader))
+	assert.Equal(t, "0", w.Result().Header.Get("Age"))
+}
+
+func TestCacheHeadersBypassWhenUnavailable(t *testing.T) {
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"contacts": []}`)
+	})
+	defer close()
+
+	srv.cacheHealth = NewHealthCheckedCache(&flakyCache{down: true}, HealthOpts{FailureThreshold: 10}, srv.log, srv.metrics)
+	srv.cache = srv.cacheHealth
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contacts", nil)
+	req.Header.Add(apiKeyHeader, "1234")
+
+	w := httptest.NewRecorder()
+	srv.httpHandler().ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, "BYPASS", w.Result().Header.Get(cacheStatusHeader))
+}
+
+func TestCacheHeadersNegative(t *testing.T) {
+	var beReqCount int32
+	srv, close, s := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&beReqCount, 1)
+		if r.Method == http.MethodPost {
+			fmt.Fprintln(w, `{"contact_id": "person_1234", "Email": "chris@autopilothq.com"}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error": "Not Found", "message": "Contact could not be found."}`)
+	})
+	defer close()
+
+	srv.cfg().Cache.NegativeTTL = time.Minute
+	handler := srv.httpHandler()
+
+	get := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contact/chris@autopilothq.com", nil)
+		req.Header.Add(apiKeyHeader, "1234")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get()
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "MISS", w.Result().Header.Get(cacheStatusHeader))
+	assert.True(t, s.Exists(negativeKey(srv.prefixKey("1234", "chris@autopilothq.com"))))
+
+	//Not found responses are served from the cache until they expire
+	s.FastForward(20 * time.Second)
+
+	w = get()
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "NEGATIVE", w.Result().Header.Get(cacheStatusHeader))
+	assert.Equal(t, "20", w.Result().Header.Get("Age"))
+	assert.Contains(t, w.Body.String(), "Contact could not be found.")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&beReqCount))
+
+	//Creating the contact through the proxy clears the not found response
+	req, _ := http.NewRequest("POST", "https://anywhere.local/v1/contact", strings.NewReader(`{"contact": {"Email": "chris@autopilothq.com"}}`))
+	req.Header.Add(apiKeyHeader, "1234")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	w = get()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "HIT", w.Result().Header.Get(cacheStatusHeader))
+}
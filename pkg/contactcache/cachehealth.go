@@ -0,0 +1,272 @@
+package contactcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//pinger caches which can check their own availability
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+//HealthOpts configures when the cache is considered unavailable
+type HealthOpts struct {
+	//Timeout for each cache operation
+	Timeout time.Duration
+	//FailureThreshold consecutive failures before cache calls are bypassed
+	FailureThreshold int
+	//CoolOff time between recovery probes while bypassed
+	CoolOff time.Duration
+}
+
+//cacheHealthOpts provides the configured cache health options
+func cacheHealthOpts(cfg CacheConfig) HealthOpts {
+	return HealthOpts{
+		Timeout:          cfg.Timeout,
+		FailureThreshold: cfg.FailureThreshold,
+		CoolOff:          cfg.CoolOff,
+	}
+}
+
+//NewHealthCheckedCache wraps a cacher, short-circuiting calls while it is failing
+func NewHealthCheckedCache(cache Cacher, opts HealthOpts, log *logrus.Logger, metrics *Metrics) *HealthCheckedCache {
+	if opts.FailureThreshold < 1 {
+		opts.FailureThreshold = 1
+	}
+
+	metrics.cacheAvailable.Set(1)
+
+	return &HealthCheckedCache{
+		cache:   cache,
+		opts:    opts,
+		log:     log,
+		metrics: metrics,
+		closed:  make(chan struct{}),
+	}
+}
+
+//HealthCheckedCache tracks failures of the underlying cache and bypasses it for a
+//cool-off period once failing, probing in the background for recovery
+type HealthCheckedCache struct {
+	cache   Cacher
+	opts    HealthOpts
+	log     *logrus.Logger
+	metrics *Metrics
+
+	mu       sync.Mutex
+	failures int
+	tripped  bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	probes    sync.WaitGroup
+}
+
+//Available checks if cache calls are currently being passed through
+func (hc *HealthCheckedCache) Available() bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	return !hc.tripped
+}
+
+//Set sets a cache key
+func (hc *HealthCheckedCache) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	if !hc.Available() {
+		hc.metrics.cacheBypassed.WithLabelValues("set").Add(1)
+		return ErrCacheUnavailable
+	}
+
+	ctx, cancel := hc.withTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	err := hc.cache.Set(ctx, key, value, ttl)
+	hc.record(ctx, "set", start, err)
+	return err
+}
+
+//Get gets a value from the cache
+func (hc *HealthCheckedCache) Get(ctx context.Context, key string) (string, error) {
+	if !hc.Available() {
+		hc.metrics.cacheBypassed.WithLabelValues("get").Add(1)
+		return "", ErrCacheUnavailable
+	}
+
+	ctx, cancel := hc.withTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	val, err := hc.cache.Get(ctx, key)
+	hc.record(ctx, "get", start, err)
+	return val, err
+}
+
+//Delete removes a value by key
+func (hc *HealthCheckedCache) Delete(ctx context.Context, key string) error {
+	if !hc.Available() {
+		hc.metrics.cacheBypassed.WithLabelValues("delete").Add(1)
+		return ErrCacheUnavailable
+	}
+
+	ctx, cancel := hc.withTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	err := hc.cache.Delete(ctx, key)
+	hc.record(ctx, "delete", start, err)
+	return err
+}
+
+//GetWithTTL gets a value along with its remaining TTL if supported by the underlying
+//cache, the TTL is negative otherwise
+func (hc *HealthCheckedCache) GetWithTTL(ctx context.Context, key string) (string, time.Duration, error) {
+	g, ok := hc.cache.(ttlGetter)
+	if !ok {
+		val, err := hc.Get(ctx, key)
+		return val, -1, err
+	}
+
+	if !hc.Available() {
+		hc.metrics.cacheBypassed.WithLabelValues("get").Add(1)
+		return "", 0, ErrCacheUnavailable
+	}
+
+	ctx, cancel := hc.withTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	val, ttl, err := g.GetWithTTL(ctx, key)
+	hc.record(ctx, "get", start, err)
+	return val, ttl, err
+}
+
+//TTL provides the remaining TTL of a key if supported by the underlying cache
+func (hc *HealthCheckedCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	t, ok := hc.cache.(ttler)
+	if !ok {
+		return 0, ErrCacheMiss
+	}
+
+	if !hc.Available() {
+		hc.metrics.cacheBypassed.WithLabelValues("ttl").Add(1)
+		return 0, ErrCacheUnavailable
+	}
+
+	ctx, cancel := hc.withTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	ttl, err := t.TTL(ctx, key)
+	hc.record(ctx, "ttl", start, err)
+	return ttl, err
+}
+
+func (hc *HealthCheckedCache) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if hc.opts.Timeout <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, hc.opts.Timeout)
+}
+
+//record tracks the result and latency of a cache operation, tripping once the failure
+//threshold is reached
+func (hc *HealthCheckedCache) record(ctx context.Context, op string, start time.Time, err error) {
+	result := "ok"
+	switch {
+	case errors.Is(err, ErrCacheMiss):
+		result = "miss"
+	case err != nil:
+		result = "error"
+	}
+	took := time.Since(start)
+	hc.metrics.cacheOperations.WithLabelValues(op, result).Observe(took.Seconds())
+	addCacheTime(ctx, took)
+
+	//Abandoned operations say nothing about the caches health
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+
+	if err == nil || errors.Is(err, ErrCacheMiss) {
+		hc.mu.Lock()
+		hc.failures = 0
+		hc.mu.Unlock()
+		return
+	}
+
+	hc.metrics.cacheErrors.WithLabelValues(op).Add(1)
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	hc.failures++
+	if hc.tripped || hc.failures < hc.opts.FailureThreshold {
+		return
+	}
+
+	hc.tripped = true
+	hc.metrics.cacheAvailable.Set(0)
+	hc.log.WithError(err).Error("cache unavailable, bypassing")
+
+	hc.probes.Add(1)
+	go hc.probe()
+}
+
+//probe periodically checks the cache until it recovers or is closed
+func (hc *HealthCheckedCache) probe() {
+	defer hc.probes.Done()
+
+	for {
+		select {
+		case <-hc.closed:
+			return
+		case <-time.After(hc.opts.CoolOff):
+		}
+
+		if hc.ping() == nil {
+			hc.mu.Lock()
+			hc.tripped = false
+			hc.failures = 0
+			hc.mu.Unlock()
+
+			hc.metrics.cacheAvailable.Set(1)
+			hc.log.Info("cache recovered")
+			return
+		}
+	}
+}
+
+//Close stops probing for recovery, waiting for a running probe to finish
+func (hc *HealthCheckedCache) Close() {
+	hc.closeOnce.Do(func() { close(hc.closed) })
+	hc.probes.Wait()
+}
+
+//ping checks the underlying cache is responding within the operation timeout
+func (hc *HealthCheckedCache) ping() error {
+	ctx, cancel := hc.withTimeout(context.Background())
+	defer cancel()
+
+	return hc.Ping(ctx)
+}
+
+//Ping checks the underlying cache is responding, regardless of whether calls are being bypassed
+func (hc *HealthCheckedCache) Ping(ctx context.Context) error {
+	if p, ok := hc.cache.(pinger); ok {
+		return p.Ping(ctx)
+	}
+
+	//Fall back to a read, where a miss still indicates the cache is responding
+	_, err := hc.cache.Get(ctx, "ping")
+	if errors.Is(err, ErrCacheMiss) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package contactcache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+//flakyCache a cacher which fails while down is set
+type flakyCache struct {
+	mu    sync.Mutex
+	down  bool
+	calls int
+}
+
+func (fc *flakyCache) setDown(down bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.down = down
+}
+
+func (fc *flakyCache) callCount() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.calls
+}
+
+func (fc *flakyCache) call() error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.calls++
+	if fc.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (fc *flakyCache) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return fc.call()
+}
+
+func (fc *flakyCache) Get(ctx context.Context, key string) (string, error) {
+	if err := fc.call(); err != nil {
+		return "", err
+	}
+	return "", ErrCacheMiss
+}
+
+func (fc *flakyCache) Delete(ctx context.Context, key string) error {
+	return fc.call()
+}
+
+func TestHealthCheckedCache(t *testing.T) {
+	inner := &flakyCache{}
+	hc := NewHealthCheckedCache(inner, HealthOpts{FailureThreshold: 2, CoolOff: 10 * time.Millisecond}, logrus.New(), NewMetrics())
+	t.Cleanup(hc.Close)
+	ctx := context.Background()
+
+	//Misses are not failures
+	_, err := hc.Get(ctx, "foo")
+	assert.True(t, errors.Is(err, ErrCacheMiss))
+	assert.True(t, hc.Available())
+
+	inner.setDown(true)
+	hc.Get(ctx, "foo")
+	hc.Get(ctx, "foo")
+	assert.False(t, hc.Available())
+
+	//Calls short-circuit while tripped
+	calls := inner.callCount()
+	_, err = hc.Get(ctx, "foo")
+	assert.True(t, errors.Is(err, ErrCacheUnavailable))
+	assert.True(t, errors.Is(hc.Set(ctx, "foo", "bar", time.Minute), ErrCacheUnavailable))
+
+	inner.setDown(false)
+
+	assert.Eventually(t, hc.Available, time.Second, 5*time.Millisecond)
+	assert.True(t, inner.callCount() > calls)
+}
+
+//cancelledCache a cacher whose operations are abandoned by the caller
+type cancelledCache struct {
+	flakyCache
+}
+
+func (cc *cancelledCache) Get(ctx context.Context, key string) (string, error) {
+	if err := cc.call(); err != nil {
+		return "", err
+	}
+	return "", ctx.Err()
+}
+
+func TestHealthCheckedCacheIgnoresCancellation(t *testing.T) {
+	inner := &cancelledCache{}
+	hc := NewHealthCheckedCache(inner, HealthOpts{FailureThreshold: 2, CoolOff: time.Minute}, logrus.New(), NewMetrics())
+	t.Cleanup(hc.Close)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	//Abandoned operations are neither failures
+	inner.setDown(true)
+	hc.Get(context.Background(), "foo")
+	inner.setDown(false)
+	hc.Get(expired, "foo")
+	assert.True(t, hc.Available())
+
+	//Nor reset the failure streak
+	hc.Get(cancelled, "foo")
+	inner.setDown(true)
+	hc.Get(context.Background(), "foo")
+	assert.False(t, hc.Available())
+}
+
+func TestCacheBypassedWhenUnavailable(t *testing.T) {
+	srv, beReqCount, close, s := setupTestServer(t, `{"contacts": []}`)
+	defer close()
+
+	apiKey := "1234"
+	s.Set(srv.prefixKey(apiKey, "lists:"), `{"contacts": []}`)
+
+	inner := &flakyCache{down: true}
+	srv.cacheHealth = NewHealthCheckedCache(inner, HealthOpts{FailureThreshold: 1, CoolOff: time.Minute}, srv.log, srv.metrics)
+	t.Cleanup(srv.cacheHealth.Close)
+	srv.cache = srv.cacheHealth
+
+	handler := srv.httpHandler()
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contacts", nil)
+	req.Header.Add(apiKeyHeader, apiKey)
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Result().StatusCode)
+	}
+
+	//Requests go straight to the backend without touching the cache once tripped
+	assert.Equal(t, 3, *beReqCount)
+	assert.Equal(t, 1, inner.callCount())
+}
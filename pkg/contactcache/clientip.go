@@ -0,0 +1,165 @@
+package contactcache
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+//Sources of the resolved client IP
+const (
+	clientIPPeer          = "peer"
+	clientIPProxyProtocol = "proxy_protocol"
+	clientIPForwarded     = "forwarded"
+)
+
+//clientAddr the resolved client IP and how it was resolved
+type clientAddr struct {
+	ip     string
+	source string
+}
+
+//resolveClientIP resolves the client IP from the connection, which may have come from a
+//PROXY protocol header, or the forwarded headers when sent by a trusted proxy
+func (s *Server) resolveClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := clientAddr{source: clientIPPeer}
+		if proxied, _ := r.Context().Value(ctxKeyProxyProtocol).(bool); proxied {
+			addr.source = clientIPProxyProtocol
+		}
+
+		peer := remoteIP(r.RemoteAddr)
+		if peer != nil {
+			addr.ip = peer.String()
+		}
+
+		trusted := s.cfg().ClientIP.trustedProxies()
+		if peer != nil && trusted.contains(peer) {
+			if ip := trusted.resolve(forwardedFor(r.Header)); ip != nil {
+				addr = clientAddr{ip: ip.String(), source: clientIPForwarded}
+			}
+		}
+
+		s.metrics.clientIPSource.WithLabelValues(addr.source).Inc()
+
+		next.ServeHTTP(w, r.WithContext(withClientAddr(r.Context(), addr)))
+	})
+}
+
+//clientIP provides the resolved client IP, or the peer address if unresolved. Empty for
+//unix socket peers
+func clientIP(r *http.Request) string {
+	if addr, ok := clientAddrFromContext(r.Context()); ok {
+		return addr.ip
+	}
+
+	if ip := remoteIP(r.RemoteAddr); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+//remoteIP parses the IP from a host:port remote address
+func remoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+//ipNets trusted proxy networks
+type ipNets []*net.IPNet
+
+func (n ipNets) contains(ip net.IP) bool {
+	for _, ipNet := range n {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//resolve walks the forwarded addresses from the nearest proxy, skipping trusted proxies.
+//The first untrusted address is the client. Unparseable addresses, such as obfuscated
+//identifiers, end the walk at the last proxy which could be parsed
+func (n ipNets) resolve(hops []string) net.IP {
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseForwardedAddr(hops[i])
+		if hop == nil {
+			break
+		}
+
+		ip = hop
+		if !n.contains(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+//forwardedFor lists the forwarded client and proxy addresses, furthest first. The
+//Forwarded header is preferred over X-Forwarded-For
+func forwardedFor(h http.Header) []string {
+	var hops []string
+
+	if forwarded := h.Values("Forwarded"); len(forwarded) > 0 {
+		for _, elements := range forwarded {
+			for _, element := range strings.Split(elements, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+					if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+						hops = append(hops, strings.Trim(kv[1], `"`))
+					}
+				}
+			}
+		}
+		return hops
+	}
+
+	for _, xff := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(xff, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+//parseForwardedAddr parses an IP, with an optional port and IPv6 brackets
+func parseForwardedAddr(addr string) net.IP {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+//trustedProxies parses the trusted proxy networks, bare IPs being a single address
+func (c ClientIPConfig) trustedProxies() ipNets {
+	nets := make(ipNets, 0, len(c.TrustedProxies))
+	for _, cidr := range c.TrustedProxies {
+		if ipNet, err := parseCIDR(cidr); err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	return nets
+}
+
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+		}
+	}
+
+	_, ipNet, err := net.ParseCIDR(cidr)
+	return ipNet, err
+}
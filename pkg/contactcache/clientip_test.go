@@ -0,0 +1,55 @@
+package contactcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	srv := &Server{metrics: NewMetrics()}
+	srv.applyConfig(DefaultConfig())
+	srv.cfg().ClientIP.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::1"}
+
+	var resolved clientAddr
+	handler := srv.resolveClientIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resolved, _ = clientAddrFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		ip         string
+		source     string
+	}{
+		{"peer", "203.0.113.7:41234", nil, "203.0.113.7", clientIPPeer},
+		{"untrusted peer", "203.0.113.7:41234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.7", clientIPPeer},
+		{"trusted peer", "10.0.0.1:41234", map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.2"}, "198.51.100.1", clientIPForwarded},
+		{"spoofed hops", "10.0.0.1:41234", map[string]string{"X-Forwarded-For": "192.0.2.1, 198.51.100.1"}, "198.51.100.1", clientIPForwarded},
+		{"all trusted", "10.0.0.1:41234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3", clientIPForwarded},
+		{"trusted without headers", "10.0.0.1:41234", nil, "10.0.0.1", clientIPPeer},
+		{"forwarded preferred", "[2001:db8::1]:41234", map[string]string{
+			"Forwarded":       `for="[2001:db8::cafe]:4711";proto=https, for=10.0.0.2`,
+			"X-Forwarded-For": "198.51.100.1",
+		}, "2001:db8::cafe", clientIPForwarded},
+		{"obfuscated", "10.0.0.1:41234", map[string]string{"Forwarded": "for=_hidden, for=10.0.0.2"}, "10.0.0.2", clientIPForwarded},
+		{"unix socket", "@", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "", clientIPPeer},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/v1/contacts", nil)
+		req.RemoteAddr = test.remoteAddr
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, clientAddr{ip: test.ip, source: test.source}, resolved, test.name)
+	}
+
+	assert.Equal(t, float64(5), testutil.ToFloat64(srv.metrics.clientIPSource.WithLabelValues(clientIPForwarded)))
+}
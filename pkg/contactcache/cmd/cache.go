@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/tcfw/test-contactcache/pkg/contactcache"
+)
+
+func newCacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Inspect, purge and warm a tenants cache",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+
+	cmd.PersistentFlags().StringP("api-key", "k", "", "Tenant API key, hashed locally")
+	cmd.PersistentFlags().String("tenant", "", "Tenant as the sha256 hash of the API key")
+
+	cmd.AddCommand(newCacheGetCmd())
+	cmd.AddCommand(newCachePurgeCmd())
+	cmd.AddCommand(newCacheLsCmd())
+	cmd.AddCommand(newCacheStatsCmd())
+	cmd.AddCommand(newCacheWarmCmd())
+
+	return cmd
+}
+
+func newCacheGetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:          "get <idOrEmail>",
+		Short:        "Show a cached contact by email or person ID",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withManager(cmd, func(ctx context.Context, cm *contactcache.CacheManager, tenant string) error {
+				entry, err := cm.Lookup(ctx, tenant, args[0])
+				if err == contactcache.ErrCacheMiss {
+					return fmt.Errorf("%s is not cached", args[0])
+				} else if err != nil {
+					return err
+				}
+
+				return printJSON(entry)
+			})
+		},
+	}
+}
+
+func newCachePurgeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "purge [idOrEmail]",
+		Short:        "Remove a cached contact, the tenants list responses or the whole tenant",
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			lists, _ := cmd.Flags().GetBool("lists")
+			all, _ := cmd.Flags().GetBool("all")
+
+			if len(args) == 0 && !lists && !all {
+				return fmt.Errorf("provide an email or person ID, --lists or --all")
+			}
+
+			return withManager(cmd, func(ctx context.Context, cm *contactcache.CacheManager, tenant string) error {
+				var n int64
+				var err error
+
+				switch {
+				case all:
+					n, err = cm.PurgeTenant(ctx, tenant)
+				case len(args) == 1:
+					n, err = cm.PurgeContact(ctx, tenant, args[0])
+				default:
+					n, err = cm.PurgeLists(ctx, tenant)
+				}
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("deleted %d keys\n", n)
+				return nil
+			})
+		},
+	}
+
+	cmd.Flags().Bool("lists", false, "Remove the tenants cached list responses")
+	cmd.Flags().Bool("all", false, "Remove all of the tenants cache entries")
+
+	return cmd
+}
+
+func newCacheLsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:          "ls",
+		Short:        "List the tenants cached keys and their TTLs",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withManager(cmd, func(ctx context.Context, cm *contactcache.CacheManager, tenant string) error {
+				entries, err := cm.Keys(ctx, tenant)
+				if err != nil {
+					return err
+				}
+
+				tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(tw, "KEY\tTTL")
+				for _, entry := range entries {
+					fmt.Fprintf(tw, "%s\t%.0fs\n", entry.Key, entry.TTL)
+				}
+				return tw.Flush()
+			})
+		},
+	}
+}
+
+func newCacheStatsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:          "stats",
+		Short:        "Show the tenants cache hit/miss stats",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withManager(cmd, func(ctx context.Context, cm *contactcache.CacheManager, tenant string) error {
+				stats, err := cm.Stats(ctx, tenant)
+				if err != nil {
+					return err
+				}
+
+				return printJSON(stats)
+			})
+		},
+	}
+}
+
+func newCacheWarmCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "warm",
+		Short:        "Pre-populate the tenants cache by walking the backends contact list",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			//The backend requires the API key itself
+			apiKey, _ := cmd.Flags().GetString("api-key")
+			if apiKey == "" {
+				return fmt.Errorf("warming requires --api-key")
+			}
+			maxPages, _ := cmd.Flags().GetInt("max-pages")
+
+			readConfig()
+
+			cfg, err := contactcache.LoadConfig()
+			if err != nil {
+				return err
+			}
+
+			srv, err := contactcache.NewServer(cfg)
+			if err != nil {
+				return err
+			}
+
+			pages, contacts, err := srv.Warm(context.Background(), apiKey, maxPages)
+			fmt.Printf("cached %d pages, %d contacts\n", pages, contacts)
+			return err
+		},
+	}
+
+	cmd.Flags().Int("max-pages", 0, "Maximum list pages to walk, 0 for all")
+
+	return cmd
+}
+
+//withManager runs fn against the configured cache for the tenant given by --api-key or --tenant
+func withManager(cmd *cobra.Command, fn func(context.Context, *contactcache.CacheManager, string) error) error {
+	tenant, err := tenantFromFlags(cmd)
+	if err != nil {
+		return err
+	}
+
+	readConfig()
+
+	cfg, err := contactcache.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	cm, err := contactcache.NewCacheManagerFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+	defer cm.Close()
+
+	return fn(context.Background(), cm, tenant)
+}
+
+//tenantFromFlags hashes the --api-key flag or validates the --tenant flag
+func tenantFromFlags(cmd *cobra.Command) (string, error) {
+	apiKey, _ := cmd.Flags().GetString("api-key")
+	tenant, _ := cmd.Flags().GetString("tenant")
+
+	switch {
+	case apiKey != "" && tenant != "":
+		return "", fmt.Errorf("provide only one of --api-key or --tenant")
+	case apiKey != "":
+		return contactcache.TenantHash(apiKey), nil
+	case tenant == "":
+		return "", fmt.Errorf("provide --api-key or --tenant")
+	case !contactcache.ValidTenant(tenant):
+		return "", fmt.Errorf("tenant must be the sha256 hash of the API key")
+	}
+
+	return tenant, nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
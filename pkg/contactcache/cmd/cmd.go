@@ -16,6 +16,8 @@ func NewContactCacheCmd() *cobra.Command {
 	}
 
 	cmd.AddCommand(newServeCmd())
+	cmd.AddCommand(newCacheCmd())
+	cmd.AddCommand(newConfigCmd())
 
 	viper.SetConfigName("config")              // name of config file (without extension)
 	viper.SetConfigType("yaml")                // REQUIRED if the config file does not have the extension in the name
@@ -25,3 +27,14 @@ func NewContactCacheCmd() *cobra.Command {
 
 	return cmd
 }
+
+//readConfig reads the config file if one can be found
+func readConfig() {
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			// Config file not found; ignore error
+		} else {
+			panic(err)
+		}
+	}
+}
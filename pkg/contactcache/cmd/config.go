@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tcfw/test-contactcache/pkg/contactcache"
+	"gopkg.in/yaml.v2"
+)
+
+func newConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+
+	cmd.AddCommand(newConfigValidateCmd())
+
+	return cmd
+}
+
+func newConfigValidateCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:          "validate",
+		Short:        "Validate the configuration and print the effective config with secrets redacted",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			readConfig()
+
+			cfg, err := contactcache.LoadConfig()
+			if err != nil {
+				return err
+			}
+
+			out, err := yaml.Marshal(cfg.Redacted())
+			if err != nil {
+				return err
+			}
+
+			if file := viper.ConfigFileUsed(); file != "" {
+				fmt.Fprintf(os.Stderr, "# %s\n", file)
+			}
+			os.Stdout.Write(out)
+
+			return nil
+		},
+	}
+}
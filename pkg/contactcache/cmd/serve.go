@@ -1,6 +1,12 @@
 package cmd
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/tcfw/test-contactcache/pkg/contactcache"
@@ -11,19 +17,36 @@ func newServeCmd() *cobra.Command {
 		Use:   "start",
 		Short: "Start the server",
 		Run: func(cmd *cobra.Command, args []string) {
-			if err := viper.ReadInConfig(); err != nil {
-				if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-					// Config file not found; ignore error
-				} else {
-					panic(err)
-				}
+			readConfig()
+
+			cfg, err := contactcache.LoadConfig()
+			if err != nil {
+				panic(err)
 			}
 
-			srv, err := contactcache.NewServer()
+			srv, err := contactcache.NewServer(cfg)
 			if err != nil {
 				panic(err)
 			}
-			if err := srv.Start(); err != nil {
+
+			//Reload on config file changes or SIGHUP, gracefully shutdown on termination
+			srv.WatchConfig()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+			go func() {
+				for sig := range sigs {
+					if sig == syscall.SIGHUP {
+						srv.ReloadConfig()
+						continue
+					}
+					cancel()
+					return
+				}
+			}()
+
+			if err := srv.Start(ctx); err != nil {
 				panic(err)
 			}
 		},
@@ -34,12 +57,14 @@ func newServeCmd() *cobra.Command {
 	cmd.Flags().StringP("listen", "l", ":443", "Listening address")
 	cmd.Flags().String("metrics-listen", ":9102", "Metrics listening address")
 	cmd.Flags().StringP("target", "t", "https://api2.autopilothq.com", "Metrics listening address")
+	cmd.Flags().Duration("shutdown-timeout", 30*time.Second, "Time allowed for graceful shutdown")
 
 	viper.BindPFlag("tls.key", cmd.Flags().Lookup("tls-key"))
 	viper.BindPFlag("tls.cert", cmd.Flags().Lookup("tls-cert"))
 	viper.BindPFlag("address", cmd.Flags().Lookup("listen"))
 	viper.BindPFlag("backend.address", cmd.Flags().Lookup("target"))
 	viper.BindPFlag("metrics.address", cmd.Flags().Lookup("metrics-listen"))
+	viper.BindPFlag("shutdown.timeout", cmd.Flags().Lookup("shutdown-timeout"))
 
 	return cmd
 }
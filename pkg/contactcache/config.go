@@ -1,8 +1,875 @@
 package contactcache
 
-import "github.com/spf13/viper"
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
-//defaultConfig sets the main default configs
-func defaultConfig() {
-	viper.SetDefault("cache.address", "127.0.0.1:6379")
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	redacted = "REDACTED"
+)
+
+//Config typed server configuration, unmarshalled from viper
+type Config struct {
+	Address   string           `mapstructure:"address" yaml:"address"`
+	Listeners []ListenerConfig `mapstructure:"listeners" yaml:"listeners"`
+	ClientIP  ClientIPConfig   `mapstructure:"client_ip" yaml:"client_ip"`
+	Log       LogConfig        `mapstructure:"log" yaml:"log"`
+	TLS       TLSConfig        `mapstructure:"tls" yaml:"tls"`
+	Backend   BackendConfig    `mapstructure:"backend" yaml:"backend"`
+	Metrics   MetricsConfig    `mapstructure:"metrics" yaml:"metrics"`
+	Admin     AdminConfig      `mapstructure:"admin" yaml:"admin"`
+	Cache     CacheConfig      `mapstructure:"cache" yaml:"cache"`
+	RateLimit RateLimitConfig  `mapstructure:"ratelimit" yaml:"ratelimit"`
+	Upstream  UpstreamConfig   `mapstructure:"upstream" yaml:"upstream"`
+	Shadow    ShadowConfig     `mapstructure:"shadow" yaml:"shadow"`
+	Webhooks  WebhooksConfig   `mapstructure:"webhooks" yaml:"webhooks"`
+	Outbox    OutboxConfig     `mapstructure:"outbox" yaml:"outbox"`
+	Events    EventsConfig     `mapstructure:"events" yaml:"events"`
+	SSE       SSEConfig        `mapstructure:"sse" yaml:"sse"`
+	Health    HealthConfig     `mapstructure:"health" yaml:"health"`
+	Stats     StatsConfig      `mapstructure:"stats" yaml:"stats"`
+	Shutdown  ShutdownConfig   `mapstructure:"shutdown" yaml:"shutdown"`
+	Tracing   TracingConfig    `mapstructure:"tracing" yaml:"tracing"`
+}
+
+//LogConfig server logging
+type LogConfig struct {
+	Level  string `mapstructure:"level" yaml:"level"`
+	Format string `mapstructure:"format" yaml:"format"`
+}
+
+//ListenerConfig a socket serving the proxy, without any listeners HTTPS is served on
+//address. The network is tcp, unix or systemd (socket activation). The address is the
+//host:port for tcp, the socket path for unix or the FileDescriptorName for systemd, an
+//empty systemd name using the first passed socket. The protocol is https, http or h2c
+//(cleartext HTTP/2). Unix socket permissions can be set with an octal socket_mode. With
+//proxy_protocol every connection must start with a PROXY protocol v1 or v2 header
+type ListenerConfig struct {
+	Network       string `mapstructure:"network" yaml:"network"`
+	Address       string `mapstructure:"address" yaml:"address"`
+	Protocol      string `mapstructure:"protocol" yaml:"protocol"`
+	SocketMode    string `mapstructure:"socket_mode" yaml:"socket_mode"`
+	ProxyProtocol bool   `mapstructure:"proxy_protocol" yaml:"proxy_protocol"`
+}
+
+//ClientIPConfig proxies, as CIDRs or IPs, trusted to set the Forwarded and
+//X-Forwarded-For headers
+type ClientIPConfig struct {
+	TrustedProxies []string `mapstructure:"trusted_proxies" yaml:"trusted_proxies"`
+}
+
+//TLSConfig certificate and key files, reloaded when changed
+type TLSConfig struct {
+	Cert           string          `mapstructure:"cert" yaml:"cert"`
+	Key            string          `mapstructure:"key" yaml:"key"`
+	OCSPStaple     string          `mapstructure:"ocsp_staple" yaml:"ocsp_staple"`
+	ReloadInterval time.Duration   `mapstructure:"reload_interval" yaml:"reload_interval"`
+	Profile        string          `mapstructure:"profile" yaml:"profile"`
+	MinVersion     string          `mapstructure:"min_version" yaml:"min_version"`
+	MaxVersion     string          `mapstructure:"max_version" yaml:"max_version"`
+	CipherSuites   []string        `mapstructure:"cipher_suites" yaml:"cipher_suites"`
+	Curves         []string        `mapstructure:"curves" yaml:"curves"`
+	Client         ClientTLSConfig `mapstructure:"client" yaml:"client"`
+}
+
+//ClientTLSConfig optional mTLS, binding client certificates to the API keys they may use
+type ClientTLSConfig struct {
+	CA       string          `mapstructure:"ca" yaml:"ca"`
+	Required bool            `mapstructure:"required" yaml:"required"`
+	Bindings []ClientBinding `mapstructure:"bindings" yaml:"bindings"`
+}
+
+//ClientBinding allows a client certificate subject, matched against the common name or
+//any SAN, to use the listed API keys or tenants (hashed API keys)
+type ClientBinding struct {
+	Subject string   `mapstructure:"subject" yaml:"subject"`
+	APIKeys []string `mapstructure:"api_keys" yaml:"api_keys"`
+	Tenants []string `mapstructure:"tenants" yaml:"tenants"`
+}
+
+//BackendConfig the proxied API, either a single address or a pool of upstreams balanced
+//by the strategy (round_robin, least_conn or weighted)
+type BackendConfig struct {
+	Address     string             `mapstructure:"address" yaml:"address"`
+	Pool        []PoolMemberConfig `mapstructure:"pool" yaml:"pool,omitempty"`
+	Strategy    string             `mapstructure:"strategy" yaml:"strategy"`
+	HealthCheck ActiveHealthConfig `mapstructure:"health_check" yaml:"health_check"`
+	Outlier     OutlierConfig      `mapstructure:"outlier" yaml:"outlier"`
+}
+
+//ShadowConfig mirrors a percentage of backend traffic with the listed methods to a
+//shadow backend, comparing the responses. Disabled without an address. Ignored fields
+//are skipped when comparing JSON bodies and redacted fields are never logged
+type ShadowConfig struct {
+	Address      string        `mapstructure:"address" yaml:"address"`
+	Percent      float64       `mapstructure:"percent" yaml:"percent"`
+	Methods      []string      `mapstructure:"methods" yaml:"methods"`
+	Timeout      time.Duration `mapstructure:"timeout" yaml:"timeout"`
+	MaxBodySize  int64         `mapstructure:"max_body_size" yaml:"max_body_size"`
+	MaxInFlight  int           `mapstructure:"max_in_flight" yaml:"max_in_flight"`
+	IgnoreFields []string      `mapstructure:"ignore_fields" yaml:"ignore_fields"`
+	RedactFields []string      `mapstructure:"redact_fields" yaml:"redact_fields"`
+}
+
+//PoolMemberConfig an upstream in the backend pool
+type PoolMemberConfig struct {
+	Address string `mapstructure:"address" yaml:"address"`
+	Weight  int    `mapstructure:"weight" yaml:"weight"`
+}
+
+//ActiveHealthConfig periodic upstream health checks, disabled with a zero interval
+type ActiveHealthConfig struct {
+	Interval           time.Duration `mapstructure:"interval" yaml:"interval"`
+	Timeout            time.Duration `mapstructure:"timeout" yaml:"timeout"`
+	Path               string        `mapstructure:"path" yaml:"path"`
+	HealthyThreshold   int           `mapstructure:"healthy_threshold" yaml:"healthy_threshold"`
+	UnhealthyThreshold int           `mapstructure:"unhealthy_threshold" yaml:"unhealthy_threshold"`
+}
+
+//OutlierConfig passive ejection of upstreams after consecutive failed requests, disabled
+//with zero consecutive failures
+type OutlierConfig struct {
+	ConsecutiveFailures int           `mapstructure:"consecutive_failures" yaml:"consecutive_failures"`
+	EjectionDuration    time.Duration `mapstructure:"ejection_duration" yaml:"ejection_duration"`
+	MaxEjectionPercent  int           `mapstructure:"max_ejection_percent" yaml:"max_ejection_percent"`
+}
+
+//MetricsConfig the metrics and health endpoint
+type MetricsConfig struct {
+	Address string `mapstructure:"address" yaml:"address"`
+}
+
+//AdminConfig the admin API, disabled unless an address is set
+type AdminConfig struct {
+	Address string         `mapstructure:"address" yaml:"address"`
+	Token   string         `mapstructure:"token" yaml:"token"`
+	TLS     AdminTLSConfig `mapstructure:"tls" yaml:"tls"`
+}
+
+//AdminTLSConfig admin API certificates and the CA used to verify client certificates
+type AdminTLSConfig struct {
+	Cert     string `mapstructure:"cert" yaml:"cert"`
+	Key      string `mapstructure:"key" yaml:"key"`
+	ClientCA string `mapstructure:"client_ca" yaml:"client_ca"`
+}
+
+//WebhooksConfig receives Autopilot contact events on the path, disabled if empty, to
+//invalidate or refresh the affected cache entries. Each endpoint maps a shared secret to
+//a tenant, refreshing requires the tenants API key. Repeated deliveries within the
+//dedupe TTL are ignored
+type WebhooksConfig struct {
+	Path      string                  `mapstructure:"path" yaml:"path"`
+	Endpoints []WebhookEndpointConfig `mapstructure:"endpoints" yaml:"endpoints"`
+	Refresh   bool                    `mapstructure:"refresh" yaml:"refresh"`
+	DedupeTTL time.Duration           `mapstructure:"dedupe_ttl" yaml:"dedupe_ttl"`
+}
+
+//WebhookEndpointConfig a webhook secret and the tenant, or API key, its events are for
+type WebhookEndpointConfig struct {
+	Secret string `mapstructure:"secret" yaml:"secret"`
+	Tenant string `mapstructure:"tenant" yaml:"tenant"`
+	APIKey string `mapstructure:"api_key" yaml:"api_key"`
+}
+
+//tenant the hashed API key the endpoints events are for
+func (e WebhookEndpointConfig) tenant() string {
+	if e.APIKey != "" {
+		return tenantHash(e.APIKey)
+	}
+	return e.Tenant
+}
+
+//OutboxConfig the durable queue of failed cache invalidations and change events, retried
+//with exponential backoff until they succeed or reach the maximum attempts and are dead
+//lettered. The queue is written to a local WAL at the path, or only kept in memory if
+//empty
+type OutboxConfig struct {
+	Path        string        `mapstructure:"path" yaml:"path"`
+	MaxAttempts int           `mapstructure:"max_attempts" yaml:"max_attempts"`
+	Backoff     time.Duration `mapstructure:"backoff" yaml:"backoff"`
+	MaxBackoff  time.Duration `mapstructure:"max_backoff" yaml:"max_backoff"`
+}
+
+//EventsConfig publishes change events to the sink, none disables, for contact upserts
+//and deletes once the backend confirms them. Events are queued in the outbox and
+//retried until the sink accepts them
+type EventsConfig struct {
+	Sink  string                `mapstructure:"sink" yaml:"sink"`
+	Redis RedisStreamSinkConfig `mapstructure:"redis" yaml:"redis"`
+	HTTP  HTTPSinkConfig        `mapstructure:"http" yaml:"http"`
+}
+
+//RedisStreamSinkConfig the stream in the cache redis events are added to, trimmed to
+//approximately the max length
+type RedisStreamSinkConfig struct {
+	Stream string `mapstructure:"stream" yaml:"stream"`
+	MaxLen int64  `mapstructure:"max_len" yaml:"max_len"`
+}
+
+//HTTPSinkConfig the URL events are POSTed to, signed with the secret if set
+type HTTPSinkConfig struct {
+	URL     string        `mapstructure:"url" yaml:"url"`
+	Secret  string        `mapstructure:"secret" yaml:"secret"`
+	Timeout time.Duration `mapstructure:"timeout" yaml:"timeout"`
+}
+
+//SSEConfig streams notices of contacts being invalidated or cached as server-sent
+//events, shared between replicas over the redis pub/sub channel. The most recent notices
+//are kept so reconnecting clients can resume
+type SSEConfig struct {
+	Enabled    bool          `mapstructure:"enabled" yaml:"enabled"`
+	Channel    string        `mapstructure:"channel" yaml:"channel"`
+	Heartbeat  time.Duration `mapstructure:"heartbeat" yaml:"heartbeat"`
+	Replay     int           `mapstructure:"replay" yaml:"replay"`
+	MaxStreams int           `mapstructure:"max_streams" yaml:"max_streams"`
+}
+
+//CacheConfig redis connection and cache behaviour
+type CacheConfig struct {
+	Address          string        `mapstructure:"address" yaml:"address"`
+	Password         string        `mapstructure:"password" yaml:"password"`
+	TTL              time.Duration `mapstructure:"ttl" yaml:"ttl"`
+	DB               int           `mapstructure:"db" yaml:"db"`
+	DialTimeout      time.Duration `mapstructure:"dial_timeout" yaml:"dial_timeout"`
+	ReadTimeout      time.Duration `mapstructure:"read_timeout" yaml:"read_timeout"`
+	WriteTimeout     time.Duration `mapstructure:"write_timeout" yaml:"write_timeout"`
+	Timeout          time.Duration `mapstructure:"timeout" yaml:"timeout"`
+	FailureThreshold int           `mapstructure:"failure_threshold" yaml:"failure_threshold"`
+	CoolOff          time.Duration `mapstructure:"cool_off" yaml:"cool_off"`
+	StaleTTL         time.Duration `mapstructure:"stale_ttl" yaml:"stale_ttl"`
+	NegativeTTL      time.Duration `mapstructure:"negative_ttl" yaml:"negative_ttl"`
+	Verify           VerifyConfig  `mapstructure:"verify" yaml:"verify"`
+}
+
+//VerifyConfig samples cache hits, comparing them with the live backend response to
+//measure staleness. Stale entries are optionally invalidated
+type VerifyConfig struct {
+	SampleRatio float64       `mapstructure:"sample_ratio" yaml:"sample_ratio"`
+	Timeout     time.Duration `mapstructure:"timeout" yaml:"timeout"`
+	MaxInFlight int           `mapstructure:"max_in_flight" yaml:"max_in_flight"`
+	Invalidate  bool          `mapstructure:"invalidate" yaml:"invalidate"`
+}
+
+//RateLimitConfig per tenant request budgets
+type RateLimitConfig struct {
+	Enabled bool                         `mapstructure:"enabled" yaml:"enabled"`
+	Cache   LimitConfig                  `mapstructure:"cache" yaml:"cache"`
+	Backend LimitConfig                  `mapstructure:"backend" yaml:"backend"`
+	Client  LimitConfig                  `mapstructure:"client" yaml:"client"`
+	Tenants map[string]TenantLimitConfig `mapstructure:"tenants" yaml:"tenants,omitempty"`
+}
+
+//LimitConfig a token bucket
+type LimitConfig struct {
+	Rate  float64 `mapstructure:"rate" yaml:"rate"`
+	Burst int     `mapstructure:"burst" yaml:"burst"`
+}
+
+//TenantLimitConfig overrides the default budgets for a tenant
+type TenantLimitConfig struct {
+	Cache   *LimitConfig `mapstructure:"cache" yaml:"cache,omitempty"`
+	Backend *LimitConfig `mapstructure:"backend" yaml:"backend,omitempty"`
+}
+
+//UpstreamConfig backend request handling
+type UpstreamConfig struct {
+	RateLimit UpstreamRateLimitConfig `mapstructure:"ratelimit" yaml:"ratelimit"`
+	Timeout   UpstreamTimeoutConfig   `mapstructure:"timeout" yaml:"timeout"`
+	Retry     RetryConfig             `mapstructure:"retry" yaml:"retry"`
+	Breaker   BreakerConfig           `mapstructure:"breaker" yaml:"breaker"`
+}
+
+//UpstreamRateLimitConfig handling of tenants rate limited by the backend
+type UpstreamRateLimitConfig struct {
+	ServeStale        bool          `mapstructure:"serve_stale" yaml:"serve_stale"`
+	MaxWait           time.Duration `mapstructure:"max_wait" yaml:"max_wait"`
+	MaxQueue          int           `mapstructure:"max_queue" yaml:"max_queue"`
+	DefaultRetryAfter time.Duration `mapstructure:"default_retry_after" yaml:"default_retry_after"`
+}
+
+//UpstreamTimeoutConfig backend transport timeouts
+type UpstreamTimeoutConfig struct {
+	Dial           time.Duration `mapstructure:"dial" yaml:"dial"`
+	TLSHandshake   time.Duration `mapstructure:"tls_handshake" yaml:"tls_handshake"`
+	ResponseHeader time.Duration `mapstructure:"response_header" yaml:"response_header"`
+	Idle           time.Duration `mapstructure:"idle" yaml:"idle"`
+	Overall        time.Duration `mapstructure:"overall" yaml:"overall"`
+}
+
+//RetryConfig retries of idempotent backend requests
+type RetryConfig struct {
+	Max        int           `mapstructure:"max" yaml:"max"`
+	Backoff    time.Duration `mapstructure:"backoff" yaml:"backoff"`
+	MaxBackoff time.Duration `mapstructure:"max_backoff" yaml:"max_backoff"`
+}
+
+//BreakerConfig the backend circuit breaker
+type BreakerConfig struct {
+	Enabled          bool          `mapstructure:"enabled" yaml:"enabled"`
+	Window           time.Duration `mapstructure:"window" yaml:"window"`
+	MinRequests      int           `mapstructure:"min_requests" yaml:"min_requests"`
+	ErrorRate        float64       `mapstructure:"error_rate" yaml:"error_rate"`
+	OpenDuration     time.Duration `mapstructure:"open_duration" yaml:"open_duration"`
+	HalfOpenRequests int           `mapstructure:"half_open_requests" yaml:"half_open_requests"`
+}
+
+//HealthConfig readiness probing
+type HealthConfig struct {
+	Timeout  time.Duration          `mapstructure:"timeout" yaml:"timeout"`
+	CacheTTL time.Duration          `mapstructure:"cache_ttl" yaml:"cache_ttl"`
+	Redis    DependencyHealthConfig `mapstructure:"redis" yaml:"redis"`
+	Backend  BackendHealthConfig    `mapstructure:"backend" yaml:"backend"`
+}
+
+//DependencyHealthConfig whether a failing dependency fails readiness
+type DependencyHealthConfig struct {
+	Fatal bool `mapstructure:"fatal" yaml:"fatal"`
+}
+
+//BackendHealthConfig backend readiness probing
+type BackendHealthConfig struct {
+	Fatal bool   `mapstructure:"fatal" yaml:"fatal"`
+	Path  string `mapstructure:"path" yaml:"path"`
+}
+
+//StatsConfig per tenant stats
+type StatsConfig struct {
+	FlushInterval time.Duration `mapstructure:"flush_interval" yaml:"flush_interval"`
+}
+
+//ShutdownConfig graceful shutdown
+type ShutdownConfig struct {
+	Timeout time.Duration `mapstructure:"timeout" yaml:"timeout"`
+	Delay   time.Duration `mapstructure:"delay" yaml:"delay"`
+}
+
+//TracingConfig OpenTelemetry span exporting
+type TracingConfig struct {
+	//Exporter one of none, stdout or otlp
+	Exporter    string     `mapstructure:"exporter" yaml:"exporter"`
+	ServiceName string     `mapstructure:"service_name" yaml:"service_name"`
+	SampleRatio float64    `mapstructure:"sample_ratio" yaml:"sample_ratio"`
+	OTLP        OTLPConfig `mapstructure:"otlp" yaml:"otlp"`
+}
+
+//OTLPConfig OTLP/HTTP collector
+type OTLPConfig struct {
+	//Endpoint host:port of the collector, defaults to the OTEL_EXPORTER_OTLP_ENDPOINT env or localhost
+	Endpoint string `mapstructure:"endpoint" yaml:"endpoint"`
+	Insecure bool   `mapstructure:"insecure" yaml:"insecure"`
+}
+
+//DefaultConfig provides the main default configs
+func DefaultConfig() *Config {
+	return &Config{
+		Address: ":443",
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		TLS: TLSConfig{
+			ReloadInterval: 30 * time.Second,
+			Profile:        "intermediate",
+			Client: ClientTLSConfig{
+				Required: true,
+			},
+		},
+		Backend: BackendConfig{
+			Strategy: strategyRoundRobin,
+			HealthCheck: ActiveHealthConfig{
+				Interval:           10 * time.Second,
+				Timeout:            2 * time.Second,
+				Path:               "/",
+				HealthyThreshold:   2,
+				UnhealthyThreshold: 2,
+			},
+			Outlier: OutlierConfig{
+				ConsecutiveFailures: 5,
+				EjectionDuration:    30 * time.Second,
+				MaxEjectionPercent:  50,
+			},
+		},
+		Shadow: ShadowConfig{
+			Methods:     []string{http.MethodGet},
+			Timeout:     5 * time.Second,
+			MaxBodySize: 1 << 20,
+			MaxInFlight: 50,
+		},
+		Webhooks: WebhooksConfig{
+			DedupeTTL: 10 * time.Minute,
+		},
+		Outbox: OutboxConfig{
+			MaxAttempts: 20,
+			Backoff:     500 * time.Millisecond,
+			MaxBackoff:  time.Minute,
+		},
+		Events: EventsConfig{
+			Sink: sinkNone,
+			Redis: RedisStreamSinkConfig{
+				Stream: "contactcache:changes",
+				MaxLen: 100000,
+			},
+			HTTP: HTTPSinkConfig{
+				Timeout: 5 * time.Second,
+			},
+		},
+		SSE: SSEConfig{
+			Channel:    "contactcache:notices",
+			Heartbeat:  15 * time.Second,
+			Replay:     1000,
+			MaxStreams: 1000,
+		},
+		Metrics: MetricsConfig{
+			Address: ":9102",
+		},
+		Cache: CacheConfig{
+			Address:          "127.0.0.1:6379",
+			TTL:              5 * time.Minute,
+			DialTimeout:      1 * time.Second,
+			ReadTimeout:      500 * time.Millisecond,
+			WriteTimeout:     500 * time.Millisecond,
+			Timeout:          250 * time.Millisecond,
+			FailureThreshold: 5,
+			CoolOff:          5 * time.Second,
+			StaleTTL:         1 * time.Hour,
+			Verify: VerifyConfig{
+				Timeout:     5 * time.Second,
+				MaxInFlight: 10,
+			},
+		},
+		RateLimit: RateLimitConfig{
+			Cache:   LimitConfig{Rate: 50, Burst: 100},
+			Backend: LimitConfig{Rate: 5, Burst: 10},
+		},
+		Upstream: UpstreamConfig{
+			RateLimit: UpstreamRateLimitConfig{
+				ServeStale:        true,
+				MaxWait:           2 * time.Second,
+				MaxQueue:          100,
+				DefaultRetryAfter: 5 * time.Second,
+			},
+			Timeout: UpstreamTimeoutConfig{
+				Dial:           5 * time.Second,
+				TLSHandshake:   5 * time.Second,
+				ResponseHeader: 10 * time.Second,
+				Idle:           90 * time.Second,
+				Overall:        30 * time.Second,
+			},
+			Retry: RetryConfig{
+				Max:        2,
+				Backoff:    100 * time.Millisecond,
+				MaxBackoff: 1 * time.Second,
+			},
+			Breaker: BreakerConfig{
+				Enabled:          true,
+				Window:           10 * time.Second,
+				MinRequests:      20,
+				ErrorRate:        0.5,
+				OpenDuration:     30 * time.Second,
+				HalfOpenRequests: 1,
+			},
+		},
+		Health: HealthConfig{
+			Timeout:  2 * time.Second,
+			CacheTTL: 5 * time.Second,
+			Backend: BackendHealthConfig{
+				Path: "/",
+			},
+		},
+		Stats: StatsConfig{
+			FlushInterval: 10 * time.Second,
+		},
+		Shutdown: ShutdownConfig{
+			Timeout: 30 * time.Second,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			ServiceName: "contactcache",
+			SampleRatio: 1,
+		},
+	}
+}
+
+//LoadConfig unmarshals the viper config over the defaults, rejecting unknown keys
+//and invalid values
+func LoadConfig() (*Config, error) {
+	cfg := DefaultConfig()
+
+	if err := viper.UnmarshalExact(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %s", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+//Validate checks required values are set, files exist and durations are within range
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Address != "" || len(c.Listeners) > 0, "address is required")
+	https := false
+	for i, l := range c.listeners() {
+		name := fmt.Sprintf("listeners[%d]", i)
+		https = https || l.Protocol == "https"
+		switch l.Network {
+		case "tcp", "unix":
+			check(l.Address != "", "%s.address is required", name)
+		case "systemd":
+		default:
+			errs = append(errs, fmt.Sprintf("%s.network: must be tcp, unix or systemd, got %q", name, l.Network))
+		}
+		check(l.Protocol == "https" || l.Protocol == "http" || l.Protocol == "h2c",
+			"%s.protocol: must be https, http or h2c, got %q", name, l.Protocol)
+		if l.SocketMode != "" {
+			_, err := l.socketMode()
+			check(l.Network == "unix", "%s.socket_mode is only supported by unix listeners", name)
+			check(err == nil, "%s.socket_mode: must be octal permissions, got %q", name, l.SocketMode)
+		}
+	}
+	check(c.Metrics.Address != "", "metrics.address is required")
+
+	for i, cidr := range c.ClientIP.TrustedProxies {
+		if _, err := parseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Sprintf("client_ip.trusted_proxies[%d]: %s", i, err))
+		}
+	}
+
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Sprintf("log.level: %s", err))
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		errs = append(errs, fmt.Sprintf("log.format: must be json or text, got %q", c.Log.Format))
+	}
+
+	//TLS
+	check(!https || c.TLS.Cert != "" || c.TLS.Key != "", "tls.cert and tls.key are required by https listeners")
+	errs = append(errs, checkKeyPair("tls", c.TLS.Cert, c.TLS.Key)...)
+	check(c.TLS.ReloadInterval >= 0, "tls.reload_interval must not be negative")
+	errs = append(errs, checkFile("tls.ocsp_staple", c.TLS.OCSPStaple)...)
+	if _, err := tlsPolicy(c.TLS); err != nil {
+		errs = append(errs, fmt.Sprintf("tls: %s", err))
+	}
+	errs = append(errs, checkFile("tls.client.ca", c.TLS.Client.CA)...)
+	check(c.TLS.Client.CA != "" || len(c.TLS.Client.Bindings) == 0, "tls.client.bindings requires tls.client.ca")
+	for i, b := range c.TLS.Client.Bindings {
+		check(b.Subject != "", fmt.Sprintf("tls.client.bindings[%d].subject is required", i))
+		check(len(b.APIKeys)+len(b.Tenants) > 0, fmt.Sprintf("tls.client.bindings[%d] requires api_keys or tenants", i))
+	}
+	errs = append(errs, checkKeyPair("admin.tls", c.Admin.TLS.Cert, c.Admin.TLS.Key)...)
+	errs = append(errs, checkFile("admin.tls.client_ca", c.Admin.TLS.ClientCA)...)
+	if c.Admin.Address != "" {
+		check(c.Admin.Token != "" || c.Admin.TLS.ClientCA != "", "admin API requires admin.token or admin.tls.client_ca")
+	}
+
+	//Backend
+	if len(c.Backend.Pool) == 0 {
+		errs = append(errs, checkBackendURL("backend.address", c.Backend.Address)...)
+	}
+	for i, m := range c.Backend.Pool {
+		errs = append(errs, checkBackendURL(fmt.Sprintf("backend.pool[%d].address", i), m.Address)...)
+		check(m.Weight >= 0, "backend.pool[%d].weight must not be negative", i)
+	}
+	switch c.Backend.Strategy {
+	case strategyRoundRobin, strategyLeastConn, strategyWeighted:
+	default:
+		errs = append(errs, fmt.Sprintf("backend.strategy: must be round_robin, least_conn or weighted, got %q", c.Backend.Strategy))
+	}
+	if hc := c.Backend.HealthCheck; hc.Interval > 0 {
+		check(hc.Timeout > 0, "backend.health_check.timeout must be greater than 0")
+		check(hc.HealthyThreshold >= 1, "backend.health_check.healthy_threshold must be at least 1")
+		check(hc.UnhealthyThreshold >= 1, "backend.health_check.unhealthy_threshold must be at least 1")
+	}
+	if o := c.Backend.Outlier; o.ConsecutiveFailures > 0 {
+		check(o.EjectionDuration > 0, "backend.outlier.ejection_duration must be greater than 0")
+		check(o.MaxEjectionPercent >= 0 && o.MaxEjectionPercent <= 100, "backend.outlier.max_ejection_percent must be between 0 and 100")
+	}
+
+	//Shadow
+	if c.Shadow.Address != "" {
+		errs = append(errs, checkBackendURL("shadow.address", c.Shadow.Address)...)
+		check(c.Shadow.Timeout > 0, "shadow.timeout must be greater than 0")
+		check(c.Shadow.MaxInFlight >= 1, "shadow.max_in_flight must be at least 1")
+	}
+	check(c.Shadow.Percent >= 0 && c.Shadow.Percent <= 100, "shadow.percent must be between 0 and 100")
+	check(c.Shadow.MaxBodySize >= 0, "shadow.max_body_size must not be negative")
+
+	//Webhooks
+	if c.Webhooks.Path != "" {
+		check(strings.HasPrefix(c.Webhooks.Path, "/"), "webhooks.path must start with /")
+		check(!strings.HasPrefix(c.Webhooks.Path, "/v1/"), "webhooks.path must not be an API path")
+	}
+	for i, e := range c.Webhooks.Endpoints {
+		check(len(e.Secret) >= 16, "webhooks.endpoints[%d].secret must be at least 16 characters", i)
+		check(e.Tenant != "" || e.APIKey != "", "webhooks.endpoints[%d] requires tenant or api_key", i)
+		check(e.Tenant == "" || ValidTenant(e.Tenant), "webhooks.endpoints[%d].tenant must be the sha256 hash of the API key", i)
+		check(e.Tenant == "" || e.APIKey == "" || e.Tenant == tenantHash(e.APIKey), "webhooks.endpoints[%d].tenant does not match api_key", i)
+		check(!c.Webhooks.Refresh || e.APIKey != "", "webhooks.endpoints[%d].api_key is required to refresh", i)
+	}
+	check(c.Webhooks.DedupeTTL >= 0, "webhooks.dedupe_ttl must not be negative")
+
+	//Outbox
+	check(c.Outbox.MaxAttempts >= 1, "outbox.max_attempts must be at least 1")
+	check(c.Outbox.Backoff > 0, "outbox.backoff must be greater than 0")
+	check(c.Outbox.MaxBackoff >= c.Outbox.Backoff, "outbox.max_backoff must be at least outbox.backoff")
+
+	//Events
+	switch c.Events.Sink {
+	case sinkNone:
+	case sinkRedis:
+		check(c.Events.Redis.Stream != "", "events.redis.stream is required")
+		check(c.Events.Redis.MaxLen >= 0, "events.redis.max_len must not be negative")
+	case sinkHTTP:
+		errs = append(errs, checkBackendURL("events.http.url", c.Events.HTTP.URL)...)
+		check(c.Events.HTTP.Timeout > 0, "events.http.timeout must be greater than 0")
+	default:
+		errs = append(errs, fmt.Sprintf("events.sink: must be none, redis or http, got %q", c.Events.Sink))
+	}
+	if c.Events.Sink == sinkRedis || c.Events.Sink == sinkHTTP {
+		//Events are only delivered through the outbox, so would be lost on restart
+		check(c.Outbox.Path != "", "outbox.path is required to publish change events")
+	}
+
+	//Server-sent events
+	if c.SSE.Enabled {
+		check(c.SSE.Channel != "", "sse.channel is required")
+		check(c.SSE.Heartbeat > 0, "sse.heartbeat must be greater than 0")
+		check(c.SSE.MaxStreams >= 1, "sse.max_streams must be at least 1")
+	}
+	check(c.SSE.Replay >= 0, "sse.replay must not be negative")
+
+	//Cache
+	check(c.Cache.Address != "", "cache.address is required")
+	check(c.Cache.DB >= 0, "cache.db must not be negative")
+	check(c.Cache.DialTimeout > 0, "cache.dial_timeout must be greater than 0")
+	check(c.Cache.ReadTimeout > 0, "cache.read_timeout must be greater than 0")
+	check(c.Cache.WriteTimeout > 0, "cache.write_timeout must be greater than 0")
+	check(c.Cache.Timeout > 0, "cache.timeout must be greater than 0")
+	check(c.Cache.FailureThreshold >= 1, "cache.failure_threshold must be at least 1")
+	check(c.Cache.CoolOff > 0, "cache.cool_off must be greater than 0")
+	check(c.Cache.TTL > 0, "cache.ttl must be greater than 0")
+	check(c.Cache.StaleTTL >= 0, "cache.stale_ttl must not be negative")
+	check(c.Cache.StaleTTL == 0 || c.Cache.StaleTTL >= c.Cache.TTL, "cache.stale_ttl must be 0 or at least cache.ttl")
+	check(c.Cache.NegativeTTL >= 0, "cache.negative_ttl must not be negative")
+	check(c.Cache.Verify.SampleRatio >= 0 && c.Cache.Verify.SampleRatio <= 1, "cache.verify.sample_ratio must be between 0 and 1")
+	if c.Cache.Verify.SampleRatio > 0 {
+		check(c.Cache.Verify.Timeout > 0, "cache.verify.timeout must be greater than 0")
+		check(c.Cache.Verify.MaxInFlight >= 1, "cache.verify.max_in_flight must be at least 1")
+	}
+
+	//Rate limits
+	errs = append(errs, checkLimit("ratelimit.cache", &c.RateLimit.Cache)...)
+	errs = append(errs, checkLimit("ratelimit.backend", &c.RateLimit.Backend)...)
+	if c.RateLimit.Client != (LimitConfig{}) {
+		errs = append(errs, checkLimit("ratelimit.client", &c.RateLimit.Client)...)
+	}
+	for tenant, limits := range c.RateLimit.Tenants {
+		check(ValidTenant(tenant), "ratelimit.tenants.%s must be the sha256 hash of the API key", tenant)
+		errs = append(errs, checkLimit("ratelimit.tenants."+tenant+".cache", limits.Cache)...)
+		errs = append(errs, checkLimit("ratelimit.tenants."+tenant+".backend", limits.Backend)...)
+	}
+
+	//Upstream
+	up := c.Upstream
+	check(up.RateLimit.MaxWait >= 0, "upstream.ratelimit.max_wait must not be negative")
+	check(up.RateLimit.MaxQueue >= 0, "upstream.ratelimit.max_queue must not be negative")
+	check(up.RateLimit.DefaultRetryAfter > 0, "upstream.ratelimit.default_retry_after must be greater than 0")
+	check(up.Timeout.Dial > 0, "upstream.timeout.dial must be greater than 0")
+	check(up.Timeout.TLSHandshake > 0, "upstream.timeout.tls_handshake must be greater than 0")
+	check(up.Timeout.ResponseHeader > 0, "upstream.timeout.response_header must be greater than 0")
+	check(up.Timeout.Idle >= 0, "upstream.timeout.idle must not be negative")
+	check(up.Timeout.Overall > 0, "upstream.timeout.overall must be greater than 0")
+	check(up.Retry.Max >= 0, "upstream.retry.max must not be negative")
+	check(up.Retry.Backoff > 0, "upstream.retry.backoff must be greater than 0")
+	check(up.Retry.MaxBackoff >= up.Retry.Backoff, "upstream.retry.max_backoff must be at least upstream.retry.backoff")
+	check(up.Breaker.Window > 0, "upstream.breaker.window must be greater than 0")
+	check(up.Breaker.MinRequests >= 1, "upstream.breaker.min_requests must be at least 1")
+	check(up.Breaker.ErrorRate > 0 && up.Breaker.ErrorRate <= 1, "upstream.breaker.error_rate must be within (0, 1]")
+	check(up.Breaker.OpenDuration > 0, "upstream.breaker.open_duration must be greater than 0")
+	check(up.Breaker.HalfOpenRequests >= 1, "upstream.breaker.half_open_requests must be at least 1")
+
+	//Health, stats and shutdown
+	check(c.Health.Timeout > 0, "health.timeout must be greater than 0")
+	check(c.Health.CacheTTL >= 0, "health.cache_ttl must not be negative")
+	check(strings.HasPrefix(c.Health.Backend.Path, "/"), "health.backend.path must start with /")
+	check(c.Stats.FlushInterval > 0, "stats.flush_interval must be greater than 0")
+	check(c.Shutdown.Timeout > 0, "shutdown.timeout must be greater than 0")
+	check(c.Shutdown.Delay >= 0, "shutdown.delay must not be negative")
+
+	//Tracing
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		errs = append(errs, "tracing.exporter must be one of none, stdout or otlp")
+	}
+	check(c.Tracing.ServiceName != "", "tracing.service_name is required")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be within [0, 1]")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(errs, "\n  "))
+	}
+
+	return nil
+}
+
+//Redacted provides a copy of the config with secrets removed
+func (c *Config) Redacted() *Config {
+	rc := *c
+
+	if rc.Cache.Password != "" {
+		rc.Cache.Password = redacted
+	}
+	if rc.Admin.Token != "" {
+		rc.Admin.Token = redacted
+	}
+	if rc.Events.HTTP.Secret != "" {
+		rc.Events.HTTP.Secret = redacted
+	}
+
+	if len(rc.Webhooks.Endpoints) > 0 {
+		endpoints := make([]WebhookEndpointConfig, len(rc.Webhooks.Endpoints))
+		for i, e := range rc.Webhooks.Endpoints {
+			e.Secret = redacted
+			if e.APIKey != "" {
+				e.APIKey = redacted
+			}
+			endpoints[i] = e
+		}
+		rc.Webhooks.Endpoints = endpoints
+	}
+
+	//Copied so the bindings of the original config are untouched
+	if len(rc.TLS.Client.Bindings) > 0 {
+		bindings := make([]ClientBinding, len(rc.TLS.Client.Bindings))
+		for i, b := range rc.TLS.Client.Bindings {
+			keys := make([]string, len(b.APIKeys))
+			for j := range keys {
+				keys[j] = redacted
+			}
+			b.APIKeys = keys
+			bindings[i] = b
+		}
+		rc.TLS.Client.Bindings = bindings
+	}
+
+	return &rc
+}
+
+//limit resolves the limit for a tenant, preferring tenant specific overrides
+func (c *Config) limit(tenant string, b budget) rateLimit {
+	l := c.RateLimit.Cache
+	if b == budgetBackend {
+		l = c.RateLimit.Backend
+	}
+
+	if override, ok := c.RateLimit.Tenants[tenant]; ok {
+		if b == budgetCache && override.Cache != nil {
+			l = *override.Cache
+		} else if b == budgetBackend && override.Backend != nil {
+			l = *override.Backend
+		}
+	}
+
+	return rateLimit{Rate: l.Rate, Burst: l.Burst}
+}
+
+//listeners provides the configured listeners with defaults applied, or HTTPS on the
+//address if none are configured
+func (c *Config) listeners() []ListenerConfig {
+	if len(c.Listeners) == 0 {
+		return []ListenerConfig{{Network: "tcp", Address: c.Address, Protocol: "https"}}
+	}
+
+	listeners := make([]ListenerConfig, len(c.Listeners))
+	for i, l := range c.Listeners {
+		if l.Network == "" {
+			l.Network = "tcp"
+		}
+		if l.Protocol == "" {
+			l.Protocol = "https"
+		}
+		listeners[i] = l
+	}
+
+	return listeners
+}
+
+//socketMode parses the octal unix socket permissions
+func (l ListenerConfig) socketMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(l.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q", l.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+func checkLimit(name string, l *LimitConfig) []string {
+	if l == nil {
+		return nil
+	}
+
+	var errs []string
+	if l.Rate <= 0 {
+		errs = append(errs, name+".rate must be greater than 0")
+	}
+	if l.Burst < 1 {
+		errs = append(errs, name+".burst must be at least 1")
+	}
+	return errs
+}
+
+func checkBackendURL(name, address string) []string {
+	if address == "" {
+		return []string{name + " is required"}
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return []string{fmt.Sprintf("%s is not a valid URL: %s", name, err)}
+	}
+
+	var errs []string
+	if u.Scheme != "http" && u.Scheme != "https" {
+		errs = append(errs, name+" must be a http or https URL")
+	}
+	if u.Host == "" {
+		errs = append(errs, name+" must include a host")
+	}
+	return errs
+}
+
+func checkKeyPair(name, cert, key string) []string {
+	if (cert == "") != (key == "") {
+		return []string{name + ".cert and " + name + ".key must be set together"}
+	}
+
+	return append(checkFile(name+".cert", cert), checkFile(name+".key", key)...)
+}
+
+func checkFile(name, path string) []string {
+	if path == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return []string{fmt.Sprintf("%s: %s", name, err)}
+	}
+	return nil
 }
@@ -0,0 +1,213 @@
+package contactcache
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+//testKeyPair writes a certificate for the default https listener
+func testKeyPair(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "contactcache")
+
+	return certFile, keyFile
+}
+
+//testConfig provides a valid config for validation tests
+func testConfig(t *testing.T) *Config {
+	cfg := DefaultConfig()
+	cfg.Backend.Address = "https://api2.autopilothq.com"
+	cfg.TLS.Cert, cfg.TLS.Key = testKeyPair(t)
+
+	return cfg
+}
+
+func TestLoadConfig(t *testing.T) {
+	defer viper.Reset()
+
+	cert, key := testKeyPair(t)
+	viper.Set("tls.cert", cert)
+	viper.Set("tls.key", key)
+	viper.Set("backend.address", "https://api2.autopilothq.com")
+	viper.Set("cache.stale_ttl", "2h")
+	viper.Set("ratelimit.tenants."+tenantHash("1234")+".backend.rate", 1)
+	viper.Set("ratelimit.tenants."+tenantHash("1234")+".backend.burst", 2)
+
+	cfg, err := LoadConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2*time.Hour, cfg.Cache.StaleTTL)
+		assert.Equal(t, 5*time.Second, cfg.Cache.CoolOff)
+		assert.Equal(t, rateLimit{Rate: 1, Burst: 2}, cfg.limit(tenantHash("1234"), budgetBackend))
+		assert.Equal(t, rateLimit{Rate: 50, Burst: 100}, cfg.limit(tenantHash("1234"), budgetCache))
+		assert.Equal(t, rateLimit{Rate: 5, Burst: 10}, cfg.limit(tenantHash("4321"), budgetBackend))
+	}
+
+	//Typos are rejected
+	viper.Set("cache.stale_tll", "2h")
+
+	_, err = LoadConfig()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "stale_tll")
+}
+
+func TestValidateConfig(t *testing.T) {
+	cfg := testConfig(t)
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Backend.Address = "api2.autopilothq.com"
+	cfg.TLS.Cert = "/does/not/exist.pem"
+	cfg.TLS.Key = "/does/not/exist.key"
+	cfg.Cache.StaleTTL = time.Second
+	cfg.Upstream.Breaker.ErrorRate = 2
+	cfg.TLS.Client.Bindings = []ClientBinding{{Subject: "svc"}}
+	cfg.TLS.Profile = "strict"
+	cfg.ClientIP.TrustedProxies = []string{"10.0.0.0/8", "10.0.0.0/33"}
+	cfg.Shadow.Address = "shadow.example.com"
+	cfg.Shadow.Percent = 150
+	cfg.Cache.Verify.SampleRatio = 0.1
+	cfg.Cache.Verify.MaxInFlight = 0
+	cfg.Outbox.MaxBackoff = time.Millisecond
+	cfg.Events.Sink = "kafka"
+	cfg.SSE.Enabled = true
+	cfg.SSE.Heartbeat = 0
+	cfg.Listeners = []ListenerConfig{
+		{Network: "udp", Address: ":53"},
+		{Network: "unix", Protocol: "spdy"},
+		{Network: "tcp", Address: ":80", Protocol: "http", SocketMode: "0660"},
+		{Network: "unix", Address: "/run/cc.sock", SocketMode: "rw"},
+	}
+
+	err := cfg.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "backend.address")
+		assert.Contains(t, err.Error(), "tls.cert")
+		assert.Contains(t, err.Error(), "tls.key")
+		assert.Contains(t, err.Error(), "cache.stale_ttl")
+		assert.Contains(t, err.Error(), "upstream.breaker.error_rate")
+		assert.Contains(t, err.Error(), "tls.client.bindings requires tls.client.ca")
+		assert.Contains(t, err.Error(), "tls.client.bindings[0] requires api_keys or tenants")
+		assert.Contains(t, err.Error(), `unknown TLS profile "strict"`)
+		assert.Contains(t, err.Error(), "client_ip.trusted_proxies[1]")
+		assert.NotContains(t, err.Error(), "client_ip.trusted_proxies[0]")
+		assert.Contains(t, err.Error(), "shadow.address must be a http or https URL")
+		assert.Contains(t, err.Error(), "shadow.percent must be between 0 and 100")
+		assert.Contains(t, err.Error(), "cache.verify.max_in_flight must be at least 1")
+		assert.NotContains(t, err.Error(), "cache.verify.sample_ratio")
+		assert.Contains(t, err.Error(), "outbox.max_backoff must be at least outbox.backoff")
+		assert.Contains(t, err.Error(), `events.sink: must be none, redis or http, got "kafka"`)
+		assert.Contains(t, err.Error(), "sse.heartbeat must be greater than 0")
+		assert.Contains(t, err.Error(), `listeners[0].network: must be tcp, unix or systemd, got "udp"`)
+		assert.Contains(t, err.Error(), "listeners[1].address is required")
+		assert.Contains(t, err.Error(), `listeners[1].protocol: must be https, http or h2c, got "spdy"`)
+		assert.Contains(t, err.Error(), "listeners[2].socket_mode is only supported by unix listeners")
+		assert.Contains(t, err.Error(), `listeners[3].socket_mode: must be octal permissions, got "rw"`)
+	}
+
+	//Change events are only published through a durable outbox
+	cfg = testConfig(t)
+	cfg.Events.Sink = sinkRedis
+	err = cfg.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "outbox.path is required to publish change events")
+	}
+
+	cfg.Outbox.Path = "/var/lib/contactcache/outbox.wal"
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestValidateHTTPSListeners(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Backend.Address = "https://api2.autopilothq.com"
+
+	//The default listener is https
+	err := cfg.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tls.cert and tls.key are required by https listeners")
+	}
+
+	cfg.Listeners = []ListenerConfig{{Address: ":80", Protocol: "http"}, {Network: "unix", Address: "/run/cc.sock", Protocol: "h2c"}}
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Listeners = append(cfg.Listeners, ListenerConfig{Address: ":443"})
+	err = cfg.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tls.cert and tls.key are required by https listeners")
+	}
+
+	cfg.TLS.Cert, cfg.TLS.Key = testKeyPair(t)
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestValidateBackendPool(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Backend.Pool = []PoolMemberConfig{{Address: "https://api-eu1.example.com"}, {Address: "https://api-eu2.example.com", Weight: 2}}
+	assert.NoError(t, cfg.Validate())
+
+	//The pool takes precedence over the address
+	cfg.Backend.Address = "api2.autopilothq.com"
+	cfg.Backend.Pool[1] = PoolMemberConfig{Address: "ftp://api-eu2.example.com", Weight: -1}
+	cfg.Backend.Strategy = "random"
+	cfg.Backend.Outlier.MaxEjectionPercent = 101
+
+	err := cfg.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "backend.pool[1].address must be a http or https URL")
+		assert.Contains(t, err.Error(), "backend.pool[1].weight must not be negative")
+		assert.NotContains(t, err.Error(), "backend.pool[0]")
+		assert.NotContains(t, err.Error(), "backend.address")
+		assert.Contains(t, err.Error(), `backend.strategy: must be round_robin, least_conn or weighted, got "random"`)
+		assert.Contains(t, err.Error(), "backend.outlier.max_ejection_percent must be between 0 and 100")
+	}
+}
+
+func TestRedactedConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Cache.Password = "hunter2"
+	cfg.Admin.Token = "secret"
+	cfg.TLS.Client.Bindings = []ClientBinding{{Subject: "svc", APIKeys: []string{"1234"}}}
+	cfg.Webhooks.Endpoints = []WebhookEndpointConfig{{Secret: "0123456789abcdef", APIKey: "1234"}}
+	cfg.Events.HTTP.Secret = "signing-secret"
+
+	rc := cfg.Redacted()
+	assert.Equal(t, redacted, rc.Cache.Password)
+	assert.Equal(t, redacted, rc.Admin.Token)
+	assert.Equal(t, []string{redacted}, rc.TLS.Client.Bindings[0].APIKeys)
+	assert.Equal(t, "hunter2", cfg.Cache.Password)
+	assert.Equal(t, []string{"1234"}, cfg.TLS.Client.Bindings[0].APIKeys)
+	assert.Equal(t, WebhookEndpointConfig{Secret: redacted, APIKey: redacted}, rc.Webhooks.Endpoints[0])
+	assert.Equal(t, "1234", cfg.Webhooks.Endpoints[0].APIKey)
+	assert.Equal(t, redacted, rc.Events.HTTP.Secret)
+}
+
+func TestValidateWebhooks(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Webhooks.Path = "/webhooks/autopilot"
+	cfg.Webhooks.Endpoints = []WebhookEndpointConfig{
+		{Secret: "0123456789abcdef", Tenant: TenantHash("1234")},
+		{Secret: "0123456789abcdef", APIKey: "5678"},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Webhooks.Path = "/v1/webhooks"
+	cfg.Webhooks.Refresh = true
+	cfg.Webhooks.Endpoints = append(cfg.Webhooks.Endpoints,
+		WebhookEndpointConfig{Secret: "short", Tenant: "1234"},
+		WebhookEndpointConfig{Secret: "0123456789abcdef", Tenant: TenantHash("1234"), APIKey: "5678"},
+	)
+
+	err := cfg.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "webhooks.path must not be an API path")
+		assert.Contains(t, err.Error(), "webhooks.endpoints[0].api_key is required to refresh")
+		assert.NotContains(t, err.Error(), "webhooks.endpoints[1]")
+		assert.Contains(t, err.Error(), "webhooks.endpoints[2].secret must be at least 16 characters")
+		assert.Contains(t, err.Error(), "webhooks.endpoints[2].tenant must be the sha256 hash of the API key")
+		assert.Contains(t, err.Error(), "webhooks.endpoints[3].tenant does not match api_key")
+	}
+}
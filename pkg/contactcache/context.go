@@ -0,0 +1,74 @@
+package contactcache
+
+import "context"
+
+type ctxKey int
+
+const (
+	ctxKeyTenant ctxKey = iota
+	ctxKeyStaleRef
+	ctxKeyRequestInfo
+	ctxKeyProxyProtocol
+	ctxKeyClientAddr
+	ctxKeyTriedUpstreams
+)
+
+//withTenant attaches the hashed tenant key to the context
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, ctxKeyTenant, tenant)
+}
+
+//tenantFromContext provides the hashed tenant key if attached
+func tenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(ctxKeyTenant).(string)
+	return tenant, ok
+}
+
+//withStaleRef attaches the stale cache entry which may be served in place of the backend
+func withStaleRef(ctx context.Context, ref *staleRef) context.Context {
+	return context.WithValue(ctx, ctxKeyStaleRef, ref)
+}
+
+//staleRefFromContext provides the stale cache entry reference if attached
+func staleRefFromContext(ctx context.Context) (*staleRef, bool) {
+	ref, ok := ctx.Value(ctxKeyStaleRef).(*staleRef)
+	return ref, ok
+}
+
+//withRequestInfo attaches the request details collected for the access log
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, ctxKeyRequestInfo, info)
+}
+
+//requestInfoFromContext provides the request details if attached
+func requestInfoFromContext(ctx context.Context) (*requestInfo, bool) {
+	info, ok := ctx.Value(ctxKeyRequestInfo).(*requestInfo)
+	return info, ok
+}
+
+//withProxyProtocol marks connections accepted on a PROXY protocol listener
+func withProxyProtocol(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyProxyProtocol, true)
+}
+
+//withClientAddr attaches the resolved client IP
+func withClientAddr(ctx context.Context, addr clientAddr) context.Context {
+	return context.WithValue(ctx, ctxKeyClientAddr, addr)
+}
+
+//clientAddrFromContext provides the resolved client IP if attached
+func clientAddrFromContext(ctx context.Context) (clientAddr, bool) {
+	addr, ok := ctx.Value(ctxKeyClientAddr).(clientAddr)
+	return addr, ok
+}
+
+//withTriedUpstreams attaches a record of the upstreams attempted for the request
+func withTriedUpstreams(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyTriedUpstreams, &triedUpstreams{})
+}
+
+//triedUpstreamsFromContext provides the attempted upstreams if attached
+func triedUpstreamsFromContext(ctx context.Context) (*triedUpstreams, bool) {
+	tried, ok := ctx.Value(ctxKeyTriedUpstreams).(*triedUpstreams)
+	return tried, ok
+}
@@ -0,0 +1,252 @@
+package contactcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/tidwall/gjson"
+)
+
+//Change event sinks
+const (
+	sinkNone  = "none"
+	sinkRedis = "redis"
+	sinkHTTP  = "http"
+)
+
+//Change event operations
+const (
+	changeUpsert = "upsert"
+	changeDelete = "delete"
+)
+
+const (
+	//changeSignatureHeader the HMAC-SHA256 of the body using the HTTP sink secret, as
+	//sha256=<hex>
+	changeSignatureHeader = "X-Change-Signature"
+
+	//maxChangeBodySize largest request or response body inspected to describe a change
+	maxChangeBodySize = 1 << 20
+)
+
+//ChangeEvent a contact write confirmed by the backend. Contacts are identified by ID
+//and the sha256 hash of the lowercased email, so events never carry PII
+type ChangeEvent struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	ContactID string    `json:"contact_id,omitempty"`
+	EmailHash string    `json:"email_hash,omitempty"`
+	Operation string    `json:"operation"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+//ChangeSink publishes change events. Events are delivered at least once, consumers
+//should dedupe by the event ID
+type ChangeSink interface {
+	Publish(ctx context.Context, event *ChangeEvent) error
+}
+
+//newChangeSink creates the configured sink, nil if disabled
+func newChangeSink(cfg EventsConfig, rdb *redis.Client) ChangeSink {
+	switch cfg.Sink {
+	case sinkRedis:
+		return NewRedisStreamSink(rdb, cfg.Redis.Stream, cfg.Redis.MaxLen)
+	case sinkHTTP:
+		return NewHTTPSink(cfg.HTTP.URL, cfg.HTTP.Secret, cfg.HTTP.Timeout)
+	default:
+		return nil
+	}
+}
+
+//RedisStreamSink adds events to a redis stream
+type RedisStreamSink struct {
+	rdb    *redis.Client
+	stream string
+	maxLen int64
+}
+
+//NewRedisStreamSink creates a sink adding events to the stream, trimmed to approximately
+//maxLen entries unless 0
+func NewRedisStreamSink(rdb *redis.Client, stream string, maxLen int64) *RedisStreamSink {
+	return &RedisStreamSink{rdb: rdb, stream: stream, maxLen: maxLen}
+}
+
+//Publish adds the event fields as a stream entry
+func (rs *RedisStreamSink) Publish(ctx context.Context, event *ChangeEvent) error {
+	return rs.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: rs.stream,
+		MaxLen: rs.maxLen,
+		Approx: rs.maxLen > 0,
+		Values: []string{
+			"id", event.ID,
+			"tenant", event.Tenant,
+			"contact_id", event.ContactID,
+			"email_hash", event.EmailHash,
+			"operation", event.Operation,
+			"timestamp", event.Timestamp.Format(time.RFC3339Nano),
+		},
+	}).Err()
+}
+
+//HTTPSink POSTs events as JSON, any 2xx response accepts the event
+type HTTPSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+//NewHTTPSink creates a sink POSTing events to the URL, signing the body if the secret
+//is set
+func NewHTTPSink(url, secret string, timeout time.Duration) *HTTPSink {
+	return &HTTPSink{url: url, secret: secret, client: &http.Client{Timeout: timeout}}
+}
+
+//Publish POSTs the event
+func (hs *HTTPSink) Publish(ctx context.Context, event *ChangeEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hs.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	if hs.secret != "" {
+		req.Header.Set(changeSignatureHeader, "sha256="+signChange(hs.secret, body))
+	}
+
+	resp, err := hs.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxChangeBodySize))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("change event sink responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+//signChange provides the hex HMAC-SHA256 of the body
+func signChange(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//hashEmail provides the sha256 hash of the lowercased email
+func hashEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email)))))
+}
+
+//changeWrite a contact write passed through to the backend, recorded to describe the
+//change once the backend responds
+type changeWrite struct {
+	apiKey   string
+	body     []byte
+	response *teeWriter
+}
+
+//recordChange records the request body and response of a contact write when a sink is
+//configured
+func (s *Server) recordChange(w http.ResponseWriter, r *http.Request) (*changeWrite, http.ResponseWriter) {
+	if s.sink == nil {
+		return nil, w
+	}
+
+	cw := &changeWrite{
+		apiKey:   r.Header.Get(apiKeyHeader),
+		response: &teeWriter{ResponseWriter: w, status: http.StatusOK, limit: maxChangeBodySize},
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		body, _ := ioutil.ReadAll(io.LimitReader(r.Body, maxChangeBodySize+1))
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		if len(body) <= maxChangeBodySize {
+			cw.body = body
+		}
+	}
+
+	return cw, cw.response
+}
+
+//publishChange queues a change event for the write if the backend confirmed it. Upserts
+//are described by the contact ID in the response and the email in the request, deletes
+//by the contact ID or email deleted
+func (s *Server) publishChange(ctx context.Context, cw *changeWrite, op string, idOrEmail string) {
+	if cw == nil || cw.response.status < 200 || cw.response.status > 299 {
+		return
+	}
+
+	var id, email string
+	switch op {
+	case changeUpsert:
+		resp, _ := cw.response.decoded()
+		id = gjson.GetBytes(resp, "contact_id").String()
+		email = gjson.GetBytes(cw.body, "contact.Email").String()
+		if email == "" {
+			email = gjson.GetBytes(resp, "Email").String()
+		}
+	case changeDelete:
+		if s.isPersonKey(idOrEmail) {
+			id = idOrEmail
+		} else {
+			email = idOrEmail
+		}
+	}
+
+	if id == "" && email == "" {
+		s.reqLog(ctx).WithField("operation", op).Warn("change event has no contact")
+		s.metrics.changeEvents.WithLabelValues(op, "dropped").Inc()
+		return
+	}
+
+	event := &ChangeEvent{
+		ID:        newRequestID(),
+		Tenant:    tenantHash(cw.apiKey),
+		ContactID: id,
+		EmailHash: hashEmail(email),
+		Operation: op,
+		Timestamp: time.Now().UTC(),
+	}
+
+	if err := s.outbox.publish(event); err != nil {
+		s.reqLog(ctx).WithError(err).Error("failed to queue change event")
+		s.metrics.changeEvents.WithLabelValues(op, "dropped").Inc()
+		return
+	}
+	s.metrics.changeEvents.WithLabelValues(op, "queued").Inc()
+}
+
+//deliverChange publishes a queued change event to the sink
+func (s *Server) deliverChange(ctx context.Context, event *ChangeEvent) error {
+	if event == nil {
+		return fmt.Errorf("outbox entry has no change event")
+	}
+	if s.sink == nil {
+		return fmt.Errorf("no change event sink configured")
+	}
+
+	if err := s.sink.Publish(ctx, event); err != nil {
+		return err
+	}
+	s.metrics.changeEvents.WithLabelValues(event.Operation, "published").Inc()
+	return nil
+}
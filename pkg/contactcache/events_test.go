@@ -0,0 +1,148 @@
+package contactcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeEvents(t *testing.T) {
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			fmt.Fprintln(w, `{"contact_id": "person_1"}`)
+		case strings.HasSuffix(r.URL.Path, "person_2"):
+			http.Error(w, `{"error": "Not Found"}`, http.StatusNotFound)
+		}
+	})
+	defer close()
+
+	var (
+		mu       sync.Mutex
+		received []ChangeEvent
+		failing  int32 = 1
+	)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, "sha256="+signChange("signing-secret", body), r.Header.Get(changeSignatureHeader))
+
+		//The first delivery fails
+		if atomic.CompareAndSwapInt32(&failing, 1, 0) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var event ChangeEvent
+		assert.NoError(t, json.Unmarshal(body, &event))
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+	}))
+	defer sink.Close()
+
+	srv.sink = NewHTTPSink(sink.URL, "signing-secret", time.Second)
+
+	handler := srv.httpHandler()
+	apiKey := "1234"
+
+	send := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, "https://anywhere.local"+path, strings.NewReader(body))
+		req.Header.Add(apiKeyHeader, apiKey)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("POST", "/v1/contact", `{"contact": {"Email": "Chris@autopilothq.com", "FirstName": "Chris"}}`))
+	assert.Equal(t, http.StatusOK, send("DELETE", "/v1/contact/person_1", ""))
+
+	//Writes the backend rejects aren't published
+	assert.Equal(t, http.StatusNotFound, send("DELETE", "/v1/contact/person_2", ""))
+
+	pending, _ := srv.outbox.entries()
+	if !assert.Len(t, pending, 2) {
+		return
+	}
+	upsertID := pending[0].Key
+
+	ctx := context.Background()
+	srv.outbox.process(ctx, time.Now().Add(time.Hour), srv.applyOutbox)
+	srv.outbox.process(ctx, time.Now().Add(time.Hour), srv.applyOutbox)
+
+	pending, _ = srv.outbox.entries()
+	assert.Empty(t, pending)
+
+	//The failed upsert is delivered after the delete, with the same ID
+	if assert.Len(t, received, 2) {
+		deleted, upserted := received[0], received[1]
+
+		assert.Equal(t, changeDelete, deleted.Operation)
+		assert.Equal(t, "person_1", deleted.ContactID)
+		assert.Empty(t, deleted.EmailHash)
+
+		assert.Equal(t, changeUpsert, upserted.Operation)
+		assert.Equal(t, upsertID, upserted.ID)
+		assert.Equal(t, tenantHash(apiKey), upserted.Tenant)
+		assert.Equal(t, "person_1", upserted.ContactID)
+		assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("chris@autopilothq.com"))), upserted.EmailHash)
+		assert.False(t, upserted.Timestamp.IsZero())
+	}
+
+	events := srv.metrics.changeEvents
+	assert.Equal(t, float64(1), testutil.ToFloat64(events.WithLabelValues(changeUpsert, "queued")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(events.WithLabelValues(changeUpsert, "published")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(events.WithLabelValues(changeDelete, "published")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.outboxAttempts.WithLabelValues(outboxEvent, "failure")))
+}
+
+func TestRedisStreamSink(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	rdb := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	sink := NewRedisStreamSink(rdb, "contactcache:changes", 1)
+
+	ctx := context.Background()
+	for _, id := range []string{"event_1", "event_2"} {
+		err := sink.Publish(ctx, &ChangeEvent{
+			ID:        id,
+			Tenant:    tenantHash("1234"),
+			ContactID: "person_1",
+			Operation: changeUpsert,
+			Timestamp: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+		})
+		assert.NoError(t, err)
+	}
+
+	//The stream is trimmed to the max length
+	entries, err := s.Stream("contactcache:changes")
+	if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+		assert.Equal(t, []string{
+			"id", "event_2",
+			"tenant", tenantHash("1234"),
+			"contact_id", "person_1",
+			"email_hash", "",
+			"operation", changeUpsert,
+			"timestamp", "2021-06-01T00:00:00Z",
+		}, entries[0].Values)
+	}
+}
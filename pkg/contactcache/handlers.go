@@ -10,42 +10,67 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	apiKeyHeader = "autopilotapikey"
 	noAPIKey     = `{"error":"Bad Request", "message": "No autopilotapikey header provided."}`
-
-	cacheTTL = 5 * time.Minute
-)
-
-var (
-	errRedisNil = errors.New("redis: nil")
 )
 
 //httpHandler http mux for serving cached responses or passing through to backend
 func (s *Server) httpHandler() http.Handler {
 	r := mux.NewRouter()
 
-	r.HandleFunc("/v1/contact/{idOrEmail}", s.handleGetContact).Methods(http.MethodGet)
-	r.HandleFunc("/v1/contact/{idOrEmail}", s.handleDeleteContact).Methods(http.MethodDelete)
-	r.HandleFunc("/v1/contact", s.handleUpsertContact).Methods(http.MethodPost)
-	r.HandleFunc("/v1/contacts", s.handleListContact).Methods(http.MethodGet)
-	r.HandleFunc("/v1/contacts/{bookmark}", s.handleListContact).Methods(http.MethodGet)
+	//Webhooks authenticate with a shared secret rather than an API key
+	if path := s.cfg().Webhooks.Path; path != "" {
+		r.Handle(path, s.instrument(http.HandlerFunc(s.handleWebhook)))
+	}
+
+	api := r.PathPrefix("/").Subrouter()
+
+	if s.cfg().SSE.Enabled {
+		api.HandleFunc("/v1/contact/{idOrEmail}/events", s.handleContactEvents).Methods(http.MethodGet).Name(routeContactEvents)
+	}
+
+	api.HandleFunc("/v1/contact/{idOrEmail}", s.handleGetContact).Methods(http.MethodGet)
+	api.HandleFunc("/v1/contact/{idOrEmail}", s.handleDeleteContact).Methods(http.MethodDelete)
+	api.HandleFunc("/v1/contact", s.handleUpsertContact).Methods(http.MethodPost)
+	api.HandleFunc("/v1/contacts", s.handleListContact).Methods(http.MethodGet)
+	api.HandleFunc("/v1/contacts/{bookmark}", s.handleListContact).Methods(http.MethodGet)
 
 	//Passthrough all over requests
-	r.PathPrefix("/").HandlerFunc(s.be.ServeHTTP)
+	api.PathPrefix("/").HandlerFunc(s.handlePassthrough)
+
+	//Client IP from PROXY protocol or trusted forwarded headers
+	r.Use(s.resolveClientIP)
+
+	//Request IDs and access logs
+	r.Use(s.requestLogging)
+
+	//X-Cache, Age and Server-Timing headers
+	r.Use(s.cacheHeaders)
+
+	//Trace all requests
+	r.Use(s.tracing)
+
+	//Metrics, first so responses from the checks below are measured
+	api.Use(s.instrument)
 
 	//Check for API key
-	r.Use(s.authCheck)
+	api.Use(s.authCheck)
 
-	//Metrics
-	r.Use(s.metrics)
+	//Client certificate bindings
+	api.Use(s.clientCertCheck)
+
+	//Per tenant rate limits
+	api.Use(s.rateLimit)
 
 	return r
 }
@@ -67,10 +92,12 @@ func (s *Server) authCheck(next http.Handler) http.Handler {
 
 //handleProxyResponse copies the response from the backend and caches the responses accordingly
 func (s *Server) handleProxyResponse(r *http.Response) error {
-	s.log.Infof("RESP: %+v", r.Request.URL.Path)
+	endUpstream(r.Request.Context())
+
+	s.observeUpstreamLimit(r)
 
-	//Only cache successful responses
-	if r.StatusCode != 200 {
+	//Only cache successful responses, or contacts the backend doesn't have
+	if r.StatusCode != 200 && !s.negativeCacheable(r) {
 		return nil
 	}
 
@@ -96,21 +123,14 @@ func (s *Server) handleProxyResponse(r *http.Response) error {
 	if err != nil {
 		return err
 	}
+	r.Body.Close()
 
-	//Get contact
-	if strings.Index(r.Request.URL.Path, "/v1/contact/") == 0 && r.Request.Method == http.MethodGet {
-		s.cacheContact(apiKey, string(b))
-	}
-
-	//Upsert contact
-	if r.Request.URL.Path == "/v1/contact" && r.Request.Method == http.MethodPost {
-		s.cacheContact(apiKey, string(b))
-	}
-
-	//List contacts
-	if strings.Index(r.Request.URL.Path, "/v1/contacts") == 0 && r.Request.Method == http.MethodGet {
-		s.cacheList(r.Request, apiKey, string(b))
-	}
+	//Populate the cache before responding so writes made after this response was read
+	//invalidate it, continuing the trace but not cancelled with the client
+	req := r.Request
+	ctx, span := s.tracer().Start(trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(req.Context())), "cache populate")
+	s.populateCache(ctx, req, r.StatusCode, apiKey, string(b), upstreamStarted(req.Context()))
+	span.End()
 
 	//Rebuild the response body closer
 	var readerBack io.ReadCloser
@@ -130,50 +150,105 @@ func (s *Server) handleProxyResponse(r *http.Response) error {
 	return nil
 }
 
-//cacheContact caches a bulk list of contacts or a simple contact
-func (s *Server) cacheContact(apiKey string, body string) error {
-	//New ctx since outside of response routine
-	ctx := context.Background()
+//populateCache caches the backend response according to the request, read being when
+//the request was sent to the backend
+func (s *Server) populateCache(ctx context.Context, r *http.Request, status int, apiKey string, body string, read time.Time) {
+	s.metrics.cachePopulateInFlight.Inc()
+	defer s.metrics.cachePopulateInFlight.Dec()
+
+	//Contact not found, unless created or invalidated while the response was in flight
+	if status == http.StatusNotFound {
+		s.countPopulate("contact", s.cacheNotFound(ctx, r, apiKey, body, read))
+		return
+	}
+
+	//Get contact, unless invalidated while the response was in flight
+	if strings.Index(r.URL.Path, "/v1/contact/") == 0 && r.Method == http.MethodGet {
+		err := s.cacheContact(ctx, apiKey, body)
+		if err == nil {
+			err = s.discardInvalidated(ctx, apiKey, body, read)
+		}
+		s.countPopulate("contact", err)
+	}
+
+	//Upsert contact, which may have just been created
+	if r.URL.Path == "/v1/contact" && r.Method == http.MethodPost {
+		err := s.clearNotFound(ctx, apiKey, body)
+		if err == nil {
+			err = s.cacheContact(ctx, apiKey, body)
+		}
+		s.countPopulate("contact", err)
+	}
+
+	//List contacts, unless the lists were invalidated while the response was in flight
+	if strings.Index(r.URL.Path, "/v1/contacts") == 0 && r.Method == http.MethodGet {
+		s.countPopulate("list", s.cacheList(ctx, r, apiKey, body, read))
+	}
+}
+
+//countPopulate records failures to cache backend responses
+func (s *Server) countPopulate(entity string, err error) {
+	if err != nil {
+		s.metrics.cachePopulateFailures.WithLabelValues(entity).Inc()
+	}
+}
 
+//cacheContact caches a bulk list of contacts or a simple contact
+func (s *Server) cacheContact(ctx context.Context, apiKey string, body string) error {
 	bulk := gjson.Get(body, "contacts").Array()
 
 	//If is bulk
 	if len(bulk) != 0 {
+		var err error
 		for _, contact := range bulk {
-			s.cacheContact(apiKey, contact.Raw)
+			if cErr := s.cacheContact(ctx, apiKey, contact.Raw); cErr != nil {
+				err = cErr
+			}
 		}
 
-		return nil
+		return err
 	}
 
 	email := gjson.Get(body, "Email").String()
 	id := gjson.Get(body, "contact_id").String()
 
 	cacheKey := s.prefixKey(apiKey, email)
+	ttl := s.cfg().Cache.TTL
 
 	//Cache response
-	err := s.cache.Set(ctx, cacheKey, body, cacheTTL)
+	err := s.cache.Set(ctx, cacheKey, body, ttl)
 	if err != nil {
-		s.log.WithError(err).Error("failed to set contact key")
+		s.logCacheError(err, "failed to set contact key")
 		return err
 	}
 
 	//Add contact/person id alias
-	err = s.cache.Set(ctx, s.prefixKey(apiKey, id), cacheKey, cacheTTL)
+	aliasKey := s.prefixKey(apiKey, id)
+	err = s.cache.Set(ctx, aliasKey, cacheKey, ttl)
 	if err != nil {
-		s.log.WithError(err).Error("failed to set contact key")
+		s.logCacheError(err, "failed to set contact key")
 		return err
 	}
 
-	cacheRequests.WithLabelValues("cache", "contact").Add(1)
+	//Keep stale copies to fall back on
+	if err := s.setStale(ctx, cacheKey, body); err != nil {
+		s.logCacheError(err, "failed to set stale contact key")
+	}
+	if err := s.setStale(ctx, aliasKey, cacheKey); err != nil {
+		s.logCacheError(err, "failed to set stale contact key")
+	}
+
+	s.countCache(apiKey, "cache", "contact")
+	s.metrics.cacheBodySize.WithLabelValues("contact").Observe(float64(len(body)))
+
+	s.notifyContact(ctx, tenantHash(apiKey), noticeCached, id, email)
 
 	return nil
 }
 
-func (s *Server) cacheList(r *http.Request, apiKey, body string) error {
-	//New ctx since outside of response routine
-	ctx := context.Background()
-
+//cacheList caches a list response, discarding it if the tenants lists were invalidated
+//after the response was read
+func (s *Server) cacheList(ctx context.Context, r *http.Request, apiKey, body string, read time.Time) error {
 	var bookmark string
 
 	//is Bookmarked
@@ -183,13 +258,29 @@ func (s *Server) cacheList(r *http.Request, apiKey, body string) error {
 
 	//Cache listing response
 	cacheKey := s.prefixKey(apiKey, fmt.Sprintf("lists:%s", bookmark))
-	err := s.cache.Set(ctx, cacheKey, body, cacheTTL)
+	err := s.cache.Set(ctx, cacheKey, body, s.cfg().Cache.TTL)
+	if err != nil {
+		s.logCacheError(err, "failed to set contact key")
+		return err
+	}
+
+	if err := s.setStale(ctx, cacheKey, body); err != nil {
+		s.logCacheError(err, "failed to set stale list key")
+	}
+
+	invalidated, err := s.invalidatedSince(ctx, s.prefixKey(apiKey, listsInvalidated), read)
 	if err != nil {
-		s.log.WithError(err).Error("failed to set contact key")
 		return err
 	}
+	if invalidated {
+		if err := s.cache.Delete(ctx, cacheKey); err != nil {
+			return err
+		}
+		return s.cache.Delete(ctx, staleKey(cacheKey))
+	}
 
-	cacheRequests.WithLabelValues("cache", "list").Add(1)
+	s.countCache(apiKey, "cache", "list")
+	s.metrics.cacheBodySize.WithLabelValues("list").Observe(float64(len(body)))
 
 	//TODO(tcfw) preemptive cache next page response
 
@@ -205,7 +296,10 @@ func (s *Server) handleGetContact(w http.ResponseWriter, r *http.Request) {
 
 	var cacheKey string
 	var val string
+	var ttl time.Duration
 	var err error
+	var stale *staleRef
+	decision := "miss"
 
 	if idOrEmail == "" {
 		goto passthrough
@@ -213,10 +307,15 @@ func (s *Server) handleGetContact(w http.ResponseWriter, r *http.Request) {
 
 	//Check if is a person key or email
 	if s.isPersonKey(idOrEmail) {
+		aliasKey := s.prefixKey(apiKey, idOrEmail)
+		stale = &staleRef{key: aliasKey, alias: true, entity: "contact"}
+		setCacheKey(r.Context(), aliasKey)
+
 		//Find the contact key for email
-		realKey, err := s.cache.Get(r.Context(), s.prefixKey(apiKey, idOrEmail))
-		if err != nil && err != errRedisNil {
-			s.log.WithError(err).Error("failed to get cache resp for alias")
+		realKey, err := s.cache.Get(r.Context(), aliasKey)
+		if err != nil && !errors.Is(err, ErrCacheMiss) {
+			s.logCacheError(err, "failed to get cache resp for alias")
+			decision = "bypass"
 			goto passthrough
 		} else if realKey == "" {
 			goto passthrough
@@ -224,50 +323,78 @@ func (s *Server) handleGetContact(w http.ResponseWriter, r *http.Request) {
 		cacheKey = realKey
 	} else {
 		cacheKey = s.prefixKey(apiKey, idOrEmail)
+		stale = &staleRef{key: cacheKey, entity: "contact"}
 	}
+	setCacheKey(r.Context(), cacheKey)
 
-	val, err = s.cache.Get(r.Context(), cacheKey)
-	if err != nil && err != errRedisNil {
-		s.log.WithError(err).Error("failed to get cache resp for alias")
+	val, ttl, err = s.getEntry(r.Context(), cacheKey)
+	if err != nil && !errors.Is(err, ErrCacheMiss) {
+		s.logCacheError(err, "failed to get cache resp")
+		decision = "bypass"
 		goto passthrough
 	} else if val == "" {
 		goto passthrough
 	}
 
+	if !s.allow(w, r, budgetCache) {
+		return
+	}
+
+	setCacheDecision(r.Context(), "hit")
+	s.recordEntryAge(r.Context(), cacheKey, s.cfg().Cache.TTL, ttl)
+
 	w.Header().Add("content-type", "application/json")
 	w.Header().Add("cached", "yes")
 	w.Write([]byte(val))
 
-	cacheRequests.WithLabelValues("hit", "contact").Add(1)
+	s.countCache(apiKey, "hit", "contact")
+	s.sampleHit(r, "contact", cacheKey, val)
 
 	return
 
 passthrough:
-	cacheRequests.WithLabelValues("miss", "contact").Add(1)
-	s.be.ServeHTTP(w, r)
+	//Contacts the backend recently didn't have are answered from the cache
+	if decision == "miss" && idOrEmail != "" && s.serveNotFound(w, r, s.prefixKey(apiKey, idOrEmail)) {
+		return
+	}
+
+	s.countCache(apiKey, "miss", "contact")
+	setCacheDecision(r.Context(), decision)
+	if stale != nil {
+		r = r.WithContext(withStaleRef(r.Context(), stale))
+	}
+	s.passthrough(w, r)
 }
 
 //handleUpsertContact invalidates cached contacts before passing through to the backend
 func (s *Server) handleUpsertContact(w http.ResponseWriter, r *http.Request) {
-	//Invalidate existing
+	//Writes refused by the rate limits leave the cache untouched
+	if !s.admit(w, r) {
+		return
+	}
 
+	//Invalidate existing
 	apiKey := r.Header.Get(apiKeyHeader)
 
 	vars := mux.Vars(r)
 	idOrEmail := vars["idOrEmail"]
 
-	if err := s.invalidateContact(r.Context(), apiKey, idOrEmail); err != nil {
-		s.log.WithError(err).Error("failed to invalidate contact cache")
-	}
+	s.invalidate(r.Context(), apiKey, idOrEmail)
 
 	//passthrough to be cached
-	s.be.ServeHTTP(w, r)
+	cw, w := s.recordChange(w, r)
+	s.forward(w, r)
+
+	s.publishChange(r.Context(), cw, changeUpsert, idOrEmail)
 }
 
 //handleDeleteContact passes through to backend before invalidating the cached contact
 func (s *Server) handleDeleteContact(w http.ResponseWriter, r *http.Request) {
 	//passthrough
-	s.be.ServeHTTP(w, r)
+	cw, w := s.recordChange(w, r)
+	if !s.passthrough(w, r) {
+		return
+	}
 
 	//Invalidate cache
 	apiKey := r.Header.Get(apiKeyHeader)
@@ -275,38 +402,171 @@ func (s *Server) handleDeleteContact(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	idOrEmail := vars["idOrEmail"]
 
-	if err := s.invalidateContact(r.Context(), apiKey, idOrEmail); err != nil {
-		s.log.WithError(err).Error("failed to invalidate contact cache")
+	s.invalidate(r.Context(), apiKey, idOrEmail)
+
+	s.publishChange(r.Context(), cw, changeDelete, idOrEmail)
+}
+
+//invalidate invalidates the contact, queueing the invalidation in the outbox to be
+//retried if the cache fails
+func (s *Server) invalidate(ctx context.Context, apiKey string, idOrEmail string) {
+	err := s.invalidateContact(ctx, apiKey, idOrEmail)
+	if err == nil {
+		return
 	}
 
+	s.log.WithError(err).Warn("failed to invalidate contact cache, queueing retry")
+	if qErr := s.outbox.enqueue(outboxInvalidate, tenantHash(apiKey), idOrEmail, err); qErr != nil {
+		s.log.WithError(qErr).Error("failed to queue contact invalidation")
+	}
 }
 
 //InvalidateContact clears the cache of both the alias and primary contact cache entry
 func (s *Server) invalidateContact(ctx context.Context, apiKey string, idOrEmail string) error {
+	return s.invalidateTenantContact(ctx, tenantHash(apiKey), idOrEmail)
+}
+
+//invalidateTenantContact clears the tenants contact and list cache entries, returning
+//the first failure after attempting every entry
+func (s *Server) invalidateTenantContact(ctx context.Context, tenant string, idOrEmail string) error {
+	//Recorded before deleting so in flight populates are discarded
+	if err := s.markInvalidated(ctx, tenant, idOrEmail); err != nil {
+		return err
+	}
+
 	//Check if is a person key or email
-	var cacheKey string
+	var cacheKey, aliasKey string
 	if s.isPersonKey(idOrEmail) {
-		//Find the contact key for email
-		realKey, err := s.cache.Get(ctx, s.prefixKey(apiKey, idOrEmail))
-		if realKey == "" || err != nil {
+		//Find the contact key for email, falling back to the stale alias once the alias expired
+		aliasKey = tenantKey(tenant, idOrEmail)
+		realKey, err := s.cache.Get(ctx, aliasKey)
+		if errors.Is(err, ErrCacheMiss) {
+			realKey, err = s.cache.Get(ctx, staleKey(aliasKey))
+		}
+		if errors.Is(err, ErrCacheMiss) {
+			//Lists may still include the contact
+			if err := s.invalidateLists(ctx, tenant); err != nil {
+				return err
+			}
+
+			s.notifyContact(ctx, tenant, noticeInvalidated, idOrEmail)
+			return nil
+		} else if realKey == "" || err != nil {
 			return err
 		}
 
 		cacheKey = realKey
 	} else {
-		cacheKey = s.prefixKey(apiKey, idOrEmail)
+		cacheKey = tenantKey(tenant, idOrEmail)
+	}
+
+	var err error
+	del := func(key string) {
+		if delErr := s.cache.Delete(ctx, key); delErr != nil && err == nil {
+			err = delErr
+		}
 	}
 
-	s.cache.Delete(ctx, cacheKey)
-	cacheRequests.WithLabelValues("invalidate", "contact").Add(1)
+	del(cacheKey)
+	del(staleKey(cacheKey))
+	if aliasKey != "" {
+		del(staleKey(aliasKey))
+	}
+	s.countTenantCache(tenant, "invalidate", "contact")
 
 	//Invalidate lists responses
-	s.cache.Delete(ctx, s.prefixKey(apiKey, "lists:*"))
-	cacheRequests.WithLabelValues("invalidate", "list").Add(1)
+	if listErr := s.invalidateLists(ctx, tenant); listErr != nil && err == nil {
+		err = listErr
+	}
+
+	if err == nil {
+		s.notifyContact(ctx, tenant, noticeInvalidated, idOrEmail, strings.TrimPrefix(cacheKey, tenantKey(tenant, "")))
+	}
+
+	return err
+}
+
+//invalidateLists clears the tenants list responses and their stale copies
+func (s *Server) invalidateLists(ctx context.Context, tenant string) error {
+	//Recorded before deleting so in flight list populates are discarded
+	if err := s.markInvalidated(ctx, tenant, listsInvalidated); err != nil {
+		return err
+	}
+
+	if _, err := s.manager().PurgeLists(ctx, tenant); err != nil {
+		return err
+	}
+
+	s.countTenantCache(tenant, "invalidate", "list")
+	return nil
+}
 
+//markInvalidated records when the tenants contact keys were invalidated
+func (s *Server) markInvalidated(ctx context.Context, tenant string, keys ...string) error {
+	at := strconv.FormatInt(time.Now().UnixNano(), 10)
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := s.cache.Set(ctx, invalidatedKey(tenantKey(tenant, key)), at, invalidatedTTL); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+//discardInvalidated removes the contact just cached if it was invalidated by ID or email
+//after the response was read, so a populate finishing after a write can't restore the
+//contact as it was before the write
+func (s *Server) discardInvalidated(ctx context.Context, apiKey string, body string, read time.Time) error {
+	tenant := tenantHash(apiKey)
+	email := gjson.Get(body, "Email").String()
+	id := gjson.Get(body, "contact_id").String()
+
+	invalidated := false
+	for _, key := range []string{id, email} {
+		if key == "" {
+			continue
+		}
+
+		since, err := s.invalidatedSince(ctx, tenantKey(tenant, key), read)
+		if err != nil {
+			return err
+		}
+		invalidated = invalidated || since
+	}
+	if !invalidated {
+		return nil
+	}
+
+	var err error
+	for _, key := range []string{tenantKey(tenant, email), tenantKey(tenant, id)} {
+		for _, k := range []string{key, staleKey(key)} {
+			if delErr := s.cache.Delete(ctx, k); delErr != nil && err == nil {
+				err = delErr
+			}
+		}
+	}
+	if err == nil {
+		s.notifyContact(ctx, tenant, noticeInvalidated, id, email)
+	}
+
+	return err
+}
+
+//invalidatedSince checks if the contact key was invalidated at or after the time
+func (s *Server) invalidatedSince(ctx context.Context, cacheKey string, since time.Time) (bool, error) {
+	val, err := s.cache.Get(ctx, invalidatedKey(cacheKey))
+	if errors.Is(err, ErrCacheMiss) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	at, _ := strconv.ParseInt(val, 10, 64)
+	return !time.Unix(0, at).Before(since), nil
+}
+
 //handleListContact response with cached list responses based on the bookmark
 func (s *Server) handleListContact(w http.ResponseWriter, r *http.Request) {
 	apiKey := r.Header.Get(apiKeyHeader)
@@ -317,32 +577,112 @@ func (s *Server) handleListContact(w http.ResponseWriter, r *http.Request) {
 	//TODO(tcfw) validate bookmark format
 
 	cacheKey := s.prefixKey(apiKey, fmt.Sprintf("lists:%s", bookmark))
-	val, err := s.cache.Get(r.Context(), cacheKey)
-	if err != nil && err != errRedisNil {
-		s.log.WithError(err).Error("failed to get cache resp")
+	setCacheKey(r.Context(), cacheKey)
+
+	decision := "miss"
+	val, ttl, err := s.getEntry(r.Context(), cacheKey)
+	if err != nil && !errors.Is(err, ErrCacheMiss) {
+		s.logCacheError(err, "failed to get cache resp")
+		decision = "bypass"
 		goto passthrough
 	} else if val == "" {
 		goto passthrough
 	}
 
+	if !s.allow(w, r, budgetCache) {
+		return
+	}
+
+	setCacheDecision(r.Context(), "hit")
+	s.recordEntryAge(r.Context(), cacheKey, s.cfg().Cache.TTL, ttl)
+
 	w.Header().Add("content-type", "application/json")
 	w.Write([]byte(val))
 
-	cacheRequests.WithLabelValues("hit", "list").Add(1)
+	s.countCache(apiKey, "hit", "list")
+	s.sampleHit(r, "list", cacheKey, val)
 
 	return
 
 passthrough:
-	cacheRequests.WithLabelValues("miss", "list").Add(1)
+	s.countCache(apiKey, "miss", "list")
+	setCacheDecision(r.Context(), decision)
+	r = r.WithContext(withStaleRef(r.Context(), &staleRef{key: cacheKey, entity: "list"}))
+	s.passthrough(w, r)
+}
+
+//handlePassthrough forwards all non-cached routes to the backend
+func (s *Server) handlePassthrough(w http.ResponseWriter, r *http.Request) {
+	s.passthrough(w, r)
+}
+
+//passthrough forwards the request to the backend if the tenant has backend budget remaining
+//and is not currently rate limited by the backend
+func (s *Server) passthrough(w http.ResponseWriter, r *http.Request) bool {
+	if !s.admit(w, r) {
+		return false
+	}
+
+	s.forward(w, r)
+	return true
+}
+
+//admit waits out the backends rate limit for the tenant and takes from the tenants backend
+//budget, responding if the request can't be forwarded
+func (s *Server) admit(w http.ResponseWriter, r *http.Request) bool {
+	if wait := s.upstreamLimits.remaining(tenantHash(r.Header.Get(apiKeyHeader))); wait > 0 {
+		if !s.awaitUpstreamLimit(w, r, wait) {
+			return false
+		}
+	}
+
+	return s.allow(w, r, budgetBackend)
+}
+
+//forward sends the request to the backend, mirroring it to the shadow backend
+func (s *Server) forward(w http.ResponseWriter, r *http.Request) {
+	//Mirror to the shadow backend once the response has been served
+	sr, w := s.mirror(w, r)
+
+	startUpstream(r.Context())
 	s.be.ServeHTTP(w, r)
+
+	if sr != nil {
+		s.shadow(sr)
+	}
+}
+
+//logCacheError logs cache failures, skipping calls bypassed while the cache is unavailable
+func (s *Server) logCacheError(err error, msg string) {
+	if errors.Is(err, ErrCacheUnavailable) {
+		return
+	}
+
+	s.log.WithError(err).Error(msg)
+}
+
+//countCache records a caching action globally and against the tenant
+func (s *Server) countCache(apiKey string, typ string, entity string) {
+	s.countTenantCache(tenantHash(apiKey), typ, entity)
+}
+
+//countTenantCache counts cache usage for the hashed API key
+func (s *Server) countTenantCache(tenant string, typ string, entity string) {
+	s.metrics.cacheRequests.WithLabelValues(typ, entity).Add(1)
+	s.tenantCounters.add(tenant, typ, entity)
 }
 
 //prefixKey prefixes a given key with a hashed api Key
 func (s *Server) prefixKey(apiKey string, key string) string {
-	return fmt.Sprintf("%x:contact:%s", sha256.Sum256([]byte(apiKey)), key)
+	return tenantKey(tenantHash(apiKey), key)
+}
+
+//tenantHash provides the hashed form of an API key used to namespace tenant state
+func tenantHash(apiKey string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(apiKey)))
 }
 
 //isPersonkey checks if the given key is an email or an ID
 func (s *Server) isPersonKey(key string) bool {
-	return strings.Contains(key, "person_") && !strings.Contains(key, "@")
+	return isPersonKey(key)
 }
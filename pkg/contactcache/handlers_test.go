@@ -6,13 +6,14 @@ import (
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestPrefixKey(t *testing.T) {
-	srv := &Server{}
+	srv := &Server{metrics: NewMetrics()}
 
 	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contact", nil)
 	req.Header.Add(apiKeyHeader, "1234")
@@ -22,7 +23,7 @@ func TestPrefixKey(t *testing.T) {
 }
 
 func TestIsPersonKey(t *testing.T) {
-	srv := &Server{}
+	srv := &Server{metrics: NewMetrics()}
 
 	//Email should be false
 	t1 := srv.isPersonKey("test@example.com")
@@ -42,7 +43,8 @@ func TestAuthCheck(t *testing.T) {
 	be := httputil.NewSingleHostReverseProxy(beURL)
 
 	srv := &Server{
-		be: be,
+		be:      be,
+		metrics: NewMetrics(),
 	}
 	handler := srv.httpHandler()
 
@@ -143,6 +145,171 @@ func TestHandleDeleteContact(t *testing.T) {
 	assert.Equal(t, "", val)
 }
 
+func TestInvalidateLists(t *testing.T) {
+	srv, beReqCount, close, s := setupTestServer(t, `{"contact_id": "person_1", "Email": "chris@autopilothq.com"}`)
+	defer close()
+
+	handler := srv.httpHandler()
+	apiKey := "1234"
+
+	lists := []string{
+		srv.prefixKey(apiKey, "lists:"),
+		srv.prefixKey(apiKey, "lists:person_2"),
+		staleKey(srv.prefixKey(apiKey, "lists:")),
+	}
+	otherTenant := srv.prefixKey("5678", "lists:")
+
+	for _, tc := range []struct{ method, path string }{
+		//Lists are invalidated even when the contact isn't cached by ID
+		{"DELETE", "/v1/contact/person_1"},
+		{"DELETE", "/v1/contact/chris@autopilothq.com"},
+		{"POST", "/v1/contact"},
+	} {
+		for _, key := range append(lists, otherTenant) {
+			s.Set(key, `{"contacts": []}`)
+		}
+
+		req, _ := http.NewRequest(tc.method, "https://anywhere.local"+tc.path, nil)
+		req.Header.Add(apiKeyHeader, apiKey)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		for _, key := range lists {
+			assert.False(t, s.Exists(key), "%s %s left %s", tc.method, tc.path, key)
+		}
+		assert.True(t, s.Exists(otherTenant))
+	}
+
+	assert.Equal(t, 3, *beReqCount)
+	pending, _ := srv.outbox.entries()
+	assert.Empty(t, pending)
+}
+
+func TestPopulateRacingDelete(t *testing.T) {
+	contact := `{"contact_id": "person_1", "Email": "chris@autopilothq.com"}`
+
+	reading := make(chan struct{})
+	release := make(chan struct{})
+	var gets int32
+
+	srv, close, s := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && atomic.AddInt32(&gets, 1) == 1 {
+			close(reading)
+			<-release
+		}
+		fmt.Fprintln(w, contact)
+	})
+	defer close()
+
+	handler := srv.httpHandler()
+	apiKey := "1234"
+
+	send := func(method string) {
+		req, _ := http.NewRequest(method, "https://anywhere.local/v1/contact/person_1", nil)
+		req.Header.Add(apiKeyHeader, apiKey)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	//The contact is deleted while the GET is waiting on the backend
+	done := make(chan struct{})
+	go func() {
+		send("GET")
+		done <- struct{}{}
+	}()
+
+	<-reading
+	send("DELETE")
+	release <- struct{}{}
+	<-done
+
+	//The populate finishing after the delete doesn't restore the contact
+	assert.False(t, s.Exists(srv.prefixKey(apiKey, "chris@autopilothq.com")))
+	assert.False(t, s.Exists(srv.prefixKey(apiKey, "person_1")))
+	assert.False(t, s.Exists(staleKey(srv.prefixKey(apiKey, "chris@autopilothq.com"))))
+
+	//Later reads are cached again
+	send("GET")
+	assert.True(t, s.Exists(srv.prefixKey(apiKey, "chris@autopilothq.com")))
+}
+
+func TestPopulateListRacingUpsert(t *testing.T) {
+	reading := make(chan struct{})
+	release := make(chan struct{})
+	var gets int32
+
+	srv, close, s := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && atomic.AddInt32(&gets, 1) == 1 {
+			close(reading)
+			<-release
+		}
+		fmt.Fprintln(w, `{"contacts": [], "contact_id": "person_1", "Email": "chris@autopilothq.com"}`)
+	})
+	defer close()
+
+	handler := srv.httpHandler()
+	apiKey := "1234"
+	listKey := srv.prefixKey(apiKey, "lists:")
+
+	send := func(method, path string) {
+		req, _ := http.NewRequest(method, "https://anywhere.local"+path, nil)
+		req.Header.Add(apiKeyHeader, apiKey)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	//A contact is upserted while the list is waiting on the backend
+	done := make(chan struct{})
+	go func() {
+		send("GET", "/v1/contacts")
+		done <- struct{}{}
+	}()
+
+	<-reading
+	send("POST", "/v1/contact")
+	release <- struct{}{}
+	<-done
+
+	//The populate finishing after the upsert doesn't restore the list
+	assert.False(t, s.Exists(listKey))
+	assert.False(t, s.Exists(staleKey(listKey)))
+
+	//Later lists are cached again
+	send("GET", "/v1/contacts")
+	assert.True(t, s.Exists(listKey))
+}
+
+func TestDeleteExpiredAliasClearsStale(t *testing.T) {
+	srv, beReqCount, close, s := setupTestServer(t, `{"contact_id": "person_1", "Email": "chris@autopilothq.com"}`)
+	defer close()
+
+	handler := srv.httpHandler()
+	apiKey := "1234"
+
+	send := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, "https://anywhere.local"+path, nil)
+		req.Header.Add(apiKeyHeader, apiKey)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	send("GET", "/v1/contact/person_1")
+
+	//Delete by ID once the live entries expired, leaving only the stale copies
+	s.Del(srv.prefixKey(apiKey, "person_1"))
+	s.Del(srv.prefixKey(apiKey, "chris@autopilothq.com"))
+	send("DELETE", "/v1/contact/person_1")
+
+	assert.False(t, s.Exists(staleKey(srv.prefixKey(apiKey, "person_1"))))
+	assert.False(t, s.Exists(staleKey(srv.prefixKey(apiKey, "chris@autopilothq.com"))))
+
+	//The deleted contact isn't served stale by ID or email
+	srv.pool.primary().breaker.transition(breakerOpen)
+	for _, path := range []string{"/v1/contact/person_1", "/v1/contact/chris@autopilothq.com"} {
+		res := send("GET", path)
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, path)
+	}
+	assert.Equal(t, 2, *beReqCount)
+}
+
 func TestHandleUpsertContact(t *testing.T) {
 	contact := `{
 "contact_id": "person_AP2-9cbf7ac0-eec5-11e4-87bc-6df09cc44d23",
@@ -0,0 +1,160 @@
+package contactcache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statusUp       = "up"
+	statusDown     = "down"
+	statusReady    = "ready"
+	statusDegraded = "degraded"
+	statusNotReady = "not_ready"
+)
+
+//dependencyStatus the result of probing a dependency
+type dependencyStatus struct {
+	Status  string  `json:"status"`
+	Fatal   bool    `json:"fatal"`
+	Latency float64 `json:"latency_ms"`
+	Error   string  `json:"error,omitempty"`
+	Circuit string  `json:"circuit,omitempty"`
+}
+
+//readinessResp readiness endpoint response
+type readinessResp struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+}
+
+//healthProbes caches dependency probe results so frequent readiness checks
+//don't add load to redis or the backend
+type healthProbes struct {
+	mu      sync.Mutex
+	checked time.Time
+	results map[string]dependencyStatus
+}
+
+//handleLiveness reports the process is able to serve requests
+func (s *Server) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+//handleReadiness reports whether the server should receive traffic based on its dependencies
+func (s *Server) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	resp := &readinessResp{
+		Status:       statusReady,
+		Dependencies: s.probeDependencies(r.Context()),
+	}
+
+	for _, dep := range resp.Dependencies {
+		if dep.Status == statusUp {
+			continue
+		}
+		if dep.Fatal {
+			resp.Status = statusNotReady
+		} else if resp.Status == statusReady {
+			resp.Status = statusDegraded
+		}
+	}
+
+	if s.isShuttingDown() {
+		resp.Status = statusNotReady
+	}
+
+	code := http.StatusOK
+	if resp.Status == statusNotReady {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+//probeDependencies checks redis and the backend, reusing recent results
+func (s *Server) probeDependencies(ctx context.Context) map[string]dependencyStatus {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+
+	if s.health.results != nil && time.Since(s.health.checked) < s.cfg().Health.CacheTTL {
+		return s.health.results
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg().Health.Timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var redisStatus, backendStatus dependencyStatus
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		redisStatus = s.probe(ctx, s.cfg().Health.Redis.Fatal, s.pingCache)
+	}()
+	go func() {
+		defer wg.Done()
+		backendStatus = s.probe(ctx, s.cfg().Health.Backend.Fatal, s.pingBackend)
+		if s.pool != nil {
+			backendStatus.Circuit = s.pool.circuitState().String()
+		}
+	}()
+	wg.Wait()
+
+	s.health.results = map[string]dependencyStatus{
+		"redis":   redisStatus,
+		"backend": backendStatus,
+	}
+	s.health.checked = time.Now()
+
+	return s.health.results
+}
+
+//probe times a dependency check
+func (s *Server) probe(ctx context.Context, fatal bool, check func(context.Context) error) dependencyStatus {
+	status := dependencyStatus{
+		Status: statusUp,
+		Fatal:  fatal,
+	}
+
+	start := time.Now()
+	err := check(ctx)
+	status.Latency = float64(time.Since(start).Microseconds()) / 1000
+
+	if err != nil {
+		status.Status = statusDown
+		status.Error = err.Error()
+	}
+
+	return status
+}
+
+//pingCache checks redis is responding
+func (s *Server) pingCache(ctx context.Context) error {
+	if s.rdb == nil {
+		return fmt.Errorf("no cache configured")
+	}
+
+	return s.rdb.Ping(ctx).Err()
+}
+
+//pingBackend checks any upstream in the backend pool is responding without server errors
+func (s *Server) pingBackend(ctx context.Context) error {
+	if s.pool == nil {
+		return fmt.Errorf("no backend configured")
+	}
+
+	return s.pool.ping(ctx, s.cfg().Health.Backend.Path)
+}
+
+//isShuttingDown checks if the server has started a graceful shutdown
+func (s *Server) isShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) == 1
+}
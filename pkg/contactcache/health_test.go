@@ -0,0 +1,108 @@
+package contactcache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readiness(t *testing.T, srv *Server) (int, *readinessResp) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://anywhere.local/readyz", nil)
+	srv.metricsServer().Handler.ServeHTTP(w, req)
+
+	resp := &readinessResp{}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return w.Result().StatusCode, resp
+}
+
+func TestLiveness(t *testing.T) {
+	srv := &Server{metrics: NewMetrics()}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://anywhere.local/healthz", nil)
+	srv.metricsServer().Handler.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Result().StatusCode)
+}
+
+func TestReadiness(t *testing.T) {
+	srv, _, close, s := setupTestServer(t, `{}`)
+	defer close()
+
+	srv.cfg().Health.CacheTTL = 0
+
+	code, resp := readiness(t, srv)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, statusReady, resp.Status)
+	assert.Equal(t, statusUp, resp.Dependencies["redis"].Status)
+	assert.Equal(t, statusUp, resp.Dependencies["backend"].Status)
+	assert.Equal(t, "closed", resp.Dependencies["backend"].Circuit)
+
+	//Redis is degrading by default
+	s.Close()
+
+	code, resp = readiness(t, srv)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, statusDegraded, resp.Status)
+	assert.Equal(t, statusDown, resp.Dependencies["redis"].Status)
+	assert.NotEmpty(t, resp.Dependencies["redis"].Error)
+
+	srv.cfg().Health.Redis.Fatal = true
+
+	code, resp = readiness(t, srv)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, statusNotReady, resp.Status)
+}
+
+func TestReadinessBackendDown(t *testing.T) {
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer close()
+
+	srv.cfg().Health.CacheTTL = 0
+
+	//The backend is degrading by default, so a backend outage doesn't pull every replica
+	code, resp := readiness(t, srv)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, statusDegraded, resp.Status)
+	assert.Equal(t, statusDown, resp.Dependencies["backend"].Status)
+
+	srv.cfg().Health.Backend.Fatal = true
+
+	code, resp = readiness(t, srv)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, statusNotReady, resp.Status)
+}
+
+func TestReadinessCachesProbes(t *testing.T) {
+	srv, _, close, s := setupTestServer(t, `{}`)
+	defer close()
+
+	_, resp := readiness(t, srv)
+	assert.Equal(t, statusReady, resp.Status)
+
+	s.Close()
+
+	_, resp = readiness(t, srv)
+	assert.Equal(t, statusReady, resp.Status)
+}
+
+func TestNotReadyWhileShuttingDown(t *testing.T) {
+	srv, _, close, _ := setupTestServer(t, `{}`)
+	defer close()
+
+	atomic.StoreInt32(&srv.shuttingDown, 1)
+
+	code, resp := readiness(t, srv)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, statusNotReady, resp.Status)
+}
@@ -0,0 +1,211 @@
+package contactcache
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	//listenFdsStart the first file descriptor passed by systemd socket activation
+	listenFdsStart = 3
+)
+
+//listener a bound socket and the server handling it
+type listener struct {
+	cfg ListenerConfig
+	ln  net.Listener
+	srv *http.Server
+}
+
+//serve serves the listener until the server is shutdown
+func (l *listener) serve() error {
+	if l.cfg.Protocol == "https" {
+		return l.srv.ServeTLS(l.ln, "", "")
+	}
+
+	return l.srv.Serve(l.ln)
+}
+
+//String describes the listener for logging
+func (l *listener) String() string {
+	if l.cfg.ProxyProtocol {
+		return fmt.Sprintf("%s %s://%s (PROXY protocol)", l.cfg.Protocol, l.cfg.Network, l.ln.Addr())
+	}
+	return fmt.Sprintf("%s %s://%s", l.cfg.Protocol, l.cfg.Network, l.ln.Addr())
+}
+
+//openListeners binds each of the configured listeners with a server using the handler.
+//tlsConfig is only required if a https listener is configured
+func (s *Server) openListeners(handler http.Handler, tlsConfig *tls.Config) ([]*listener, error) {
+	var (
+		listeners []*listener
+		activated []activatedListener
+		passed    bool
+	)
+
+	closeAll := func() {
+		for _, l := range listeners {
+			l.ln.Close()
+		}
+		for _, a := range activated {
+			a.ln.Close()
+		}
+	}
+
+	for _, cfg := range s.cfg().listeners() {
+		if cfg.Network == "systemd" && !passed {
+			var err error
+			if activated, err = systemdListeners(); err != nil {
+				closeAll()
+				return nil, err
+			}
+			passed = true
+		}
+
+		ln, err := listen(cfg, &activated)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		if cfg.ProxyProtocol {
+			ln = &proxyListener{Listener: ln, metrics: s.metrics}
+		}
+
+		srv := &http.Server{Addr: ln.Addr().String(), Handler: handler}
+		if cfg.ProxyProtocol {
+			srv.ConnContext = func(ctx context.Context, _ net.Conn) context.Context {
+				return withProxyProtocol(ctx)
+			}
+		}
+		switch cfg.Protocol {
+		case "https":
+			srv.TLSConfig = tlsConfig
+		case "h2c":
+			srv.Handler = h2c.NewHandler(handler, &http2.Server{})
+		}
+
+		listeners = append(listeners, &listener{cfg: cfg, ln: ln, srv: srv})
+	}
+
+	//Sockets passed by systemd but not configured are not used
+	for _, a := range activated {
+		s.log.Warnf("Ignoring unconfigured systemd socket %q", a.name)
+		a.ln.Close()
+	}
+
+	return listeners, nil
+}
+
+//listen binds the listener socket, taking systemd sockets from the activated list
+func listen(cfg ListenerConfig, activated *[]activatedListener) (net.Listener, error) {
+	switch cfg.Network {
+	case "unix":
+		return listenUnix(cfg)
+	case "systemd":
+		for i, a := range *activated {
+			if cfg.Address == "" || cfg.Address == a.name {
+				*activated = append((*activated)[:i], (*activated)[i+1:]...)
+				return a.ln, nil
+			}
+		}
+		return nil, fmt.Errorf("no systemd socket named %q was passed", cfg.Address)
+	default:
+		return net.Listen("tcp", cfg.Address)
+	}
+}
+
+//listenUnix binds a unix socket, removing a stale socket left by a previous process
+func listenUnix(cfg ListenerConfig) (net.Listener, error) {
+	if info, err := os.Stat(cfg.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(cfg.Address); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %s", cfg.Address, err)
+		}
+	}
+
+	ln, err := net.Listen("unix", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.SocketMode != "" {
+		mode, err := cfg.socketMode()
+		if err == nil {
+			err = os.Chmod(cfg.Address, mode)
+		}
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	return ln, nil
+}
+
+//activatedListener a socket passed by systemd, named by the FileDescriptorName of the
+//socket unit
+type activatedListener struct {
+	name string
+	ln   net.Listener
+}
+
+//systemdListeners provides the sockets passed by systemd socket activation, see
+//sd_listen_fds(3). The environment is cleared so the sockets aren't inherited
+func systemdListeners() ([]activatedListener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("systemd listener configured but no sockets were passed")
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("systemd listener configured but no sockets were passed")
+	}
+
+	var names []string
+	if env := os.Getenv("LISTEN_FDNAMES"); env != "" {
+		names = strings.Split(env, ":")
+	}
+
+	return fileListeners(listenFdsStart, count, names)
+}
+
+//fileListeners wraps the count inherited file descriptors from first as listeners
+func fileListeners(first, count int, names []string) ([]activatedListener, error) {
+	listeners := make([]activatedListener, 0, count)
+	for i := 0; i < count; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(first+i)
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(first+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.ln.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %q: %s", name, err)
+		}
+
+		listeners = append(listeners, activatedListener{name: name, ln: ln})
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,98 @@
+package contactcache
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+//listenerGet requests a contact through the client
+func listenerGet(client *http.Client, url string) (*http.Response, error) {
+	req, _ := http.NewRequest("GET", url+"/v1/contact/person_1234", nil)
+	req.Header.Add(apiKeyHeader, "1234")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return resp, nil
+}
+
+func TestListeners(t *testing.T) {
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"contact_id": "person_1234", "Email": "chris@autopilothq.com"}`)
+	})
+	defer close()
+
+	socket := filepath.Join(t.TempDir(), "contactcache.sock")
+	srv.cfg().Listeners = []ListenerConfig{
+		{Network: "unix", Address: socket, Protocol: "http", SocketMode: "0660"},
+		{Address: "127.0.0.1:0", Protocol: "h2c"},
+	}
+
+	listeners, err := srv.openListeners(srv.httpHandler(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range listeners {
+		go l.serve()
+		defer l.srv.Close()
+	}
+
+	//Unix socket
+	info, err := os.Stat(socket)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+	}
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := listenerGet(unixClient, "http://unix")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+
+	//Cleartext HTTP/2
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err = listenerGet(h2cClient, "http://"+listeners[1].ln.Addr().String())
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, 2, resp.ProtoMajor)
+	}
+
+}
+
+func TestUnixListenerReplacesStaleSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "contactcache.sock")
+
+	//Leave the socket file behind, as after a crash
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenUnix(ListenerConfig{Network: "unix", Address: socket})
+	if assert.NoError(t, err) {
+		ln.Close()
+	}
+}
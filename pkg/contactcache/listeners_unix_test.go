@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+package contactcache
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	passed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer passed.Close()
+
+	f, err := passed.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	//fileListeners takes ownership of the descriptor, as if inherited
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activated, err := fileListeners(fd, 1, []string{"proxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = listen(ListenerConfig{Network: "systemd", Address: "metrics"}, &activated)
+	assert.Error(t, err)
+
+	ln, err := listen(ListenerConfig{Network: "systemd", Address: "proxy"}, &activated)
+	if assert.NoError(t, err) {
+		defer ln.Close()
+		assert.Equal(t, passed.Addr().String(), ln.Addr().String())
+		assert.Empty(t, activated)
+	}
+
+	//Without sockets passed by systemd
+	_, err = systemdListeners()
+	assert.Error(t, err)
+}
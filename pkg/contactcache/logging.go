@@ -0,0 +1,229 @@
+package contactcache
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+)
+
+var (
+	//emailRegexp matches emails, including URL encoded emails in paths
+	emailRegexp = regexp.MustCompile(`[A-Za-z0-9._%+\-]+(@|%40)[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)+`)
+
+	//secretParamRegexp matches the values of query params carrying secrets, such as the
+	//webhook secret
+	secretParamRegexp = regexp.MustCompile(`(?i)([?&](secret|token|api_key)=)[^&#\s"]*`)
+
+	//requestIDRegexp limits propagated request IDs to safe values
+	requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:\-]{1,128}$`)
+
+	//sensitiveFields log fields which are always redacted
+	sensitiveFields = map[string]bool{
+		apiKeyHeader:    true,
+		"api_key":       true,
+		"authorization": true,
+		"password":      true,
+		"secret":        true,
+		"token":         true,
+	}
+)
+
+//requestInfo collects details about a request for its access log
+type requestInfo struct {
+	id            string
+	cache         string
+	cacheTime     time.Duration
+	upstreamStart time.Time
+	upstream      time.Duration
+	upstreamName  string
+
+	//key the resolved cache key, with the TTL and age of the entry if served from the cache
+	key    string
+	hasTTL bool
+	ttl    time.Duration
+	age    time.Duration
+}
+
+//newFormatter provides the configured log formatter, redacting PII from all entries
+func newFormatter(format string) logrus.Formatter {
+	var next logrus.Formatter = &logrus.JSONFormatter{}
+	if format == "text" {
+		next = &logrus.TextFormatter{}
+	}
+
+	return &redactingFormatter{next: next}
+}
+
+//redactingFormatter hashes emails and removes secrets from log entries before formatting
+type redactingFormatter struct {
+	next logrus.Formatter
+}
+
+//Format redacts a copy of the entry
+func (f *redactingFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	redacted := *e
+	redacted.Message = redact(e.Message)
+	redacted.Data = make(logrus.Fields, len(e.Data))
+
+	for k, v := range e.Data {
+		if sensitiveFields[strings.ToLower(k)] {
+			redacted.Data[k] = "[REDACTED]"
+			continue
+		}
+
+		switch val := v.(type) {
+		case string:
+			v = redact(val)
+		case error:
+			v = redact(val.Error())
+		case fmt.Stringer:
+			v = redact(val.String())
+		}
+		redacted.Data[k] = v
+	}
+
+	return f.next.Format(&redacted)
+}
+
+//redact removes PII and secret query params
+func redact(s string) string {
+	return secretParamRegexp.ReplaceAllString(redactPII(s), "${1}[REDACTED]")
+}
+
+//redactPII replaces emails with a short hash, keeping entries for the same email correlatable
+func redactPII(s string) string {
+	return emailRegexp.ReplaceAllStringFunc(s, func(email string) string {
+		email = strings.ToLower(strings.Replace(email, "%40", "@", 1))
+		sum := sha256.Sum256([]byte(email))
+		return "email:" + hex.EncodeToString(sum[:])[:12]
+	})
+}
+
+//newRequestID generates a random request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+//requestLogging assigns each request an ID, propagated from the caller if provided,
+//and writes a structured access log once the request completes
+func (s *Server) requestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRegexp.MatchString(id) {
+			id = newRequestID()
+			//Forwarded on to the backend
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{id: id}
+
+		wRec := &statusRecorder{
+			ResponseWriter: w,
+			Status:         200,
+		}
+
+		start := time.Now()
+		next.ServeHTTP(wRec, r.WithContext(withRequestInfo(r.Context(), info)))
+
+		fields := logrus.Fields{
+			"request_id":  id,
+			"method":      r.Method,
+			"route":       routeTemplate(r),
+			"path":        r.URL.Path,
+			"status":      wRec.Status,
+			"duration_ms": durationMs(time.Since(start)),
+			"remote_addr": r.RemoteAddr,
+		}
+		if ip := clientIP(r); ip != "" {
+			fields["client_ip"] = ip
+		}
+		if apiKey := r.Header.Get(apiKeyHeader); apiKey != "" {
+			fields["tenant"] = tenantHash(apiKey)
+		}
+		if info.cache != "" {
+			fields["cache"] = info.cache
+		}
+		if info.upstream > 0 {
+			fields["upstream_ms"] = durationMs(info.upstream)
+		}
+		if info.upstreamName != "" {
+			fields["upstream"] = info.upstreamName
+		}
+
+		s.logger().WithFields(fields).Info("request")
+	})
+}
+
+//reqLog provides a log entry tagged with the requests ID
+func (s *Server) reqLog(ctx context.Context) *logrus.Entry {
+	if info, ok := requestInfoFromContext(ctx); ok {
+		return s.logger().WithField("request_id", info.id)
+	}
+	return logrus.NewEntry(s.logger())
+}
+
+//logger provides the servers logger, falling back to the standard logger if not set
+func (s *Server) logger() *logrus.Logger {
+	if s.log == nil {
+		return logrus.StandardLogger()
+	}
+	return s.log
+}
+
+//setCacheDecision records how the cache handled the request
+func setCacheDecision(ctx context.Context, decision string) {
+	if info, ok := requestInfoFromContext(ctx); ok {
+		info.cache = decision
+	}
+}
+
+//startUpstream marks the request being forwarded to the backend
+func startUpstream(ctx context.Context) {
+	if info, ok := requestInfoFromContext(ctx); ok {
+		info.upstreamStart = time.Now()
+	}
+}
+
+//upstreamStarted provides when the request was first sent to the backend, zero if unknown
+func upstreamStarted(ctx context.Context) time.Time {
+	if info, ok := requestInfoFromContext(ctx); ok {
+		return info.upstreamStart
+	}
+	return time.Time{}
+}
+
+//setUpstream records which upstream in the backend pool served the request, the last
+//attempted when retried
+func setUpstream(ctx context.Context, name string) {
+	if info, ok := requestInfoFromContext(ctx); ok {
+		info.upstreamName = name
+	}
+}
+
+//endUpstream records how long the backend took to respond
+func endUpstream(ctx context.Context) {
+	if info, ok := requestInfoFromContext(ctx); ok && !info.upstreamStart.IsZero() {
+		info.upstream = time.Since(info.upstreamStart)
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
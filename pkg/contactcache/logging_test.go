@@ -0,0 +1,123 @@
+package contactcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+//logLines decodes each JSON log entry written
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %s", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestRedactingFormatter(t *testing.T) {
+	var buf bytes.Buffer
+	log := logrus.New()
+	log.Out = &buf
+	log.SetFormatter(newFormatter("json"))
+
+	log.WithFields(logrus.Fields{
+		"path":        "/v1/contact/Chris%40autopilothq.com",
+		apiKeyHeader:  "1234",
+		"error_field": errors.New("no contact chris@autopilothq.com"),
+		"uri":         "/webhooks/autopilot?Secret=0123456789abcdef&id=person_1",
+	}).Errorf("failed for %s", "chris@autopilothq.com")
+
+	out := buf.String()
+	assert.NotContains(t, out, "autopilothq.com")
+	assert.NotContains(t, out, "1234")
+	assert.NotContains(t, out, "0123456789abcdef")
+
+	entry := logLines(t, &buf)[0]
+	email := redactPII("chris@autopilothq.com")
+	assert.Equal(t, "failed for "+email, entry["msg"])
+	assert.Equal(t, "/v1/contact/"+email, entry["path"])
+	assert.Equal(t, "no contact "+email, entry["error_field"])
+	assert.Equal(t, "[REDACTED]", entry[apiKeyHeader])
+	assert.Equal(t, "/webhooks/autopilot?Secret=[REDACTED]&id=person_1", entry["uri"])
+}
+
+func TestRequestLogging(t *testing.T) {
+	contact := `{"contact_id": "person_1234", "Email": "chris@autopilothq.com"}`
+
+	var backendID string
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		backendID = r.Header.Get(requestIDHeader)
+		fmt.Fprintln(w, contact)
+	})
+	defer close()
+
+	var buf bytes.Buffer
+	srv.log.Out = &buf
+
+	handler := srv.httpHandler()
+
+	//Generated and forwarded to the backend
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contact/chris@autopilothq.com", nil)
+	req.Header.Add(apiKeyHeader, "1234")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	id := w.Result().Header.Get(requestIDHeader)
+	assert.Len(t, id, 32)
+	assert.Equal(t, id, backendID)
+
+	assert.NotContains(t, buf.String(), "chris@autopilothq.com")
+
+	entries := logLines(t, &buf)
+	if assert.Len(t, entries, 1) {
+		entry := entries[0]
+		assert.Equal(t, "request", entry["msg"])
+		assert.Equal(t, id, entry["request_id"])
+		assert.Equal(t, "GET", entry["method"])
+		assert.Equal(t, "/v1/contact/{idOrEmail}", entry["route"])
+		assert.Equal(t, float64(200), entry["status"])
+		assert.Equal(t, "miss", entry["cache"])
+		assert.Equal(t, tenantHash("1234"), entry["tenant"])
+		assert.Contains(t, entry, "upstream_ms")
+		assert.Contains(t, entry, "duration_ms")
+	}
+
+	//Propagated from the caller
+	buf.Reset()
+	req.Header.Set(requestIDHeader, "abc-123")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "abc-123", w.Result().Header.Get(requestIDHeader))
+
+	entries = logLines(t, &buf)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "abc-123", entries[0]["request_id"])
+		assert.Equal(t, "hit", entries[0]["cache"])
+		assert.NotContains(t, entries[0], "upstream_ms")
+	}
+
+	//Unsafe IDs are replaced
+	req.Header.Set(requestIDHeader, "bad id\n")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Len(t, w.Result().Header.Get(requestIDHeader), 32)
+}
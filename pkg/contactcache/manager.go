@@ -0,0 +1,347 @@
+package contactcache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	//tenantStatsTTL how long per tenant stats are kept after the last update
+	tenantStatsTTL = 30 * 24 * time.Hour
+)
+
+var (
+	tenantHashRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+//tenantKey builds a cache key within a tenants namespace
+func tenantKey(tenant string, key string) string {
+	return fmt.Sprintf("%s:contact:%s", tenant, key)
+}
+
+//tenantStatsKey the key holding a tenants cache stats
+func tenantStatsKey(tenant string) string {
+	return fmt.Sprintf("%s:stats", tenant)
+}
+
+//isPersonKey checks if the given key is an email or an ID
+func isPersonKey(key string) bool {
+	return strings.Contains(key, "person_") && !strings.Contains(key, "@")
+}
+
+//ValidTenant checks the tenant is a hashed API key
+func ValidTenant(tenant string) bool {
+	return tenantHashRegexp.MatchString(tenant)
+}
+
+//TenantHash provides the hashed form of an API key which namespaces the tenants cache entries
+func TenantHash(apiKey string) string {
+	return tenantHash(apiKey)
+}
+
+//CacheEntry a cached key and its remaining TTL
+type CacheEntry struct {
+	Key   string          `json:"key"`
+	Alias string          `json:"alias,omitempty"`
+	TTL   float64         `json:"ttl_seconds"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+//TenantStats cache usage for a tenant, keyed by caching action then entity
+type TenantStats struct {
+	Tenant   string                      `json:"tenant"`
+	Counts   map[string]map[string]int64 `json:"counts"`
+	HitRatio float64                     `json:"hit_ratio"`
+}
+
+//NewCacheManagerFromConfig provides a cache manager connected to the configured cache
+func NewCacheManagerFromConfig(cfg *Config) (*CacheManager, error) {
+	rdb, err := newRedisClient(cfg.Cache)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCacheManager(rdb), nil
+}
+
+//NewCacheManager provides cache inspection and purging over tenant namespaces
+func NewCacheManager(rdb *redis.Client) *CacheManager {
+	return &CacheManager{rdb: rdb}
+}
+
+//CacheManager inspects and purges cache entries for a tenant
+type CacheManager struct {
+	rdb *redis.Client
+}
+
+//Close closes the cache connection
+func (cm *CacheManager) Close() error {
+	return cm.rdb.Close()
+}
+
+//Lookup provides the cached contact by email or person ID, returning ErrCacheMiss if not cached
+func (cm *CacheManager) Lookup(ctx context.Context, tenant string, idOrEmail string) (*CacheEntry, error) {
+	entry := &CacheEntry{Key: tenantKey(tenant, idOrEmail)}
+
+	if isPersonKey(idOrEmail) {
+		realKey, err := cm.rdb.Get(ctx, entry.Key).Result()
+		if err == redis.Nil {
+			return nil, ErrCacheMiss
+		} else if err != nil {
+			return nil, err
+		}
+		entry.Alias = entry.Key
+		entry.Key = realKey
+	}
+
+	pipe := cm.rdb.Pipeline()
+	val := pipe.Get(ctx, entry.Key)
+	ttl := pipe.PTTL(ctx, entry.Key)
+	if _, err := pipe.Exec(ctx); err == redis.Nil {
+		return nil, ErrCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+
+	entry.Value = json.RawMessage(val.Val())
+	entry.TTL = ttlSeconds(ttl.Val())
+
+	return entry, nil
+}
+
+//Keys lists all cache entries in the tenants namespace with their TTLs
+func (cm *CacheManager) Keys(ctx context.Context, tenant string) ([]*CacheEntry, error) {
+	var keys []string
+	for _, pattern := range tenantCachePatterns(tenant) {
+		matched, err := cm.scan(ctx, pattern)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, matched...)
+	}
+
+	pipe := cm.rdb.Pipeline()
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		ttls[i] = pipe.PTTL(ctx, key)
+	}
+	if len(keys) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	entries := make([]*CacheEntry, 0, len(keys))
+	for i, key := range keys {
+		entries = append(entries, &CacheEntry{Key: key, TTL: ttlSeconds(ttls[i].Val())})
+	}
+
+	return entries, nil
+}
+
+//PurgeContact removes a contact, its alias, its not found response and the tenants list
+//responses, resolving expired aliases through their stale copy
+func (cm *CacheManager) PurgeContact(ctx context.Context, tenant string, idOrEmail string) (int64, error) {
+	keys := []string{tenantKey(tenant, idOrEmail)}
+
+	if isPersonKey(idOrEmail) {
+		realKey, err := cm.rdb.Get(ctx, keys[0]).Result()
+		if err == redis.Nil {
+			realKey, err = cm.rdb.Get(ctx, staleKey(keys[0])).Result()
+		}
+		if err != nil && err != redis.Nil {
+			return 0, err
+		} else if realKey != "" {
+			keys = append(keys, realKey)
+		}
+	}
+
+	stale := make([]string, 0, len(keys))
+	for _, key := range keys {
+		stale = append(stale, staleKey(key))
+	}
+	keys = append(keys, stale...)
+
+	//Contacts which have since been created
+	keys = append(keys, negativeKey(tenantKey(tenant, idOrEmail)))
+
+	n, err := cm.rdb.Del(ctx, keys...).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	lists, err := cm.PurgeLists(ctx, tenant)
+	return n + lists, err
+}
+
+//PurgeLists removes the tenants cached list responses
+func (cm *CacheManager) PurgeLists(ctx context.Context, tenant string) (int64, error) {
+	listKey := tenantKey(tenant, "lists:*")
+	return cm.purge(ctx, listKey, staleKey(listKey))
+}
+
+//PurgeTenant removes all cache entries for the tenant, keeping its rate limits and stats
+func (cm *CacheManager) PurgeTenant(ctx context.Context, tenant string) (int64, error) {
+	return cm.purge(ctx, tenantCachePatterns(tenant)...)
+}
+
+//tenantCachePatterns matches the tenants cache entries and their stale copies
+func tenantCachePatterns(tenant string) []string {
+	key := tenantKey(tenant, "*")
+	return []string{key, staleKey(key)}
+}
+
+//Stats provides the tenants cache usage
+func (cm *CacheManager) Stats(ctx context.Context, tenant string) (*TenantStats, error) {
+	vals, err := cm.rdb.HGetAll(ctx, tenantStatsKey(tenant)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &TenantStats{
+		Tenant: tenant,
+		Counts: map[string]map[string]int64{},
+	}
+
+	var hits, misses int64
+	for field, val := range vals {
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		var n int64
+		fmt.Sscan(val, &n)
+
+		if _, ok := stats.Counts[parts[0]]; !ok {
+			stats.Counts[parts[0]] = map[string]int64{}
+		}
+		stats.Counts[parts[0]][parts[1]] = n
+
+		switch parts[0] {
+		case "hit", "stale", "negative":
+			hits += n
+		case "miss":
+			misses += n
+		}
+	}
+
+	if hits+misses > 0 {
+		stats.HitRatio = float64(hits) / float64(hits+misses)
+	}
+
+	return stats, nil
+}
+
+//purge deletes all keys matching the patterns
+func (cm *CacheManager) purge(ctx context.Context, patterns ...string) (int64, error) {
+	var n int64
+
+	for _, pattern := range patterns {
+		keys, err := cm.scan(ctx, pattern)
+		if err != nil {
+			return n, err
+		}
+		if len(keys) == 0 {
+			continue
+		}
+
+		deleted, err := cm.rdb.Del(ctx, keys...).Result()
+		n += deleted
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+//scan finds all keys matching the pattern without blocking redis
+func (cm *CacheManager) scan(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+
+	iter := cm.rdb.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+
+	return keys, iter.Err()
+}
+
+//ttlSeconds converts a redis TTL to seconds, with keys without an expiry as -1
+func ttlSeconds(ttl time.Duration) float64 {
+	if ttl < 0 {
+		return -1
+	}
+	return ttl.Seconds()
+}
+
+//tenantCounters aggregates per tenant cache stats in memory to be periodically
+//flushed to redis, avoiding a redis write per request
+type tenantCounters struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int64
+}
+
+//add increments the tenants counter for the caching action and entity
+func (tc *tenantCounters) add(tenant string, typ string, entity string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.counts == nil {
+		tc.counts = map[string]map[string]int64{}
+	}
+	if _, ok := tc.counts[tenant]; !ok {
+		tc.counts[tenant] = map[string]int64{}
+	}
+
+	tc.counts[tenant][typ+":"+entity]++
+}
+
+//flush writes the aggregated counters to redis
+func (tc *tenantCounters) flush(ctx context.Context, rdb *redis.Client) error {
+	tc.mu.Lock()
+	counts := tc.counts
+	tc.counts = nil
+	tc.mu.Unlock()
+
+	if len(counts) == 0 {
+		return nil
+	}
+
+	pipe := rdb.Pipeline()
+	for tenant, fields := range counts {
+		key := tenantStatsKey(tenant)
+		for field, n := range fields {
+			pipe.HIncrBy(ctx, key, field, n)
+		}
+		pipe.Expire(ctx, key, tenantStatsTTL)
+	}
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+//flushTenantStatsLoop periodically writes the aggregated tenant stats to redis
+func (s *Server) flushTenantStatsLoop(ctx context.Context) {
+	t := time.NewTicker(s.cfg().Stats.FlushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.tenantCounters.flush(ctx, s.rdb); err != nil {
+				s.log.WithError(err).Error("failed to flush tenant stats")
+			}
+		}
+	}
+}
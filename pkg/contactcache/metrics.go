@@ -7,46 +7,375 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/spf13/viper"
 )
 
 const (
 	metricsNS = "contactcache"
 )
 
-var (
-	metricsRequests = promauto.NewHistogramVec(prometheus.HistogramOpts{
-		Namespace: metricsNS,
-		Name:      "requests",
-		Help:      "histogram of requests through the middleware",
-		Buckets: []float64{
-			0.01, 0.1, 1, 10, 100, 1000, 2000, 5000,
-		},
-	}, []string{"status"})
-
-	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
-		Namespace: metricsNS,
-		Name:      "cache_requests",
-		Help:      "Cache hits and misses",
-	}, []string{"type", "entity"})
-)
+//Metrics prometheus collectors for a server, registered on their own registry
+type Metrics struct {
+	registry *prometheus.Registry
 
-//startMetricsEndpoint starts a prometheus endpoint
-func (s *Server) startMetricsEndpoint() error {
-	r := mux.NewRouter()
+	requests         *prometheus.HistogramVec
+	requestsInFlight prometheus.Gauge
+
+	cacheRequests         *prometheus.CounterVec
+	cacheOperations       *prometheus.HistogramVec
+	cacheErrors           *prometheus.CounterVec
+	cacheBypassed         *prometheus.CounterVec
+	cacheAvailable        prometheus.Gauge
+	cacheBodySize         *prometheus.HistogramVec
+	cachePopulateFailures *prometheus.CounterVec
+	cachePopulateInFlight prometheus.Gauge
+	cacheVerifications    *prometheus.CounterVec
+	cacheVerifiedAge      *prometheus.HistogramVec
+
+	outboxPending      prometheus.Gauge
+	outboxDead         prometheus.Gauge
+	outboxAttempts     *prometheus.CounterVec
+	outboxDeadLettered *prometheus.CounterVec
+
+	rateLimitRequests *prometheus.CounterVec
+
+	shadowComparisons *prometheus.CounterVec
+
+	webhookEvents *prometheus.CounterVec
+
+	changeEvents *prometheus.CounterVec
+
+	contactStreams prometheus.Gauge
+	contactNotices *prometheus.CounterVec
+
+	clientIPSource      *prometheus.CounterVec
+	proxyProtocolErrors prometheus.Counter
+
+	upstreamRequests           *prometheus.HistogramVec
+	upstreamInFlight           prometheus.Gauge
+	upstreamRateLimited        prometheus.Counter
+	upstreamRateLimitDecisions *prometheus.CounterVec
+	upstreamErrors             *prometheus.CounterVec
+	upstreamRetries            prometheus.Counter
+	upstreamCircuitState       *prometheus.GaugeVec
+	upstreamCircuitTransitions *prometheus.CounterVec
+	upstreamCircuitRejected    *prometheus.CounterVec
+	upstreamAvailable          *prometheus.GaugeVec
+	upstreamPoolRequests       *prometheus.CounterVec
+	upstreamEjections          *prometheus.CounterVec
+
+	configReloads    *prometheus.CounterVec
+	configLastReload *prometheus.GaugeVec
+}
+
+//NewMetrics creates the server collectors on a new registry, along with the go runtime
+//and process collectors
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		requests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNS,
+			Name:      "request_duration_seconds",
+			Help:      "Duration of requests through the middleware",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+
+		requestsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNS,
+			Name:      "requests_in_flight",
+			Help:      "Requests currently being served",
+		}),
+
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "cache_requests",
+			Help:      "Cache hits and misses",
+		}, []string{"type", "entity"}),
+
+		cacheOperations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNS,
+			Name:      "cache_operation_duration_seconds",
+			Help:      "Duration of redis operations",
+			Buckets:   []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+		}, []string{"op", "result"}),
+
+		cacheErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "cache_errors",
+			Help:      "Failed cache operations",
+		}, []string{"op"}),
+
+		cacheBypassed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "cache_bypassed",
+			Help:      "Cache operations skipped while the cache is unavailable",
+		}, []string{"op"}),
+
+		cacheAvailable: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNS,
+			Name:      "cache_available",
+			Help:      "Whether the cache is in use (1) or bypassed due to failures (0)",
+		}),
+
+		cacheBodySize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNS,
+			Name:      "cache_body_size_bytes",
+			Help:      "Size of cached response bodies",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+		}, []string{"entity"}),
+
+		cachePopulateFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "cache_populate_failures",
+			Help:      "Backend responses which failed to be cached",
+		}, []string{"entity"}),
+
+		cachePopulateInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNS,
+			Name:      "cache_populate_in_flight",
+			Help:      "Backend responses currently being cached",
+		}),
+
+		cacheVerifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "cache_verifications",
+			Help:      "Sampled cache hits compared with the live backend response",
+		}, []string{"entity", "result"}),
+
+		cacheVerifiedAge: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNS,
+			Name:      "cache_verified_age_seconds",
+			Help:      "Age of sampled cache hits when compared with the live backend response",
+			Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+		}, []string{"entity", "result"}),
+
+		rateLimitRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "ratelimit_requests",
+			Help:      "Rate limit decisions per budget",
+		}, []string{"budget", "result"}),
+
+		shadowComparisons: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "shadow_comparisons",
+			Help:      "Responses from the shadow backend compared with the primary",
+		}, []string{"route", "result"}),
+
+		outboxPending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNS,
+			Name:      "outbox_pending",
+			Help:      "Failed operations queued to be retried",
+		}),
+
+		outboxDead: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNS,
+			Name:      "outbox_dead_letters",
+			Help:      "Queued operations which reached the maximum attempts",
+		}),
+
+		outboxAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "outbox_attempts",
+			Help:      "Retries of queued operations",
+		}, []string{"kind", "result"}),
+
+		outboxDeadLettered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "outbox_dead_lettered",
+			Help:      "Queued operations moved to the dead letters after the maximum attempts",
+		}, []string{"kind"}),
+
+		webhookEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "webhook_events",
+			Help:      "Autopilot webhook deliveries received",
+		}, []string{"event", "result"}),
+
+		changeEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "change_events",
+			Help:      "Contact change events queued and published to the sink",
+		}, []string{"operation", "result"}),
+
+		contactStreams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNS,
+			Name:      "contact_event_streams",
+			Help:      "Clients currently streaming contact events",
+		}),
+
+		contactNotices: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "contact_notices",
+			Help:      "Contact invalidations and caching shared with the event streams",
+		}, []string{"type", "result"}),
+
+		clientIPSource: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "client_ip_source",
+			Help:      "Requests by how the client IP was resolved (peer, proxy_protocol or forwarded)",
+		}, []string{"source"}),
+
+		proxyProtocolErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "proxy_protocol_errors",
+			Help:      "Connections closed due to a missing or invalid PROXY protocol header",
+		}),
+
+		upstreamRequests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNS,
+			Name:      "upstream_request_duration_seconds",
+			Help:      "Duration of each backend request attempt until response headers are received",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "status"}),
+
+		upstreamInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNS,
+			Name:      "upstream_requests_in_flight",
+			Help:      "Backend requests currently awaiting a response",
+		}),
+
+		upstreamRateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "upstream_ratelimited",
+			Help:      "Rate limited responses received from the backend",
+		}),
+
+		upstreamRateLimitDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "upstream_ratelimit_decisions",
+			Help:      "Handling of cache misses while the backend is rate limiting a tenant",
+		}, []string{"decision"}),
 
-	r.Handle("/metrics", promhttp.Handler())
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "upstream_errors",
+			Help:      "Failed backend requests by how they were handled",
+		}, []string{"type"}),
 
-	s.log.Info("Starting metrics endpoint")
+		upstreamRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "upstream_retries",
+			Help:      "Retried backend requests",
+		}),
 
-	metricsAddr := viper.GetString("metrics.address")
-	if metricsAddr == "" {
-		metricsAddr = ":9102"
+		upstreamCircuitState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNS,
+			Name:      "upstream_circuit_state",
+			Help:      "Circuit breaker state of each upstream (0 - closed, 1 - half-open, 2 - open)",
+		}, []string{"upstream"}),
+
+		upstreamCircuitTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "upstream_circuit_transitions",
+			Help:      "Upstream circuit breaker state changes",
+		}, []string{"upstream", "state"}),
+
+		upstreamCircuitRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "upstream_circuit_rejected",
+			Help:      "Backend requests rejected by an upstreams open circuit breaker",
+		}, []string{"upstream"}),
+
+		upstreamAvailable: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNS,
+			Name:      "upstream_available",
+			Help:      "Whether each upstream in the backend pool is passing active health checks (1) or not (0)",
+		}, []string{"upstream"}),
+
+		upstreamPoolRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "upstream_pool_requests",
+			Help:      "Backend request attempts per upstream",
+		}, []string{"upstream", "result"}),
+
+		upstreamEjections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "upstream_ejections",
+			Help:      "Upstreams ejected from the backend pool after consecutive failures",
+		}, []string{"upstream"}),
+
+		configReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNS,
+			Name:      "config_reloads",
+			Help:      "Config and TLS certificate reloads",
+		}, []string{"type", "result"}),
+
+		configLastReload: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNS,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Time of the last successful config or TLS certificate reload",
+		}, []string{"type"}),
 	}
 
-	return http.ListenAndServe(metricsAddr, r)
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestsInFlight,
+		m.cacheRequests,
+		m.cacheOperations,
+		m.cacheErrors,
+		m.cacheBypassed,
+		m.cacheAvailable,
+		m.cacheBodySize,
+		m.cachePopulateFailures,
+		m.cachePopulateInFlight,
+		m.cacheVerifications,
+		m.cacheVerifiedAge,
+		m.outboxPending,
+		m.outboxDead,
+		m.outboxAttempts,
+		m.outboxDeadLettered,
+		m.rateLimitRequests,
+		m.shadowComparisons,
+		m.webhookEvents,
+		m.changeEvents,
+		m.contactStreams,
+		m.contactNotices,
+		m.clientIPSource,
+		m.proxyProtocolErrors,
+		m.upstreamRequests,
+		m.upstreamInFlight,
+		m.upstreamRateLimited,
+		m.upstreamRateLimitDecisions,
+		m.upstreamErrors,
+		m.upstreamRetries,
+		m.upstreamCircuitState,
+		m.upstreamCircuitTransitions,
+		m.upstreamCircuitRejected,
+		m.upstreamAvailable,
+		m.upstreamPoolRequests,
+		m.upstreamEjections,
+		m.configReloads,
+		m.configLastReload,
+	)
+
+	return m
+}
+
+//Registry provides the registry the collectors are registered on
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+//Handler serves the registry in the prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+//metricsServer provides the prometheus and health endpoint server
+func (s *Server) metricsServer() *http.Server {
+	r := mux.NewRouter()
+
+	r.Handle("/metrics", s.metrics.Handler())
+	r.HandleFunc("/healthz", s.handleLiveness)
+	r.HandleFunc("/readyz", s.handleReadiness)
+
+	return &http.Server{
+		Addr:    s.cfg().Metrics.Address,
+		Handler: r,
+	}
 }
 
 //statusRecorder simple struct to record status from requests
@@ -55,9 +384,31 @@ type statusRecorder struct {
 	Status int
 }
 
-//Metrics simple counter for requests
-func (s *Server) metrics(next http.Handler) http.Handler {
+//WriteHeader records the status before writing it
+func (r *statusRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+//Flush sends any buffered data to the client, for streamed responses
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//instrument records request durations by route, method and status
+func (s *Server) instrument(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//Event streams are long lived so are measured by contact_event_streams instead,
+		//rather than skewing the request durations and requests in flight
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() == routeContactEvents {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s.metrics.requestsInFlight.Inc()
+		defer s.metrics.requestsInFlight.Dec()
 
 		wRec := &statusRecorder{
 			ResponseWriter: w,
@@ -66,6 +417,52 @@ func (s *Server) metrics(next http.Handler) http.Handler {
 
 		sTime := time.Now()
 		next.ServeHTTP(wRec, r)
-		metricsRequests.WithLabelValues(fmt.Sprintf("%d", wRec.Status)).Observe(float64(time.Since(sTime).Milliseconds()))
+
+		s.metrics.requests.WithLabelValues(routeTemplate(r), r.Method, fmt.Sprintf("%d", wRec.Status)).Observe(time.Since(sTime).Seconds())
 	})
 }
+
+//routeTemplate provides the matched route template, keeping label cardinality bounded
+//and paths with emails out of metrics and spans
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "/"
+}
+
+//instrumentedTransport records the latency of each backend request attempt
+type instrumentedTransport struct {
+	next    http.RoundTripper
+	metrics *Metrics
+}
+
+//RoundTrip times the request until response headers are received
+func (it *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	it.metrics.upstreamInFlight.Inc()
+	defer it.metrics.upstreamInFlight.Dec()
+
+	start := time.Now()
+	resp, err := it.next.RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = fmt.Sprintf("%d", resp.StatusCode)
+	}
+	it.metrics.upstreamRequests.WithLabelValues(req.Method, status).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
+
+//recordReload exports the result of a config or certificate reload
+func (m *Metrics) recordReload(typ string, ok bool) {
+	if !ok {
+		m.configReloads.WithLabelValues(typ, "failure").Inc()
+		return
+	}
+
+	m.configReloads.WithLabelValues(typ, "success").Inc()
+	m.configLastReload.WithLabelValues(typ).Set(float64(time.Now().Unix()))
+}
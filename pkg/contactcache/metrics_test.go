@@ -0,0 +1,111 @@
+package contactcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+//sampleCount provides the number of observations of a histogram with matching labels
+func sampleCount(t *testing.T, m *Metrics, name string, labels map[string]string) uint64 {
+	families, err := m.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count uint64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if want, ok := labels[label.GetName()]; ok && want != label.GetValue() {
+					continue metrics
+				}
+			}
+			count += metric.GetHistogram().GetSampleCount()
+		}
+	}
+
+	return count
+}
+
+func TestMetrics(t *testing.T) {
+	contact := `{"contact_id": "person_1234", "Email": "chris@autopilothq.com"}`
+
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, contact)
+	})
+	defer close()
+
+	handler := srv.httpHandler()
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contact/chris@autopilothq.com", nil)
+	req.Header.Add(apiKeyHeader, "1234")
+
+	//Miss then hit
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Result().StatusCode)
+	}
+
+	//Requests rejected by the middleware are measured
+	req, _ = http.NewRequest("GET", "https://anywhere.local/v1/contact/chris@autopilothq.com", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	m := srv.metrics
+
+	assert.Equal(t, uint64(2), sampleCount(t, m, "contactcache_request_duration_seconds", map[string]string{
+		"route": "/v1/contact/{idOrEmail}", "method": "GET", "status": "200",
+	}))
+	assert.Equal(t, uint64(1), sampleCount(t, m, "contactcache_request_duration_seconds", map[string]string{
+		"route": "/v1/contact/{idOrEmail}", "method": "GET", "status": "400",
+	}))
+	assert.Equal(t, uint64(1), sampleCount(t, m, "contactcache_upstream_request_duration_seconds", map[string]string{
+		"method": "GET", "status": "200",
+	}))
+	assert.Equal(t, uint64(1), sampleCount(t, m, "contactcache_cache_operation_duration_seconds", map[string]string{
+		"op": "get", "result": "ok",
+	}))
+	assert.Equal(t, uint64(1), sampleCount(t, m, "contactcache_cache_body_size_bytes", map[string]string{
+		"entity": "contact",
+	}))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.cacheRequests.WithLabelValues("hit", "contact")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.cacheRequests.WithLabelValues("miss", "contact")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.requestsInFlight))
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.upstreamInFlight))
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.cachePopulateInFlight))
+
+	//Registries are independent between servers
+	assert.Equal(t, uint64(0), sampleCount(t, NewMetrics(), "contactcache_request_duration_seconds", nil))
+}
+
+func TestMetricsPopulateFailures(t *testing.T) {
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"contacts": []}`)
+	})
+	defer close()
+
+	inner := &flakyCache{down: true}
+	srv.cacheHealth = NewHealthCheckedCache(inner, HealthOpts{FailureThreshold: 10}, srv.log, srv.metrics)
+	srv.cache = srv.cacheHealth
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contacts", nil)
+	req.Header.Add(apiKeyHeader, "1234")
+
+	w := httptest.NewRecorder()
+	srv.httpHandler().ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.cachePopulateFailures.WithLabelValues("list")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.cacheErrors.WithLabelValues("set")))
+}
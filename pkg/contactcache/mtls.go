@@ -0,0 +1,127 @@
+package contactcache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+//loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(file, name string) (*x509.CertPool, error) {
+	ca, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", name, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", name)
+	}
+
+	return pool, nil
+}
+
+//configureClientAuth verifies client certificates against the client CA if configured
+func (s *Server) configureClientAuth(tlsConfig *tls.Config) error {
+	cfg := s.cfg().TLS.Client
+	if cfg.CA == "" {
+		return nil
+	}
+
+	pool, err := loadCertPool(cfg.CA, "client CA")
+	if err != nil {
+		return err
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if cfg.Required {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return nil
+}
+
+//clientCertCheck rejects requests using an API key which isn't bound to the presented
+//client certificate, or which is bound to a certificate when none was presented
+func (s *Server) clientCertCheck(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg().TLS.Client
+		if len(cfg.Bindings) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		subjects := clientCertSubjects(r)
+		bound, allowed := cfg.binding(tenantHash(r.Header.Get(apiKeyHeader)), subjects)
+
+		switch {
+		case allowed || (!bound && len(subjects) == 0):
+			next.ServeHTTP(w, r)
+		case len(subjects) > 0:
+			s.reqLog(r.Context()).WithField("subjects", subjects).Warn("API key not bound to client certificate")
+			w.Header().Add("content-type", "application/json")
+			httpJSONError(w, "API key not permitted for client certificate.", http.StatusForbidden)
+		default:
+			w.Header().Add("content-type", "application/json")
+			httpJSONError(w, "Client certificate required.", http.StatusForbidden)
+		}
+	})
+}
+
+//clientCertSubjects provides the common name and SANs of a verified client certificate
+func clientCertSubjects(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	var subjects []string
+	if cert.Subject.CommonName != "" {
+		subjects = append(subjects, cert.Subject.CommonName)
+	}
+	subjects = append(subjects, cert.DNSNames...)
+	subjects = append(subjects, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		subjects = append(subjects, uri.String())
+	}
+
+	return subjects
+}
+
+//binding checks if the tenant is bound to any client certificate, and whether it is bound
+//to one of the given subjects
+func (c ClientTLSConfig) binding(tenant string, subjects []string) (bound bool, allowed bool) {
+	for _, b := range c.Bindings {
+		if !b.hasTenant(tenant) {
+			continue
+		}
+		bound = true
+
+		for _, subject := range subjects {
+			if subject == b.Subject {
+				return true, true
+			}
+		}
+	}
+
+	return bound, false
+}
+
+func (b ClientBinding) hasTenant(tenant string) bool {
+	for _, t := range b.Tenants {
+		if t == tenant {
+			return true
+		}
+	}
+	for _, apiKey := range b.APIKeys {
+		if tenantHash(apiKey) == tenant {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,205 @@
+package contactcache
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//testCA a certificate authority for issuing client certificates in tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key}
+}
+
+//writePEM writes the CA certificate for use as a client CA bundle
+func (ca *testCA) writePEM(t *testing.T) string {
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+//issue creates a client certificate for the common name and DNS SANs
+func (ca *testCA) issue(t *testing.T, cn string, dnsNames ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+//startMTLSServer serves the proxy over TLS with client authentication configured
+func startMTLSServer(t *testing.T, srv *Server) *httptest.Server {
+	tlsConfig, err := srv.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.configureClientAuth(tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(srv.httpHandler())
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+
+	return ts
+}
+
+//mtlsGet requests a contact with the API key, presenting the client certificate if given
+func mtlsGet(ts *httptest.Server, apiKey string, cert *tls.Certificate) (int, error) {
+	transport := ts.Client().Transport.(*http.Transport).Clone()
+	if cert != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	client := &http.Client{Transport: transport}
+	defer transport.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/v1/contact/person_1234", nil)
+	req.Header.Add(apiKeyHeader, apiKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+func TestClientCertBindings(t *testing.T) {
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"contact_id": "person_1234", "Email": "chris@autopilothq.com"}`)
+	})
+	defer close()
+
+	ca := newTestCA(t)
+	billing := ca.issue(t, "billing")
+	reports := ca.issue(t, "reports-7f9c", "reports.internal")
+	other := ca.issue(t, "other")
+
+	srv.cfg().TLS.Client = ClientTLSConfig{
+		CA: ca.writePEM(t),
+		Bindings: []ClientBinding{
+			{Subject: "billing", APIKeys: []string{"1234"}},
+			{Subject: "reports.internal", Tenants: []string{tenantHash("5678")}},
+		},
+	}
+
+	ts := startMTLSServer(t, srv)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		apiKey string
+		cert   *tls.Certificate
+		status int
+	}{
+		{"bound key", "1234", &billing, 200},
+		{"bound tenant by SAN", "5678", &reports, 200},
+		{"key bound to another certificate", "5678", &billing, 403},
+		{"unbound key", "9999", &billing, 403},
+		{"unbound certificate", "1234", &other, 403},
+		{"bound key without certificate", "1234", nil, 403},
+		{"unbound key without certificate", "9999", nil, 200},
+	}
+
+	for _, test := range tests {
+		status, err := mtlsGet(ts, test.apiKey, test.cert)
+		if assert.NoError(t, err, test.name) {
+			assert.Equal(t, test.status, status, test.name)
+		}
+	}
+
+	//Certificates from other CAs are rejected during the handshake
+	untrusted := newTestCA(t).issue(t, "billing")
+	_, err := mtlsGet(ts, "1234", &untrusted)
+	assert.Error(t, err)
+}
+
+func TestClientCertRequired(t *testing.T) {
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"contact_id": "person_1234", "Email": "chris@autopilothq.com"}`)
+	})
+	defer close()
+
+	ca := newTestCA(t)
+	client := ca.issue(t, "billing")
+
+	srv.cfg().TLS.Client = ClientTLSConfig{
+		CA:       ca.writePEM(t),
+		Required: true,
+	}
+
+	ts := startMTLSServer(t, srv)
+	defer ts.Close()
+
+	_, err := mtlsGet(ts, "1234", nil)
+	assert.Error(t, err)
+
+	//Without bindings any verified certificate may use any key
+	status, err := mtlsGet(ts, "1234", &client)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, status)
+	}
+}
@@ -0,0 +1,128 @@
+package contactcache
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+//negativeKey provides the key holding the backends not found response for a contact
+func negativeKey(cacheKey string) string {
+	parts := strings.SplitN(cacheKey, ":", 2)
+	if len(parts) != 2 {
+		return "negative:" + cacheKey
+	}
+
+	return parts[0] + ":negative:" + parts[1]
+}
+
+//negativeCacheable checks if the response is a contact the backend doesn't have, and
+//negative caching is enabled
+func (s *Server) negativeCacheable(r *http.Response) bool {
+	if r.StatusCode != http.StatusNotFound || s.cfg().Cache.NegativeTTL <= 0 {
+		return false
+	}
+
+	_, ok := notFoundContact(r.Request)
+	return ok
+}
+
+//notFoundContact provides the ID or email of a contact read
+func notFoundContact(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, "/v1/contact/") {
+		return "", false
+	}
+
+	idOrEmail := strings.TrimPrefix(r.URL.Path, "/v1/contact/")
+	return idOrEmail, idOrEmail != "" && !strings.Contains(idOrEmail, "/")
+}
+
+//cacheNotFound caches the backends not found response for the contact, discarding it if
+//the contact was created or invalidated after the response was read
+func (s *Server) cacheNotFound(ctx context.Context, r *http.Request, apiKey string, body string, read time.Time) error {
+	idOrEmail, ok := notFoundContact(r)
+	if !ok {
+		return nil
+	}
+
+	key := s.prefixKey(apiKey, idOrEmail)
+	if err := s.cache.Set(ctx, negativeKey(key), body, s.cfg().Cache.NegativeTTL); err != nil {
+		s.logCacheError(err, "failed to set negative contact key")
+		return err
+	}
+
+	invalidated, err := s.invalidatedSince(ctx, key, read)
+	if err != nil {
+		return err
+	}
+	if invalidated {
+		return s.cache.Delete(ctx, negativeKey(key))
+	}
+
+	return nil
+}
+
+//clearNotFound removes the not found responses of upserted contacts, recording them as
+//invalidated so not found responses still in flight aren't cached
+func (s *Server) clearNotFound(ctx context.Context, apiKey string, body string) error {
+	if s.cfg().Cache.NegativeTTL <= 0 {
+		return nil
+	}
+
+	contacts := gjson.Get(body, "contacts").Array()
+	if len(contacts) == 0 {
+		contacts = []gjson.Result{gjson.Parse(body)}
+	}
+
+	tenant := tenantHash(apiKey)
+	for _, contact := range contacts {
+		keys := []string{contact.Get("contact_id").String(), contact.Get("Email").String()}
+		if err := s.markInvalidated(ctx, tenant, keys...); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if key == "" {
+				continue
+			}
+			if err := s.cache.Delete(ctx, negativeKey(tenantKey(tenant, key))); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//serveNotFound responds with the cached not found response for the contact if one exists
+func (s *Server) serveNotFound(w http.ResponseWriter, r *http.Request, cacheKey string) bool {
+	setTTL := s.cfg().Cache.NegativeTTL
+	if setTTL <= 0 {
+		return false
+	}
+
+	key := negativeKey(cacheKey)
+	val, ttl, err := s.getEntry(r.Context(), key)
+	if err != nil {
+		return false
+	}
+
+	if !s.allow(w, r, budgetCache) {
+		return true
+	}
+
+	setCacheDecision(r.Context(), "negative")
+	s.recordEntryAge(r.Context(), key, setTTL, ttl)
+
+	w.Header().Add("content-type", "application/json")
+	w.Header().Add("cached", "negative")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte(val))
+
+	s.countCache(r.Header.Get(apiKeyHeader), "negative", "contact")
+
+	return true
+}
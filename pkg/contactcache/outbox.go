@@ -0,0 +1,536 @@
+package contactcache
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//Outbox entry kinds
+const (
+	outboxInvalidate = "invalidate"
+	outboxEvent      = "change_event"
+)
+
+//outboxKinds are each retried by their own worker, so slow event deliveries don't hold
+//up invalidations
+var outboxKinds = []string{outboxInvalidate, outboxEvent}
+
+//Outbox WAL record ops, each pending or dead record holds the full entry so replaying
+//keeps the latest state of every entry
+const (
+	outboxOpPending = "pending"
+	outboxOpDead    = "dead"
+	outboxOpDone    = "done"
+)
+
+//outboxCompactRecords WAL records allowed beyond the live entries before compacting
+const outboxCompactRecords = 1000
+
+//errOutboxClosed the outbox has been closed during shutdown
+var errOutboxClosed = errors.New("outbox closed")
+
+//outboxEntry an operation retried with backoff until it succeeds or is dead lettered
+type outboxEntry struct {
+	ID          uint64    `json:"id"`
+	Kind        string    `json:"kind"`
+	Tenant      string    `json:"tenant"`
+	Key         string    `json:"key"`
+	Attempts    int       `json:"attempts"`
+	Created     time.Time `json:"created"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	//Event the change event to publish
+	Event *ChangeEvent `json:"event,omitempty"`
+}
+
+//outboxRecord a line of the WAL
+type outboxRecord struct {
+	Op    string       `json:"op"`
+	ID    uint64       `json:"id"`
+	Entry *outboxEntry `json:"entry,omitempty"`
+}
+
+//outbox a durable queue of operations which must be retried until they succeed, such as
+//cache invalidations during a redis outage or change events awaiting delivery. Entries
+//are written to a local WAL, fsynced before being acknowledged, so they survive
+//restarts. Without a path entries are only kept in memory and lost on restart
+type outbox struct {
+	cfg     OutboxConfig
+	metrics *Metrics
+	log     *logrus.Logger
+
+	mu      sync.Mutex
+	file    *os.File
+	closed  bool
+	records int
+	nextID  uint64
+	pending map[uint64]*outboxEntry
+	dead    map[uint64]*outboxEntry
+
+	//wake signals the kinds retry loop of new entries
+	wake map[string]chan struct{}
+}
+
+//newOutbox opens the outbox, replaying any entries left in the WAL
+func newOutbox(cfg OutboxConfig, metrics *Metrics, log *logrus.Logger) (*outbox, error) {
+	ob := &outbox{
+		cfg:     cfg,
+		metrics: metrics,
+		log:     log,
+		pending: map[uint64]*outboxEntry{},
+		dead:    map[uint64]*outboxEntry{},
+		wake:    map[string]chan struct{}{},
+	}
+	for _, kind := range outboxKinds {
+		ob.wake[kind] = make(chan struct{}, 1)
+	}
+
+	if cfg.Path == "" {
+		log.Warn("outbox.path isn't set, queued invalidations and change events are only kept in memory and lost on restart")
+		return ob, nil
+	}
+
+	f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox: %s", err)
+	}
+
+	if err := ob.replay(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Close()
+
+	//Start from a compacted WAL, dropping any torn final record
+	if err := ob.compact(); err != nil {
+		return nil, err
+	}
+
+	if len(ob.pending)+len(ob.dead) > 0 {
+		log.WithField("pending", len(ob.pending)).WithField("dead", len(ob.dead)).Info("Recovered outbox entries")
+	}
+	ob.updateMetrics()
+
+	return ob, nil
+}
+
+//replay applies the WAL records in order
+func (ob *outbox) replay(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		var rec outboxRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			//A crash mid write leaves a partial record
+			ob.log.WithError(err).Warnf("Skipping invalid outbox record on line %d", line)
+			continue
+		}
+
+		ob.apply(rec)
+		if rec.ID > ob.nextID {
+			ob.nextID = rec.ID
+		}
+	}
+
+	return scanner.Err()
+}
+
+//apply updates the in memory state from a record
+func (ob *outbox) apply(rec outboxRecord) {
+	switch rec.Op {
+	case outboxOpPending:
+		if rec.Entry != nil {
+			delete(ob.dead, rec.ID)
+			ob.pending[rec.ID] = rec.Entry
+		}
+	case outboxOpDead:
+		if rec.Entry != nil {
+			delete(ob.pending, rec.ID)
+			ob.dead[rec.ID] = rec.Entry
+		}
+	case outboxOpDone:
+		delete(ob.pending, rec.ID)
+		delete(ob.dead, rec.ID)
+	}
+}
+
+//write appends the record to the WAL and applies it once synced. Must hold mu
+func (ob *outbox) write(rec outboxRecord) error {
+	//Records can't be persisted once the WAL is closed
+	if ob.closed {
+		return errOutboxClosed
+	}
+
+	if ob.file != nil {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+
+		if _, err := ob.file.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		if err := ob.file.Sync(); err != nil {
+			return err
+		}
+		ob.records++
+	}
+
+	ob.apply(rec)
+	return nil
+}
+
+//compact rewrites the WAL with only the live entries, atomically replacing the current
+//WAL. Must hold mu or not yet be shared
+func (ob *outbox) compact() error {
+	tmp := ob.cfg.Path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to compact outbox: %s", err)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	records := 0
+	for op, entries := range map[string]map[uint64]*outboxEntry{outboxOpPending: ob.pending, outboxOpDead: ob.dead} {
+		for id, e := range entries {
+			if err := enc.Encode(outboxRecord{Op: op, ID: id, Entry: e}); err != nil {
+				f.Close()
+				return err
+			}
+			records++
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, ob.cfg.Path); err != nil {
+		return fmt.Errorf("failed to compact outbox: %s", err)
+	}
+
+	if ob.file != nil {
+		ob.file.Close()
+	}
+	ob.file, err = os.OpenFile(ob.cfg.Path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open outbox: %s", err)
+	}
+	ob.records = records
+
+	return nil
+}
+
+//enqueue records a failed operation to be retried
+func (ob *outbox) enqueue(kind, tenant, key string, cause error) error {
+	e := &outboxEntry{
+		Kind:        kind,
+		Tenant:      tenant,
+		Key:         key,
+		NextAttempt: time.Now().Add(ob.backoffFor(0)),
+	}
+	if cause != nil {
+		e.LastError = cause.Error()
+	}
+
+	return ob.add(e)
+}
+
+//publish queues the change event to be delivered immediately, and retried until the
+//sink accepts it
+func (ob *outbox) publish(event *ChangeEvent) error {
+	return ob.add(&outboxEntry{
+		Kind:        outboxEvent,
+		Tenant:      event.Tenant,
+		Key:         event.ID,
+		NextAttempt: time.Now(),
+		Event:       event,
+	})
+}
+
+//add writes the new entry, waking the retry loop
+func (ob *outbox) add(e *outboxEntry) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.nextID++
+	e.ID = ob.nextID
+	e.Created = time.Now()
+
+	if err := ob.write(outboxRecord{Op: outboxOpPending, ID: e.ID, Entry: e}); err != nil {
+		return fmt.Errorf("failed to write outbox: %s", err)
+	}
+	ob.updateMetrics()
+	ob.signal(e.Kind)
+
+	return nil
+}
+
+//signal wakes the kinds retry loop
+func (ob *outbox) signal(kind string) {
+	select {
+	case ob.wake[kind] <- struct{}{}:
+	default:
+	}
+}
+
+//backoffFor provides the exponential backoff with jitter after the attempts
+func (ob *outbox) backoffFor(attempts int) time.Duration {
+	if attempts > 30 {
+		attempts = 30
+	}
+
+	backoff := ob.cfg.Backoff << uint(attempts)
+	if backoff <= 0 || backoff > ob.cfg.MaxBackoff {
+		backoff = ob.cfg.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+//run retries due entries of each kind concurrently until the context is done
+func (ob *outbox) run(ctx context.Context, fn func(context.Context, outboxEntry) error) {
+	var wg sync.WaitGroup
+	for _, kind := range outboxKinds {
+		wg.Add(1)
+		go func(kind string) {
+			defer wg.Done()
+			ob.runKind(ctx, kind, fn)
+		}(kind)
+	}
+	wg.Wait()
+}
+
+//runKind retries due entries of the kind until the context is done
+func (ob *outbox) runKind(ctx context.Context, kind string, fn func(context.Context, outboxEntry) error) {
+	for {
+		t := time.NewTimer(ob.untilNext(time.Now(), kind))
+
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-ob.wake[kind]:
+			t.Stop()
+		case <-t.C:
+		}
+
+		ob.processKind(ctx, time.Now(), kind, fn)
+	}
+}
+
+//untilNext provides the time until the next entry of the kind is due
+func (ob *outbox) untilNext(now time.Time, kind string) time.Duration {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	next := time.Minute
+	for _, e := range ob.pending {
+		if e.Kind != kind {
+			continue
+		}
+		if d := e.NextAttempt.Sub(now); d < next {
+			next = d
+		}
+	}
+	if next < 0 {
+		next = 0
+	}
+	return next
+}
+
+//process attempts the entries of every kind due by now
+func (ob *outbox) process(ctx context.Context, now time.Time, fn func(context.Context, outboxEntry) error) {
+	for _, kind := range outboxKinds {
+		ob.processKind(ctx, now, kind, fn)
+	}
+}
+
+//processKind attempts the entries of the kind due by now in order, dead lettering
+//entries which reach the maximum attempts
+func (ob *outbox) processKind(ctx context.Context, now time.Time, kind string, fn func(context.Context, outboxEntry) error) {
+	for _, entry := range ob.due(now, kind) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		e := entry
+		err := fn(ctx, e)
+
+		ob.mu.Lock()
+		if _, ok := ob.pending[e.ID]; !ok {
+			//Discarded while being attempted
+			ob.mu.Unlock()
+			continue
+		}
+
+		rec := outboxRecord{Op: outboxOpDone, ID: e.ID}
+		if err == nil {
+			ob.metrics.outboxAttempts.WithLabelValues(e.Kind, "success").Inc()
+		} else {
+			ob.metrics.outboxAttempts.WithLabelValues(e.Kind, "failure").Inc()
+
+			e.Attempts++
+			e.LastError = err.Error()
+			e.NextAttempt = time.Now().Add(ob.backoffFor(e.Attempts))
+
+			rec = outboxRecord{Op: outboxOpPending, ID: e.ID, Entry: &e}
+			if e.Attempts >= ob.cfg.MaxAttempts {
+				rec.Op = outboxOpDead
+				ob.metrics.outboxDeadLettered.WithLabelValues(e.Kind).Inc()
+				ob.log.WithError(err).WithField("kind", e.Kind).WithField("attempts", e.Attempts).Error("Outbox entry dead lettered")
+			}
+		}
+
+		if werr := ob.write(rec); werr != nil {
+			ob.log.WithError(werr).Error("failed to write outbox")
+		}
+		ob.updateMetrics()
+		ob.mu.Unlock()
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	if ob.file != nil && ob.records > len(ob.pending)+len(ob.dead)+outboxCompactRecords {
+		if err := ob.compact(); err != nil {
+			ob.log.WithError(err).Error("failed to compact outbox")
+		}
+	}
+}
+
+//due copies the pending entries of the kind due by now, oldest first
+func (ob *outbox) due(now time.Time, kind string) []outboxEntry {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	var due []outboxEntry
+	for _, e := range ob.pending {
+		if e.Kind == kind && !e.NextAttempt.After(now) {
+			due = append(due, *e)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+
+	return due
+}
+
+//entries copies the pending and dead lettered entries, oldest first
+func (ob *outbox) entries() (pending []outboxEntry, dead []outboxEntry) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	for _, e := range ob.pending {
+		pending = append(pending, *e)
+	}
+	for _, e := range ob.dead {
+		dead = append(dead, *e)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+	sort.Slice(dead, func(i, j int) bool { return dead[i].ID < dead[j].ID })
+
+	return pending, dead
+}
+
+//requeueDead moves the dead lettered entries back to pending with their attempts reset
+func (ob *outbox) requeueDead() (int, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	n := 0
+	now := time.Now()
+	for id, e := range ob.dead {
+		requeued := *e
+		requeued.Attempts = 0
+		requeued.NextAttempt = now
+
+		if err := ob.write(outboxRecord{Op: outboxOpPending, ID: id, Entry: &requeued}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	ob.updateMetrics()
+
+	for _, kind := range outboxKinds {
+		ob.signal(kind)
+	}
+
+	return n, nil
+}
+
+//discardDead removes the dead lettered entries
+func (ob *outbox) discardDead() (int, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	n := 0
+	for id := range ob.dead {
+		if err := ob.write(outboxRecord{Op: outboxOpDone, ID: id}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	ob.updateMetrics()
+
+	return n, nil
+}
+
+//updateMetrics sets the queue gauges. Must hold mu
+func (ob *outbox) updateMetrics() {
+	ob.metrics.outboxPending.Set(float64(len(ob.pending)))
+	ob.metrics.outboxDead.Set(float64(len(ob.dead)))
+}
+
+//close closes the WAL, pending entries are retried on the next start. Further writes
+//fail with errOutboxClosed
+func (ob *outbox) close() error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.closed = true
+	if ob.file == nil {
+		return nil
+	}
+	err := ob.file.Close()
+	ob.file = nil
+	return err
+}
+
+//applyOutbox performs a queued operation
+func (s *Server) applyOutbox(ctx context.Context, e outboxEntry) error {
+	switch e.Kind {
+	case outboxInvalidate:
+		return s.invalidateTenantContact(ctx, e.Tenant, e.Key)
+	case outboxEvent:
+		return s.deliverChange(ctx, e.Event)
+	default:
+		return fmt.Errorf("unknown outbox entry kind %q", e.Kind)
+	}
+}
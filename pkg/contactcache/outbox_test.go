@@ -0,0 +1,215 @@
+package contactcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+//outageCache fails deletes while the flaky cache is down, passing calls through otherwise
+type outageCache struct {
+	Cacher
+	flaky *flakyCache
+}
+
+func (oc *outageCache) Delete(ctx context.Context, key string) error {
+	if err := oc.flaky.call(); err != nil {
+		return err
+	}
+	return oc.Cacher.Delete(ctx, key)
+}
+
+func TestOutboxEventualInvalidation(t *testing.T) {
+	contact := `{"contact_id": "person_1", "Email": "chris@autopilothq.com"}`
+
+	srv, _, close, s := setupTestServer(t, contact)
+	defer close()
+
+	flaky := &flakyCache{}
+	srv.cache = &outageCache{Cacher: srv.cache, flaky: flaky}
+	srv.cfg().Admin.Token = "secret"
+
+	handler := srv.httpHandler()
+	apiKey := "1234"
+	cacheKey := srv.prefixKey(apiKey, "chris@autopilothq.com")
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contact/chris@autopilothq.com", nil)
+	req.Header.Add(apiKeyHeader, apiKey)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, s.Exists(cacheKey))
+
+	//Redis fails while the contact is deleted
+	flaky.setDown(true)
+
+	req, _ = http.NewRequest("DELETE", "https://anywhere.local/v1/contact/chris@autopilothq.com", nil)
+	req.Header.Add(apiKeyHeader, apiKey)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	pending, _ := srv.outbox.entries()
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, outboxInvalidate, pending[0].Kind)
+		assert.Equal(t, tenantHash(apiKey), pending[0].Tenant)
+		assert.Equal(t, "chris@autopilothq.com", pending[0].Key)
+	}
+
+	//Retries keep failing until redis recovers
+	ctx := context.Background()
+	srv.outbox.process(ctx, time.Now().Add(time.Hour), srv.applyOutbox)
+
+	flaky.setDown(false)
+	assert.True(t, s.Exists(cacheKey))
+
+	pending, _ = srv.outbox.entries()
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, 1, pending[0].Attempts)
+		assert.Equal(t, "connection refused", pending[0].LastError)
+	}
+
+	//Queued invalidations are visible through the admin API
+	w = adminRequest(t, srv.adminHandler(), "GET", "/admin/v1/outbox")
+	var queued map[string][]outboxEntry
+	if assert.NoError(t, json.NewDecoder(w.Body).Decode(&queued)) {
+		assert.Len(t, queued["pending"], 1)
+		assert.Len(t, queued["dead"], 0)
+	}
+
+	srv.outbox.process(ctx, time.Now().Add(time.Hour), srv.applyOutbox)
+	assert.False(t, s.Exists(cacheKey))
+
+	pending, _ = srv.outbox.entries()
+	assert.Empty(t, pending)
+	assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.outboxAttempts.WithLabelValues(outboxInvalidate, "failure")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.outboxAttempts.WithLabelValues(outboxInvalidate, "success")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(srv.metrics.outboxPending))
+}
+
+func TestOutboxWAL(t *testing.T) {
+	cfg := DefaultConfig().Outbox
+	cfg.Path = filepath.Join(t.TempDir(), "outbox.wal")
+	cfg.MaxAttempts = 2
+
+	metrics := NewMetrics()
+	ob, err := newOutbox(cfg, metrics, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, ob.enqueue(outboxInvalidate, "tenant", "chris@autopilothq.com", nil))
+	assert.NoError(t, ob.enqueue(outboxInvalidate, "tenant", "person_1", nil))
+	assert.NoError(t, ob.enqueue(outboxInvalidate, "tenant", "person_2", nil))
+
+	//One succeeds, one is dead lettered and one still pending
+	later := time.Now().Add(time.Hour)
+	fail := errors.New("redis unavailable")
+	apply := func(ctx context.Context, e outboxEntry) error {
+		if e.Key == "chris@autopilothq.com" {
+			return nil
+		}
+		return fail
+	}
+	ob.process(context.Background(), later, apply)
+	ob.process(context.Background(), later, func(ctx context.Context, e outboxEntry) error {
+		if e.Key == "person_1" {
+			return fail
+		}
+		return nil
+	})
+	ob.enqueue(outboxInvalidate, "tenant", "person_3", nil)
+
+	pending, dead := ob.entries()
+	assert.Len(t, pending, 1)
+	assert.Len(t, dead, 1)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.outboxDeadLettered.WithLabelValues(outboxInvalidate)))
+	assert.NoError(t, ob.close())
+
+	//Entries can't be queued once closed rather than only being kept in memory
+	err = ob.enqueue(outboxInvalidate, "tenant", "person_4", nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), errOutboxClosed.Error())
+	}
+
+	//A torn record from a crash mid write is skipped
+	f, _ := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"op":"pending","id":9,"entry":{"id":`)
+	f.Close()
+
+	//Entries are recovered on restart
+	ob, err = newOutbox(cfg, NewMetrics(), logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ob.close()
+
+	recovered, recoveredDead := ob.entries()
+	if assert.Len(t, recovered, 1) {
+		assert.Equal(t, "person_3", recovered[0].Key)
+	}
+	if assert.Len(t, recoveredDead, 1) {
+		assert.Equal(t, "person_1", recoveredDead[0].Key)
+		assert.Equal(t, 2, recoveredDead[0].Attempts)
+		assert.Equal(t, fail.Error(), recoveredDead[0].LastError)
+	}
+
+	//New entries continue from the recovered IDs
+	assert.NoError(t, ob.enqueue(outboxInvalidate, "tenant", "person_4", nil))
+	recovered, _ = ob.entries()
+	assert.True(t, recovered[1].ID > recoveredDead[0].ID)
+
+	n, err := ob.requeueDead()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	recovered, recoveredDead = ob.entries()
+	assert.Len(t, recovered, 3)
+	assert.Empty(t, recoveredDead)
+}
+
+func TestOutboxKindWorkers(t *testing.T) {
+	ob, err := newOutbox(DefaultConfig().Outbox, NewMetrics(), logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	invalidated := make(chan string, 1)
+	go ob.run(ctx, func(ctx context.Context, e outboxEntry) error {
+		if e.Kind == outboxEvent {
+			<-release
+			return nil
+		}
+		invalidated <- e.Key
+		return nil
+	})
+
+	//A slow event delivery doesn't hold up invalidations queued after it
+	assert.NoError(t, ob.publish(&ChangeEvent{ID: "event_1", Tenant: "tenant"}))
+	assert.NoError(t, ob.enqueue(outboxInvalidate, "tenant", "person_1", nil))
+
+	select {
+	case key := <-invalidated:
+		assert.Equal(t, "person_1", key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("invalidation waited for the event delivery")
+	}
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		pending, _ := ob.entries()
+		return len(pending) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,461 @@
+package contactcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//Load balancing strategies
+const (
+	strategyRoundRobin = "round_robin"
+	strategyLeastConn  = "least_conn"
+	strategyWeighted   = "weighted"
+)
+
+//upstream a backend in the pool
+type upstream struct {
+	name   string
+	url    *url.URL
+	weight int
+
+	//active in-flight requests, for least connections
+	active int64
+
+	mu sync.Mutex
+	//healthy from active health checks
+	healthy   bool
+	successes int
+	failures  int
+	//consecutive passive failures and when an ejection ends
+	consecutive  int
+	ejectedUntil time.Time
+	//current smooth weighted round robin weight
+	current int
+
+	//breaker fast-fails requests to the upstream, nil if disabled
+	breaker *circuitBreaker
+}
+
+//available checks the upstream is healthy, not ejected and its breaker isn't open
+func (u *upstream) available(now time.Time) bool {
+	if u.breaker != nil && u.breaker.State() == breakerOpen {
+		return false
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.healthy && !now.Before(u.ejectedUntil)
+}
+
+//upstreamPool balances backend requests across upstreams, excluding upstreams failing
+//active health checks or ejected after consecutive failures
+type upstreamPool struct {
+	members  []*upstream
+	strategy string
+	health   ActiveHealthConfig
+	outlier  OutlierConfig
+	metrics  *Metrics
+	log      *logrus.Logger
+
+	//client sends health checks, bounded by the health check timeout
+	client *http.Client
+
+	next uint64
+	//wrrMu guards the smooth weighted round robin state
+	wrrMu sync.Mutex
+}
+
+//newUpstreamPool creates the pool from the backend pool, or the single backend address
+func newUpstreamPool(cfg BackendConfig, metrics *Metrics, log *logrus.Logger) (*upstreamPool, error) {
+	members := cfg.Pool
+	if len(members) == 0 {
+		if cfg.Address == "" {
+			return nil, fmt.Errorf("no backend endpoint provided")
+		}
+		members = []PoolMemberConfig{{Address: cfg.Address}}
+	}
+
+	pool := &upstreamPool{
+		strategy: cfg.Strategy,
+		health:   cfg.HealthCheck,
+		outlier:  cfg.Outlier,
+		metrics:  metrics,
+		log:      log,
+		client:   &http.Client{Timeout: cfg.HealthCheck.Timeout},
+	}
+
+	for _, m := range members {
+		u, err := url.Parse(m.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse backend URL: %s", err)
+		}
+
+		weight := m.Weight
+		if weight < 1 {
+			weight = 1
+		}
+
+		pool.members = append(pool.members, &upstream{name: u.Host, url: u, weight: weight, healthy: true})
+		metrics.upstreamAvailable.WithLabelValues(u.Host).Set(1)
+	}
+
+	return pool, nil
+}
+
+//useTransport sends health checks over the upstream transport, so they share its dial
+//and TLS settings without retries or breakers
+func (p *upstreamPool) useTransport(transport http.RoundTripper) {
+	p.client = &http.Client{Transport: transport, Timeout: p.health.Timeout}
+}
+
+//useBreakers trips a circuit breaker per upstream, so a failing upstream doesn't
+//fast-fail requests to the healthy ones
+func (p *upstreamPool) useBreakers(opts breakerOpts) {
+	for _, u := range p.members {
+		u.breaker = newCircuitBreaker(u.name, opts, p.metrics)
+	}
+}
+
+//circuitState summarises the upstream breakers as the state of the most available,
+//closed if breakers are disabled
+func (p *upstreamPool) circuitState() breakerState {
+	state := breakerOpen
+	for _, u := range p.members {
+		if u.breaker == nil {
+			return breakerClosed
+		}
+		if s := u.breaker.State(); s < state {
+			state = s
+		}
+	}
+	return state
+}
+
+//primary the first configured upstream
+func (p *upstreamPool) primary() *upstream {
+	return p.members[0]
+}
+
+//pick selects an upstream using the strategy, preferring available upstreams which
+//haven't been tried. Falls back to every upstream if none are available so requests
+//are still attempted
+func (p *upstreamPool) pick(tried *triedUpstreams) *upstream {
+	now := time.Now()
+
+	candidates := make([]*upstream, 0, len(p.members))
+	for _, u := range p.members {
+		if u.available(now) && !tried.has(u) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, u := range p.members {
+			if !tried.has(u) {
+				candidates = append(candidates, u)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.members
+	}
+
+	switch p.strategy {
+	case strategyLeastConn:
+		return p.leastConn(candidates)
+	case strategyWeighted:
+		return p.weighted(candidates)
+	default:
+		return candidates[int(atomic.AddUint64(&p.next, 1)-1)%len(candidates)]
+	}
+}
+
+//leastConn picks the upstream with the fewest in-flight requests, rotating between ties
+func (p *upstreamPool) leastConn(candidates []*upstream) *upstream {
+	offset := int(atomic.AddUint64(&p.next, 1) - 1)
+
+	var best *upstream
+	for i := range candidates {
+		u := candidates[(offset+i)%len(candidates)]
+		if best == nil || atomic.LoadInt64(&u.active) < atomic.LoadInt64(&best.active) {
+			best = u
+		}
+	}
+	return best
+}
+
+//weighted picks using smooth weighted round robin, spreading requests in proportion to
+//the upstream weights without sending bursts to the heaviest
+func (p *upstreamPool) weighted(candidates []*upstream) *upstream {
+	p.wrrMu.Lock()
+	defer p.wrrMu.Unlock()
+
+	var (
+		best  *upstream
+		total int
+	)
+	for _, u := range candidates {
+		u.current += u.weight
+		total += u.weight
+		if best == nil || u.current > best.current {
+			best = u
+		}
+	}
+	best.current -= total
+
+	return best
+}
+
+//observe records the outcome of a request for passive outlier ejection. Errors and
+//server errors count as failures
+func (p *upstreamPool) observe(u *upstream, resp *http.Response, err error) {
+	failed := err != nil || resp.StatusCode >= 500
+
+	result := "success"
+	if failed {
+		result = "failure"
+	}
+	p.metrics.upstreamPoolRequests.WithLabelValues(u.name, result).Inc()
+
+	if p.outlier.ConsecutiveFailures <= 0 || len(p.members) < 2 {
+		return
+	}
+
+	u.mu.Lock()
+	if !failed {
+		u.consecutive = 0
+		u.mu.Unlock()
+		return
+	}
+
+	u.consecutive++
+	eject := u.consecutive >= p.outlier.ConsecutiveFailures
+	u.mu.Unlock()
+
+	if eject && p.canEject() {
+		u.mu.Lock()
+		u.consecutive = 0
+		u.ejectedUntil = time.Now().Add(p.outlier.EjectionDuration)
+		u.mu.Unlock()
+
+		p.metrics.upstreamEjections.WithLabelValues(u.name).Inc()
+		p.log.WithField("upstream", u.name).Warnf("Ejecting upstream for %s after consecutive failures", p.outlier.EjectionDuration)
+	}
+}
+
+//canEject checks another upstream can be ejected without exceeding the max ejection percent
+func (p *upstreamPool) canEject() bool {
+	now := time.Now()
+
+	ejected := 1
+	for _, u := range p.members {
+		u.mu.Lock()
+		if now.Before(u.ejectedUntil) {
+			ejected++
+		}
+		u.mu.Unlock()
+	}
+
+	return ejected*100 <= p.outlier.MaxEjectionPercent*len(p.members)
+}
+
+//healthCheckLoop actively checks each upstream on the interval until the context is done
+func (p *upstreamPool) healthCheckLoop(ctx context.Context) {
+	if p.health.Interval <= 0 || len(p.members) < 2 {
+		return
+	}
+
+	t := time.NewTicker(p.health.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			p.checkHealth(ctx)
+		}
+	}
+}
+
+//checkHealth probes every upstream, marking them unhealthy or healthy again once the
+//thresholds of consecutive results are reached
+func (p *upstreamPool) checkHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, u := range p.members {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+
+			probeCtx, cancel := context.WithTimeout(ctx, p.health.Timeout)
+			defer cancel()
+
+			p.recordHealth(u, p.pingUpstream(probeCtx, u, p.health.Path))
+		}(u)
+	}
+	wg.Wait()
+}
+
+func (p *upstreamPool) recordHealth(u *upstream, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err != nil {
+		u.successes = 0
+		u.failures++
+		if u.healthy && u.failures >= p.health.UnhealthyThreshold {
+			u.healthy = false
+			p.metrics.upstreamAvailable.WithLabelValues(u.name).Set(0)
+			p.log.WithError(err).WithField("upstream", u.name).Warn("Upstream failed health checks")
+		}
+		return
+	}
+
+	u.failures = 0
+	u.successes++
+	if !u.healthy && u.successes >= p.health.HealthyThreshold {
+		u.healthy = true
+		p.metrics.upstreamAvailable.WithLabelValues(u.name).Set(1)
+		p.log.WithField("upstream", u.name).Info("Upstream passed health checks")
+	}
+}
+
+//ping checks any upstream is responding without server errors
+func (p *upstreamPool) ping(ctx context.Context, path string) error {
+	errs := make(chan error, len(p.members))
+	for _, u := range p.members {
+		go func(u *upstream) {
+			errs <- p.pingUpstream(ctx, u, path)
+		}(u)
+	}
+
+	var failures []string
+	for range p.members {
+		err := <-errs
+		if err == nil {
+			return nil
+		}
+		failures = append(failures, err.Error())
+	}
+
+	return errors.New(strings.Join(failures, ", "))
+}
+
+//pingUpstream requests the path from the upstream, failing on server errors
+func (p *upstreamPool) pingUpstream(ctx context.Context, u *upstream, path string) error {
+	target := *u.url
+	target.Path = path
+
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s responded with %d", u.name, resp.StatusCode)
+	}
+
+	return nil
+}
+
+//triedUpstreams the upstreams attempted for a request, so retries fail over
+type triedUpstreams struct {
+	upstreams []*upstream
+}
+
+func (t *triedUpstreams) has(u *upstream) bool {
+	if t == nil {
+		return false
+	}
+	for _, tried := range t.upstreams {
+		if tried == u {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *triedUpstreams) add(u *upstream) {
+	if t != nil {
+		t.upstreams = append(t.upstreams, u)
+	}
+}
+
+//poolTransport sends each attempt to an upstream picked from the pool, through the
+//upstreams circuit breaker
+type poolTransport struct {
+	next http.RoundTripper
+	pool *upstreamPool
+}
+
+//RoundTrip rewrites the request to the picked upstream, recording the outcome
+func (pt *poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tried, _ := triedUpstreamsFromContext(req.Context())
+	u, err := pt.pickAllowed(tried)
+	if err != nil {
+		return nil, err
+	}
+	tried.add(u)
+	setUpstream(req.Context(), u.name)
+
+	out := req.Clone(req.Context())
+	out.URL.Scheme = u.url.Scheme
+	out.URL.Host = u.url.Host
+	out.URL.Path = singleJoiningSlash(u.url.Path, req.URL.Path)
+	if req.URL.RawPath != "" {
+		out.URL.RawPath = singleJoiningSlash(u.url.EscapedPath(), req.URL.RawPath)
+	}
+
+	atomic.AddInt64(&u.active, 1)
+	resp, err := pt.next.RoundTrip(out)
+	atomic.AddInt64(&u.active, -1)
+
+	if u.breaker != nil {
+		u.breaker.record(breakerOutcomeOf(req, resp, err))
+	}
+
+	//Requests cancelled by the client aren't held against the upstream
+	if req.Context().Err() == nil {
+		pt.pool.observe(u, resp, err)
+	}
+
+	return resp, err
+}
+
+//pickAllowed picks an upstream whose breaker allows the request, failing over from
+//upstreams which reject it such as half-open upstreams with every probe in flight
+func (pt *poolTransport) pickAllowed(tried *triedUpstreams) (*upstream, error) {
+	exclude := &triedUpstreams{}
+	if tried != nil {
+		exclude.upstreams = append(exclude.upstreams, tried.upstreams...)
+	}
+
+	for {
+		u := pt.pool.pick(exclude)
+		if u.breaker == nil || u.breaker.allow() {
+			return u, nil
+		}
+		pt.pool.metrics.upstreamCircuitRejected.WithLabelValues(u.name).Inc()
+
+		//Every upstream has been tried or rejected the request
+		if exclude.has(u) {
+			return nil, errCircuitOpen
+		}
+		exclude.add(u)
+	}
+}
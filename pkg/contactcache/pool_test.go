@@ -0,0 +1,293 @@
+package contactcache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+//newTestPool creates a pool of the addresses with the default health check and
+//outlier settings
+func newTestPool(t *testing.T, strategy string, members ...PoolMemberConfig) *upstreamPool {
+	cfg := DefaultConfig().Backend
+	cfg.Strategy = strategy
+	cfg.Pool = members
+
+	pool, err := newUpstreamPool(cfg, NewMetrics(), logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+//picks counts the upstreams picked over n requests
+func picks(pool *upstreamPool, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		counts[pool.pick(nil).name]++
+	}
+	return counts
+}
+
+func TestPoolStrategies(t *testing.T) {
+	members := []PoolMemberConfig{
+		{Address: "http://a.local", Weight: 3},
+		{Address: "http://b.local", Weight: 1},
+		{Address: "http://c.local"},
+	}
+
+	rr := newTestPool(t, strategyRoundRobin, members...)
+	assert.Equal(t, map[string]int{"a.local": 4, "b.local": 4, "c.local": 4}, picks(rr, 12))
+
+	weighted := newTestPool(t, strategyWeighted, members...)
+	assert.Equal(t, map[string]int{"a.local": 9, "b.local": 3, "c.local": 3}, picks(weighted, 15))
+
+	//Smooth weighting interleaves rather than sending bursts to the heaviest
+	var order string
+	for i := 0; i < 5; i++ {
+		order += weighted.pick(nil).name[:1]
+	}
+	assert.Equal(t, "abaca", order)
+
+	leastConn := newTestPool(t, strategyLeastConn, members...)
+	leastConn.members[0].active = 2
+	leastConn.members[2].active = 1
+	assert.Equal(t, map[string]int{"b.local": 3}, picks(leastConn, 3))
+}
+
+func TestPoolPickSkipsUnavailable(t *testing.T) {
+	pool := newTestPool(t, strategyRoundRobin,
+		PoolMemberConfig{Address: "http://a.local"},
+		PoolMemberConfig{Address: "http://b.local"},
+	)
+
+	pool.members[0].ejectedUntil = time.Now().Add(time.Minute)
+	assert.Equal(t, map[string]int{"b.local": 4}, picks(pool, 4))
+
+	//Tried upstreams are avoided when failing over
+	tried := &triedUpstreams{}
+	tried.add(pool.members[1])
+	assert.Equal(t, "a.local", pool.pick(tried).name)
+
+	//Requests are still attempted if no upstreams are available
+	pool.members[1].healthy = false
+	assert.Len(t, picks(pool, 4), 2)
+}
+
+func TestPoolFailover(t *testing.T) {
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"contacts": []}`)
+	})
+	defer close()
+
+	var badReqs int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&badReqs, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+
+	good := srv.pool.primary().url.String()
+
+	srv.cfg().Upstream.Retry.Backoff = time.Millisecond
+	srv.cfg().Upstream.Breaker.Enabled = false
+	srv.cfg().Backend.Pool = []PoolMemberConfig{{Address: bad.URL}, {Address: good}}
+	srv.cfg().Backend.Outlier.ConsecutiveFailures = 2
+
+	pool, err := newUpstreamPool(srv.cfg().Backend, srv.metrics, srv.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.pool = pool
+	srv.be = srv.newReverseProxy()
+
+	handler := srv.httpHandler()
+
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("GET", "https://anywhere.local/v1/other", nil)
+		req.Header.Add(apiKeyHeader, "1234")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Result().StatusCode)
+	}
+
+	//The failing upstream is ejected after consecutive failures
+	badName := pool.members[0].name
+	assert.Equal(t, int32(2), atomic.LoadInt32(&badReqs))
+	assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.upstreamEjections.WithLabelValues(badName)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(srv.metrics.upstreamPoolRequests.WithLabelValues(badName, "failure")))
+	assert.Equal(t, float64(4), testutil.ToFloat64(srv.metrics.upstreamPoolRequests.WithLabelValues(pool.members[1].name, "success")))
+}
+
+func TestPoolBreakerPerUpstream(t *testing.T) {
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"contacts": []}`)
+	})
+	defer close()
+
+	var badReqs int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&badReqs, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+
+	good := srv.pool.primary().url.String()
+
+	srv.cfg().Upstream.Retry.Backoff = time.Millisecond
+	srv.cfg().Upstream.Breaker.MinRequests = 2
+	srv.cfg().Backend.Pool = []PoolMemberConfig{{Address: bad.URL}, {Address: good}}
+	srv.cfg().Backend.Outlier.ConsecutiveFailures = 0
+
+	pool, err := newUpstreamPool(srv.cfg().Backend, srv.metrics, srv.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.pool = pool
+	srv.be = srv.newReverseProxy()
+
+	handler := srv.httpHandler()
+
+	for i := 0; i < 6; i++ {
+		req, _ := http.NewRequest("GET", "https://anywhere.local/v1/other", nil)
+		req.Header.Add(apiKeyHeader, "1234")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Result().StatusCode)
+	}
+
+	//Only the failing upstreams breaker opens, requests go to the healthy upstream
+	badName, goodName := pool.members[0].name, pool.members[1].name
+	assert.Equal(t, breakerOpen, pool.members[0].breaker.State())
+	assert.Equal(t, breakerClosed, pool.members[1].breaker.State())
+	assert.Equal(t, breakerClosed, pool.circuitState())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&badReqs))
+	assert.Equal(t, float64(breakerOpen), testutil.ToFloat64(srv.metrics.upstreamCircuitState.WithLabelValues(badName)))
+	assert.Equal(t, float64(breakerClosed), testutil.ToFloat64(srv.metrics.upstreamCircuitState.WithLabelValues(goodName)))
+}
+
+func TestPoolBreakerHalfOpenFailover(t *testing.T) {
+	var goodReqs int32
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&goodReqs, 1)
+		fmt.Fprintln(w, `{"contacts": []}`)
+	})
+	defer close()
+
+	var probeReqs int32
+	probing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probeReqs, 1)
+	}))
+	defer probing.Close()
+
+	srv.cfg().Upstream.Retry.Max = 0
+	srv.cfg().Backend.Pool = []PoolMemberConfig{{Address: probing.URL}, {Address: srv.pool.primary().url.String()}}
+
+	pool, err := newUpstreamPool(srv.cfg().Backend, srv.metrics, srv.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.pool = pool
+	srv.be = srv.newReverseProxy()
+
+	//Half-open with every probe already in flight
+	cb := pool.members[0].breaker
+	cb.mu.Lock()
+	cb.transition(breakerHalfOpen)
+	cb.probes = cb.opts.HalfOpenRequests
+	cb.mu.Unlock()
+
+	handler := srv.httpHandler()
+
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("GET", "https://anywhere.local/v1/other", nil)
+		req.Header.Add(apiKeyHeader, "1234")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Result().StatusCode)
+	}
+
+	//Requests fail over to the healthy upstream rather than fast failing
+	assert.Equal(t, int32(4), atomic.LoadInt32(&goodReqs))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&probeReqs))
+	assert.NotZero(t, testutil.ToFloat64(srv.metrics.upstreamCircuitRejected.WithLabelValues(pool.members[0].name)))
+}
+
+func TestPoolMaxEjectionPercent(t *testing.T) {
+	pool := newTestPool(t, strategyRoundRobin,
+		PoolMemberConfig{Address: "http://a.local"},
+		PoolMemberConfig{Address: "http://b.local"},
+	)
+	pool.outlier.ConsecutiveFailures = 1
+
+	failure := &http.Response{StatusCode: http.StatusBadGateway}
+	pool.observe(pool.members[0], failure, nil)
+	pool.observe(pool.members[1], failure, nil)
+
+	now := time.Now()
+	assert.False(t, pool.members[0].available(now))
+	assert.True(t, pool.members[1].available(now), "at most 50% of upstreams are ejected")
+}
+
+func TestPoolHealthChecks(t *testing.T) {
+	var healthy int32 = 1
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	pool := newTestPool(t, strategyRoundRobin,
+		PoolMemberConfig{Address: backend.URL},
+		PoolMemberConfig{Address: "http://b.local"},
+	)
+	u := pool.members[0]
+	ctx := context.Background()
+
+	atomic.StoreInt32(&healthy, 0)
+	pool.checkHealth(ctx)
+	assert.True(t, u.available(time.Now()), "unhealthy threshold not yet reached")
+	pool.checkHealth(ctx)
+	assert.False(t, u.available(time.Now()))
+	assert.Equal(t, float64(0), testutil.ToFloat64(pool.metrics.upstreamAvailable.WithLabelValues(u.name)))
+
+	atomic.StoreInt32(&healthy, 1)
+	pool.checkHealth(ctx)
+	assert.False(t, u.available(time.Now()), "healthy threshold not yet reached")
+	pool.checkHealth(ctx)
+	assert.True(t, u.available(time.Now()))
+	assert.Equal(t, float64(1), testutil.ToFloat64(pool.metrics.upstreamAvailable.WithLabelValues(u.name)))
+
+	//Readiness requires any upstream to respond
+	assert.NoError(t, pool.ping(ctx, "/"))
+}
+
+func TestPoolHealthCheckTimeout(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	pool := newTestPool(t, strategyRoundRobin, PoolMemberConfig{Address: backend.URL})
+	pool.health.Timeout = 20 * time.Millisecond
+	pool.useTransport(&http.Transport{})
+
+	//Checks are bounded by the health check timeout, not just the callers context
+	start := time.Now()
+	assert.Error(t, pool.pingUpstream(context.Background(), pool.members[0], "/"))
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,195 @@
+package contactcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//proxyHeaderTimeout time allowed for the load balancer to send the PROXY header
+	proxyHeaderTimeout = 10 * time.Second
+
+	//proxyV1MaxLen longest v1 header including the CRLF
+	proxyV1MaxLen = 107
+)
+
+//proxyV2Signature prefixes binary v2 headers
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//proxyListener requires each accepted connection to start with a PROXY protocol v1 or
+//v2 header, replacing the remote address with the source address from the header
+type proxyListener struct {
+	net.Listener
+	metrics *Metrics
+}
+
+//Accept wraps the connection, the header is read lazily from the connections own
+//goroutine so a slow peer can't block accepting other connections
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyConn{Conn: conn, br: bufio.NewReader(conn), metrics: l.metrics}, nil
+}
+
+//proxyConn a connection with a PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	br      *bufio.Reader
+	metrics *Metrics
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+//Read reads past the header, failing if the header is invalid
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.br.Read(b)
+}
+
+//RemoteAddr provides the source address from the header, or the peers address for
+//LOCAL and UNKNOWN headers, such as load balancer health checks
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remote, c.err = readProxyHeader(c.br)
+	if c.err != nil {
+		c.err = fmt.Errorf("invalid PROXY protocol header: %s", c.err)
+		if c.metrics != nil {
+			c.metrics.proxyProtocolErrors.Inc()
+		}
+		c.Conn.Close()
+	}
+}
+
+//readProxyHeader reads a v1 or v2 header, providing the source address if the
+//connection was proxied
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(br)
+	}
+
+	prefix, err := br.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	if string(prefix) != "PROXY " {
+		return nil, fmt.Errorf("missing header")
+	}
+
+	return readProxyV1(br)
+}
+
+//readProxyV1 parses the text header, e.g. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, fmt.Errorf("v1 header too long")
+		}
+
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 source address")
+	}
+
+	switch {
+	case fields[1] == "TCP4" && ip.To4() != nil:
+	case fields[1] == "TCP6" && ip.To4() == nil:
+	default:
+		return nil, fmt.Errorf("unsupported v1 protocol %q", fields[1])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+//readProxyV2 parses the binary header, skipping any TLVs
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	switch hdr[12] & 0xf {
+	case 0x0:
+		//LOCAL, sent by the proxy itself
+		return nil, nil
+	case 0x1:
+		//PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", hdr[12]&0xf)
+	}
+
+	var ipLen int
+	switch hdr[13] >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		//Unix sockets and unspecified families have no usable source address
+		return nil, nil
+	}
+
+	if len(body) < ipLen*2+4 {
+		return nil, fmt.Errorf("v2 address block too short")
+	}
+
+	ip := make(net.IP, ipLen)
+	copy(ip, body[:ipLen])
+	port := binary.BigEndian.Uint16(body[ipLen*2:])
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,122 @@
+package contactcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+//proxyV2Header builds a binary PROXY header for a TCP4 connection from src
+func proxyV2Header(command byte, src string, srcPort uint16) []byte {
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x20|command, 0x11, 0, 12)
+
+	addrs := make([]byte, 12)
+	copy(addrs[0:4], net.ParseIP(src).To4())
+	copy(addrs[4:8], net.ParseIP("192.0.2.1").To4())
+	binary.BigEndian.PutUint16(addrs[8:], srcPort)
+	binary.BigEndian.PutUint16(addrs[10:], 443)
+
+	return append(hdr, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		addr   string
+		err    bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n", "203.0.113.7:56324", false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 mismatched family", "PROXY TCP6 203.0.113.7 192.0.2.1 56324 443\r\n", "", true},
+		{"v1 malformed", "PROXY TCP4 203.0.113.7\r\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+		{"v2 proxy", string(proxyV2Header(0x1, "203.0.113.7", 56324)), "203.0.113.7:56324", false},
+		{"v2 local", string(proxyV2Header(0x0, "203.0.113.7", 56324)), "", false},
+		{"missing", "GET / HTTP/1.1\r\n", "", true},
+	}
+
+	for _, test := range tests {
+		br := bufio.NewReader(strings.NewReader(test.header + "GET / HTTP/1.1\r\n"))
+
+		addr, err := readProxyHeader(br)
+		if test.err {
+			assert.Error(t, err, test.name)
+			continue
+		}
+
+		if assert.NoError(t, err, test.name) {
+			if test.addr == "" {
+				assert.Nil(t, addr, test.name)
+			} else if assert.NotNil(t, addr, test.name) {
+				assert.Equal(t, test.addr, addr.String(), test.name)
+			}
+
+			//The request following the header is untouched
+			rest, _ := ioutil.ReadAll(br)
+			assert.Equal(t, "GET / HTTP/1.1\r\n", string(rest), test.name)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	srv := &Server{metrics: NewMetrics()}
+	srv.applyConfig(DefaultConfig())
+	srv.cfg().Listeners = []ListenerConfig{{Address: "127.0.0.1:0", Protocol: "http", ProxyProtocol: true}}
+
+	handler := srv.resolveClientIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, _ := clientAddrFromContext(r.Context())
+		fmt.Fprintf(w, "%s %s", addr.ip, addr.source)
+	}))
+
+	listeners, err := srv.openListeners(handler, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listeners[0].srv.Close()
+	go listeners[0].serve()
+
+	request := func(header string) (string, error) {
+		conn, err := net.Dial("tcp", listeners[0].ln.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", header)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	body, err := request("PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "203.0.113.7 proxy_protocol", body)
+	}
+
+	body, err = request(string(proxyV2Header(0x1, "198.51.100.1", 56324)))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "198.51.100.1 proxy_protocol", body)
+	}
+
+	//Connections without a header are closed
+	_, err = request("")
+	assert.Error(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.proxyProtocolErrors))
+}
@@ -0,0 +1,190 @@
+package contactcache
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+//budget separates rate limits by how the request was served
+type budget string
+
+const (
+	budgetCache   budget = "cache"
+	budgetBackend budget = "backend"
+	budgetClient  budget = "client"
+)
+
+//rateLimit token bucket parameters
+type rateLimit struct {
+	//Rate tokens refilled per second
+	Rate float64
+	//Burst maximum tokens held by the bucket
+	Burst int
+}
+
+//RateLimiter consumes tokens from a named bucket
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit rateLimit) (bool, time.Duration, error)
+}
+
+//tokenBucketScript refills and consumes a token bucket atomically so all replicas share the same state
+var tokenBucketScript = redis.NewScript(`
+local key = KEYS[1]
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local ttl = ARGV[4]
+
+local state = redis.call("HMGET", key, "tokens", "ts")
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+
+tokens = math.min(burst, tokens + (math.max(0, now - ts) * rate / 1000))
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	allowed = 1
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+
+redis.call("HMSET", key, "tokens", tostring(tokens), "ts", ARGV[3])
+redis.call("PEXPIRE", key, ttl)
+
+return {allowed, wait}
+`)
+
+//NewRedisRateLimiter provides a redis backed token bucket limiter
+func NewRedisRateLimiter(rdb *redis.Client) RateLimiter {
+	return &RedisRateLimiter{rdb: rdb}
+}
+
+//RedisRateLimiter token bucket limiter shared across replicas
+type RedisRateLimiter struct {
+	rdb *redis.Client
+}
+
+//Allow consumes a single token from the bucket, returning how long to wait if none are available
+func (rl *RedisRateLimiter) Allow(ctx context.Context, key string, limit rateLimit) (bool, time.Duration, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	//Expire buckets once they would have fully refilled
+	ttl := int64(float64(limit.Burst)*1000/limit.Rate) + 1000
+
+	res, err := tokenBucketScript.Run(ctx, rl.rdb, []string{key}, limit.Rate, limit.Burst, now, ttl).Result()
+	if err != nil {
+		return false, 0, err
+	}
+
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 2 {
+		return false, 0, fmt.Errorf("unexpected rate limit response: %v", res)
+	}
+
+	allowed, _ := vals[0].(int64)
+	wait, _ := vals[1].(int64)
+
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+//rateLimit applies the per client IP limit, then attaches the tenants limits to the
+//request so handlers can consume from the cache or backend budget once the cache
+//decision has been made
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg().RateLimit
+		if s.limiter == nil || !cfg.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if ip := clientIP(r); ip != "" && cfg.Client.Rate > 0 {
+			limit := rateLimit{Rate: cfg.Client.Rate, Burst: cfg.Client.Burst}
+			if !s.consume(w, r, "ratelimit:client:"+ip, budgetClient, limit) {
+				return
+			}
+		}
+
+		tenant := tenantHash(r.Header.Get(apiKeyHeader))
+
+		next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), tenant)))
+	})
+}
+
+//allow checks the requests budget, responding with a 429 if the tenant has exhausted it
+func (s *Server) allow(w http.ResponseWriter, r *http.Request, b budget) bool {
+	tenant, ok := tenantFromContext(r.Context())
+	if !ok {
+		return true
+	}
+
+	return s.consume(w, r, fmt.Sprintf("%s:ratelimit:%s", tenant, b), b, s.cfg().limit(tenant, b))
+}
+
+//spend checks the requests budget for backend requests made in the background, without
+//responding if the tenant has exhausted it
+func (s *Server) spend(ctx context.Context, b budget) bool {
+	tenant, ok := tenantFromContext(ctx)
+	if !ok {
+		return true
+	}
+
+	ok, _ = s.take(ctx, fmt.Sprintf("%s:ratelimit:%s", tenant, b), b, s.cfg().limit(tenant, b))
+	return ok
+}
+
+//consume takes a token from the bucket, responding with a 429 if none are available
+func (s *Server) consume(w http.ResponseWriter, r *http.Request, key string, b budget, limit rateLimit) bool {
+	ok, wait := s.take(r.Context(), key, b, limit)
+	if ok {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.Header().Add("content-type", "application/json")
+	httpJSONError(w, "Rate limit exceeded.", http.StatusTooManyRequests)
+
+	return false
+}
+
+//take takes a token from the bucket, providing the wait until one is available if not
+func (s *Server) take(ctx context.Context, key string, b budget, limit rateLimit) (bool, time.Duration) {
+	//Limits are kept in the cache so fail open while it's unavailable
+	if s.cacheHealth != nil && !s.cacheHealth.Available() {
+		return true, 0
+	}
+
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+
+	ok, wait, err := s.limiter.Allow(ctx, key, limit)
+	if err != nil {
+		//Fail open so a limiter outage doesn't take down the proxy
+		s.reqLog(ctx).WithError(err).Error("failed to check rate limit")
+		return true, 0
+	}
+
+	if ok {
+		s.metrics.rateLimitRequests.WithLabelValues(string(b), "allowed").Add(1)
+		return true, 0
+	}
+
+	s.metrics.rateLimitRequests.WithLabelValues(string(b), "rejected").Add(1)
+	return false, wait
+}
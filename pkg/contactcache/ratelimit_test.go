@@ -0,0 +1,143 @@
+package contactcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitBackendBudget(t *testing.T) {
+	srv, beReqCount, close, _ := setupTestServer(t, `{"contacts": []}`)
+	defer close()
+
+	srv.cfg().RateLimit.Enabled = true
+	srv.cfg().RateLimit.Backend = LimitConfig{Rate: 0.001, Burst: 1}
+
+	handler := srv.httpHandler()
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/other", nil)
+	req.Header.Add(apiKeyHeader, "1234")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	//Budget exhausted
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Result().StatusCode)
+	assert.NotEmpty(t, w.Result().Header.Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "Too Many Requests")
+	assert.Equal(t, 1, *beReqCount)
+
+	//Other tenants are unaffected
+	req.Header.Set(apiKeyHeader, "4321")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+}
+
+func TestRateLimitSeparateCacheBudget(t *testing.T) {
+	srv, beReqCount, close, s := setupTestServer(t, `{"contacts": []}`)
+	defer close()
+
+	apiKey := "1234"
+
+	srv.cfg().RateLimit.Enabled = true
+	srv.cfg().RateLimit.Backend = LimitConfig{Rate: 0.001, Burst: 1}
+	srv.cfg().RateLimit.Tenants = map[string]TenantLimitConfig{
+		tenantHash(apiKey): {Cache: &LimitConfig{Rate: 0.001, Burst: 2}},
+	}
+
+	s.Set(srv.prefixKey(apiKey, "lists:"), `{"contacts": []}`)
+
+	handler := srv.httpHandler()
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contacts", nil)
+	req.Header.Add(apiKeyHeader, apiKey)
+
+	//Cache hits consume the cache budget only
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Result().StatusCode)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Result().StatusCode)
+
+	//Backend budget remains
+	req, _ = http.NewRequest("GET", "https://anywhere.local/v1/other", nil)
+	req.Header.Add(apiKeyHeader, apiKey)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, 1, *beReqCount)
+}
+
+func TestRateLimitClientIP(t *testing.T) {
+	srv, _, close, _ := setupTestServer(t, `{"contacts": []}`)
+	defer close()
+
+	srv.cfg().RateLimit.Enabled = true
+	srv.cfg().RateLimit.Client = LimitConfig{Rate: 0.001, Burst: 1}
+	srv.cfg().ClientIP.TrustedProxies = []string{"10.0.0.0/8"}
+
+	handler := srv.httpHandler()
+
+	get := func(apiKey, xff string) int {
+		req, _ := http.NewRequest("GET", "https://anywhere.local/v1/other", nil)
+		req.RemoteAddr = "10.0.0.1:41234"
+		req.Header.Add(apiKeyHeader, apiKey)
+		req.Header.Add("X-Forwarded-For", xff)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	assert.Equal(t, 200, get("1234", "203.0.113.7"))
+
+	//Limited per client regardless of tenant
+	assert.Equal(t, http.StatusTooManyRequests, get("4321", "203.0.113.7"))
+
+	//Other clients behind the same proxy are unaffected
+	assert.Equal(t, 200, get("1234", "203.0.113.8"))
+}
+
+func TestRateLimitUpsertKeepsCache(t *testing.T) {
+	srv, beReqCount, close, s := setupTestServer(t, `{"contact_id": "person_1", "Email": "chris@autopilothq.com"}`)
+	defer close()
+
+	apiKey := "1234"
+
+	srv.cfg().RateLimit.Enabled = true
+	srv.cfg().RateLimit.Backend = LimitConfig{Rate: 0.001, Burst: 1}
+
+	handler := srv.httpHandler()
+
+	upsert := func() int {
+		req, _ := http.NewRequest("POST", "https://anywhere.local/v1/contact", nil)
+		req.Header.Add(apiKeyHeader, apiKey)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	assert.Equal(t, 200, upsert())
+
+	//Upserts refused by the backend budget don't invalidate
+	listKey := srv.prefixKey(apiKey, "lists:")
+	s.Set(listKey, `{"contacts": []}`)
+
+	assert.Equal(t, http.StatusTooManyRequests, upsert())
+	assert.True(t, s.Exists(listKey))
+	assert.True(t, s.Exists(srv.prefixKey(apiKey, "chris@autopilothq.com")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.cacheRequests.WithLabelValues("invalidate", "contact")))
+	assert.Equal(t, 1, *beReqCount)
+}
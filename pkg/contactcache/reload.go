@@ -0,0 +1,167 @@
+package contactcache
+
+import (
+	"path/filepath"
+	"reflect"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+//WatchConfig reloads the config when the config file changes. The file is watched here
+//rather than by viper so it's only ever read while holding the reload lock
+func (s *Server) WatchConfig() {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		s.log.WithError(err).Error("failed to watch config file")
+		return
+	}
+
+	//Watch the directory to pick up atomic saves and symlink swaps such as kubernetes ConfigMaps
+	file = filepath.Clean(file)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		s.log.WithError(err).Error("failed to watch config file")
+		watcher.Close()
+		return
+	}
+
+	go s.watchConfig(watcher, file)
+}
+
+//watchConfig reloads the config on writes to the file or when its symlink target changes
+func (s *Server) watchConfig(watcher *fsnotify.Watcher, file string) {
+	defer watcher.Close()
+
+	target, _ := filepath.EvalSymlinks(file)
+	for {
+		select {
+		case e, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			current, _ := filepath.EvalSymlinks(file)
+			written := filepath.Clean(e.Name) == file && e.Op&(fsnotify.Write|fsnotify.Create) != 0
+			if !written && (current == "" || current == target) {
+				continue
+			}
+			target = current
+
+			s.log.WithField("file", e.Name).Info("config file changed")
+			s.ReloadConfig()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			s.log.WithError(err).Warn("config file watch failed")
+		}
+	}
+}
+
+//ReloadConfig re-reads the config file and applies the reloadable settings, along
+//with reloading the TLS certificates
+func (s *Server) ReloadConfig() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if viper.ConfigFileUsed() != "" {
+		if err := viper.ReadInConfig(); err != nil {
+			s.log.WithError(err).Error("failed to read config")
+			s.metrics.recordReload("config", false)
+			return err
+		}
+	}
+
+	return s.reload()
+}
+
+//reload validates the current viper config, only swapping it in if valid. The reload
+//lock must be held
+func (s *Server) reload() error {
+	cfg, err := LoadConfig()
+	if err != nil {
+		s.log.WithError(err).Error("config reload failed, keeping current config")
+		s.metrics.recordReload("config", false)
+		return err
+	}
+
+	if restart := s.applyConfig(cfg); len(restart) > 0 {
+		s.log.WithField("settings", restart).Warn("changed settings require a restart to take effect")
+	}
+	s.metrics.recordReload("config", true)
+	s.log.Info("config reloaded")
+
+	var certErr error
+	for _, certs := range s.certs {
+		if err := certs.reload(); err != nil {
+			s.log.WithError(err).Error("TLS certificate reload failed, keeping current certificate")
+			certErr = err
+		}
+	}
+
+	return certErr
+}
+
+//applyConfig atomically swaps in the config. Settings only read on start are kept
+//from the current config, returning the names of those which changed
+func (s *Server) applyConfig(cfg *Config) []string {
+	next := *cfg
+
+	var restart []string
+	if cur, ok := s.config.Load().(*Config); ok {
+		keep := func(name string, next interface{}, cur interface{}) {
+			v := reflect.ValueOf(next).Elem()
+			if !reflect.DeepEqual(v.Interface(), cur) {
+				restart = append(restart, name)
+				v.Set(reflect.ValueOf(cur))
+			}
+		}
+
+		//TTLs and verification sampling are reloadable, the connection is not
+		cache := cur.Cache
+		cache.TTL, cache.StaleTTL, cache.NegativeTTL = next.Cache.TTL, next.Cache.StaleTTL, next.Cache.NegativeTTL
+		cache.Verify = next.Cache.Verify
+
+		//Client certificate bindings are reloadable, the certificates and CA are not
+		tlsCfg := cur.TLS
+		tlsCfg.Client.Bindings = next.TLS.Client.Bindings
+
+		//Heartbeats and the stream limit are reloadable, the channel and replay buffer are not
+		sse := cur.SSE
+		sse.Heartbeat, sse.MaxStreams = next.SSE.Heartbeat, next.SSE.MaxStreams
+
+		keep("address", &next.Address, cur.Address)
+		keep("listeners", &next.Listeners, cur.Listeners)
+		keep("tls", &next.TLS, tlsCfg)
+		keep("backend", &next.Backend, cur.Backend)
+		keep("webhooks.path", &next.Webhooks.Path, cur.Webhooks.Path)
+		keep("outbox", &next.Outbox, cur.Outbox)
+		keep("events", &next.Events, cur.Events)
+		keep("sse", &next.SSE, sse)
+		keep("metrics", &next.Metrics, cur.Metrics)
+		keep("admin", &next.Admin, cur.Admin)
+		keep("cache", &next.Cache, cache)
+		keep("upstream.timeout", &next.Upstream.Timeout, cur.Upstream.Timeout)
+		keep("upstream.retry", &next.Upstream.Retry, cur.Upstream.Retry)
+		keep("upstream.breaker", &next.Upstream.Breaker, cur.Upstream.Breaker)
+		keep("stats", &next.Stats, cur.Stats)
+		keep("tracing", &next.Tracing, cur.Tracing)
+	}
+
+	if s.log != nil {
+		if level, err := logrus.ParseLevel(next.Log.Level); err == nil {
+			s.log.SetLevel(level)
+		}
+		s.log.SetFormatter(newFormatter(next.Log.Format))
+	}
+
+	s.config.Store(&next)
+
+	return restart
+}
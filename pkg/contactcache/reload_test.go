@@ -0,0 +1,155 @@
+package contactcache
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyConfigKeepsRestartSettings(t *testing.T) {
+	srv := &Server{log: logrus.New(), metrics: NewMetrics()}
+
+	cfg := DefaultConfig()
+	cfg.Backend.Address = "https://api2.autopilothq.com"
+	srv.applyConfig(cfg)
+
+	next := *cfg
+	next.Log.Level = "debug"
+	next.Cache.TTL = 10 * time.Minute
+	next.Cache.Address = "10.0.0.1:6379"
+	next.RateLimit.Enabled = true
+	next.Backend.Address = "https://other.autopilothq.com"
+
+	restart := srv.applyConfig(&next)
+	assert.ElementsMatch(t, []string{"backend", "cache"}, restart)
+
+	assert.Equal(t, 10*time.Minute, srv.cfg().Cache.TTL)
+	assert.True(t, srv.cfg().RateLimit.Enabled)
+	assert.Equal(t, logrus.DebugLevel, srv.log.Level)
+
+	assert.Equal(t, "127.0.0.1:6379", srv.cfg().Cache.Address)
+	assert.Equal(t, "https://api2.autopilothq.com", srv.cfg().Backend.Address)
+}
+
+func TestReloadKeepsConfigOnFailure(t *testing.T) {
+	defer viper.Reset()
+
+	srv := &Server{log: logrus.New(), metrics: NewMetrics()}
+
+	cert, key := testKeyPair(t)
+	viper.Set("tls.cert", cert)
+	viper.Set("tls.key", key)
+	viper.Set("backend.address", "https://api2.autopilothq.com")
+	viper.Set("ratelimit.enabled", true)
+	assert.NoError(t, srv.ReloadConfig())
+	assert.True(t, srv.cfg().RateLimit.Enabled)
+
+	viper.Set("ratelimit.enabled", false)
+	viper.Set("upstream.breaker.error_rate", 2)
+	assert.Error(t, srv.ReloadConfig())
+	assert.True(t, srv.cfg().RateLimit.Enabled)
+}
+
+//writeTestCert writes a self-signed certificate and key for the common name
+func writeTestCert(t *testing.T, certFile, keyFile, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func certCN(t *testing.T, cr *certReloader) string {
+	cert, err := cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	writeTestCert(t, certFile, keyFile, "first")
+
+	cr, err := newCertReloader(certFile, keyFile, "", 0, NewMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "first", certCN(t, cr))
+
+	//Explicit reload
+	writeTestCert(t, certFile, keyFile, "second")
+	assert.NoError(t, cr.reload())
+	assert.Equal(t, "second", certCN(t, cr))
+
+	//Failed reloads keep the current certificate
+	ioutil.WriteFile(keyFile, []byte("invalid"), 0600)
+	assert.Error(t, cr.reload())
+	assert.Equal(t, "second", certCN(t, cr))
+}
+
+func TestCertReloaderPicksUpRotation(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	writeTestCert(t, certFile, keyFile, "first")
+
+	cr, err := newCertReloader(certFile, keyFile, "", time.Nanosecond, NewMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "first", certCN(t, cr))
+
+	//Ensure the rotated files are seen as newer
+	cr.mu.Lock()
+	cr.modTime = cr.modTime.Add(-time.Minute)
+	cr.mu.Unlock()
+
+	writeTestCert(t, certFile, keyFile, "rotated")
+	assert.Equal(t, "rotated", certCN(t, cr))
+}
@@ -1,80 +1,333 @@
 package contactcache
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/gorilla/handlers"
+	"github.com/go-redis/redis/v8"
 	"github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //NewServer creates a new instance of the middleware
-func NewServer() (*Server, error) {
-	defaultConfig()
-
+func NewServer(cfg *Config) (*Server, error) {
 	srv := &Server{
-		log: logrus.New(),
+		log:     logrus.New(),
+		metrics: NewMetrics(),
 	}
+	srv.applyConfig(cfg)
 
 	//New up a redis endpoint
-	cache, err := NewRedisCache()
+	rdb, err := newRedisClient(cfg.Cache)
+	if err != nil {
+		return nil, err
+	}
+	srv.cacheHealth = NewHealthCheckedCache(&RedisCache{rdb: rdb}, cacheHealthOpts(cfg.Cache), srv.log, srv.metrics)
+	srv.rdb = rdb
+	srv.cache = &tracedCache{next: srv.cacheHealth, tracer: srv.tracer}
+	srv.limiter = NewRedisRateLimiter(rdb)
+
+	//Tracing
+	tp, err := newTracerProvider(cfg.Tracing)
 	if err != nil {
 		return nil, err
 	}
-	srv.cache = cache
+	if tp != nil {
+		srv.tp = tp
+	}
 
-	//Parse backend
-	backendAddress := viper.GetString("backend.address")
-	if backendAddress == "" {
-		return nil, fmt.Errorf("no backend endpoint provided")
+	//Backend pool and reverse proxy
+	pool, err := newUpstreamPool(cfg.Backend, srv.metrics, srv.log)
+	if err != nil {
+		return nil, err
 	}
+	srv.pool = pool
+	srv.be = srv.newReverseProxy()
 
-	backend, err := url.Parse(backendAddress)
+	//Failed invalidations recovered from the WAL are retried once started
+	srv.outbox, err = newOutbox(cfg.Outbox, srv.metrics, srv.log)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse backend URL: %s", err)
+		return nil, err
 	}
 
-	//Set backend reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(backend)
-	srv.be = proxy
-	proxy.ModifyResponse = srv.handleProxyResponse
+	//Change events are delivered through the outbox
+	srv.sink = newChangeSink(cfg.Events, rdb)
+	srv.notices = newNoticeHub(cfg.SSE.Replay)
 
 	return srv, nil
 }
 
 //Server primary content server
 type Server struct {
-	log   *logrus.Logger
-	be    *httputil.ReverseProxy
-	cache Cacher
+	//config the current *Config, swapped on reload
+	config atomic.Value
+	//reloadMu serializes reading the config file and reloading, guarding certs
+	reloadMu sync.Mutex
+	certs    []*certReloader
+
+	log     *logrus.Logger
+	metrics *Metrics
+	be      *httputil.ReverseProxy
+	rdb     *redis.Client
+	cache   Cacher
+	limiter RateLimiter
+	tp      trace.TracerProvider
+
+	cacheHealth *HealthCheckedCache
+
+	pool *upstreamPool
+
+	outbox *outbox
+	sink   ChangeSink
+
+	notices *noticeHub
+
+	upstreamLimits upstreamLimits
+	health         healthProbes
+	tenantCounters tenantCounters
+
+	//shadowInFlight mirrored requests awaiting comparison
+	shadowInFlight int32
+
+	//verifyInFlight sampled cache hits being compared with the backend
+	verifyInFlight int32
+
+	//noticesSubscribed set while subscribed to the notices of other replicas
+	noticesSubscribed int32
+
+	//shuttingDown set once graceful shutdown has started
+	shuttingDown int32
+
+	//tasks tracks background work such as shadowing and verification
+	tasks sync.WaitGroup
 }
 
-//Start starts serving https requests
-func (s *Server) Start() error {
-	tlsConfig, err := s.tlsConfig()
+//cfg provides the servers current config, falling back to the defaults if none was provided
+func (s *Server) cfg() *Config {
+	cfg, ok := s.config.Load().(*Config)
+	if !ok {
+		return DefaultConfig()
+	}
+	return cfg
+}
+
+//Start starts serving requests on the configured listeners until the context is
+//cancelled, after which the servers are gracefully shutdown
+func (s *Server) Start(ctx context.Context) error {
+	cfg := s.cfg()
+
+	var (
+		tlsConfig *tls.Config
+		certs     *certReloader
+	)
+	for _, l := range cfg.listeners() {
+		if l.Protocol != "https" || tlsConfig != nil {
+			continue
+		}
+
+		var err error
+		tlsConfig, err = s.tlsConfig()
+		if err != nil {
+			s.log.Fatalf("TLS config failed: %s", err)
+			return err
+		}
+
+		//Load certificates through GetCertificate so rotated files are picked up live
+		certs, err = newCertReloader(cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.OCSPStaple, cfg.TLS.ReloadInterval, s.metrics)
+		if err != nil {
+			return err
+		}
+		s.reloadMu.Lock()
+		s.certs = append(s.certs, certs)
+		s.reloadMu.Unlock()
+		tlsConfig.GetCertificate = certs.GetCertificate
+
+		if err := s.configureClientAuth(tlsConfig); err != nil {
+			return err
+		}
+		s.log.WithFields(tlsPolicyFields(cfg.TLS, tlsConfig)).Info("TLS policy")
+	}
+
+	listeners, err := s.openListeners(s.httpHandler(), tlsConfig)
 	if err != nil {
-		s.log.Fatalf("TLS config failed: %s", err)
 		return err
 	}
 
-	handler := s.httpHandler()
-	handler = handlers.LoggingHandler(s.log.Out, handler)
+	servers := make([]*http.Server, 0, len(listeners))
+	for _, l := range listeners {
+		servers = append(servers, l.srv)
+	}
+
+	metricsSrv := s.metricsServer()
+	others := []*http.Server{metricsSrv}
 
-	httpSrv := http.Server{
-		Addr:      viper.Get("address").(string),
-		Handler:   handler,
-		TLSConfig: tlsConfig,
+	adminSrv, err := s.adminServer(certs)
+	if err != nil {
+		for _, l := range listeners {
+			l.ln.Close()
+		}
+		return err
 	}
 
-	cert := viper.Get("tls.cert").(string)
-	key := viper.Get("tls.key").(string)
+	errs := make(chan error, 2+len(listeners))
 
-	go s.startMetricsEndpoint()
+	if adminSrv != nil {
+		others = append(others, adminSrv)
 
-	s.log.Info("Starting HTTPs endpoint")
+		go func() {
+			s.log.Info("Starting admin endpoint")
+			if err := listenAndServeAdmin(adminSrv); err != http.ErrServerClosed {
+				errs <- fmt.Errorf("admin endpoint: %s", err)
+			}
+		}()
+	}
 
-	return httpSrv.ListenAndServeTLS(cert, key)
+	go func() {
+		s.log.Info("Starting metrics endpoint")
+		if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+			errs <- fmt.Errorf("metrics endpoint: %s", err)
+		}
+	}()
+
+	for _, l := range listeners {
+		go func(l *listener) {
+			s.log.Infof("Starting %s endpoint", l)
+			if err := l.serve(); err != http.ErrServerClosed {
+				errs <- fmt.Errorf("%s endpoint: %s", l, err)
+			}
+		}(l)
+	}
+
+	go s.flushTenantStatsLoop(ctx)
+	go s.pool.healthCheckLoop(ctx)
+	go s.outbox.run(ctx, s.applyOutbox)
+	if cfg.SSE.Enabled {
+		go s.subscribeNotices(ctx)
+	}
+
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+
+	if shutdownErr := s.shutdown(servers, others...); err == nil {
+		err = shutdownErr
+	}
+
+	return err
+}
+
+//shutdown gracefully stops the servers, waiting for in-flight requests and background
+//tasks to complete before closing the cache connection
+func (s *Server) shutdown(servers []*http.Server, others ...*http.Server) error {
+	s.log.Info("Shutting down")
+
+	//Report not ready and keep serving while load balancers stop sending traffic
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	time.Sleep(s.cfg().Shutdown.Delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg().Shutdown.Timeout)
+	defer cancel()
+
+	//End event streams so clients reconnect to other replicas rather than holding the drain
+	if s.notices != nil {
+		s.notices.close()
+	}
+
+	err := s.shutdownAll(ctx, servers, "failed to drain in-flight requests on %s")
+
+	if drainErr := s.drain(ctx); drainErr != nil {
+		s.log.WithError(drainErr).Error("failed to drain background tasks")
+		if err == nil {
+			err = drainErr
+		}
+	}
+
+	s.shutdownAll(ctx, others, "failed to shutdown endpoint %s")
+
+	if s.outbox != nil {
+		if closeErr := s.outbox.close(); closeErr != nil {
+			s.log.WithError(closeErr).Error("failed to close outbox")
+		}
+	}
+
+	if traceErr := s.shutdownTracing(ctx); traceErr != nil {
+		s.log.WithError(traceErr).Error("failed to flush traces")
+	}
+
+	if s.cacheHealth != nil {
+		s.cacheHealth.Close()
+	}
+
+	if s.rdb != nil {
+		if flushErr := s.tenantCounters.flush(ctx, s.rdb); flushErr != nil {
+			s.log.WithError(flushErr).Error("failed to flush tenant stats")
+		}
+
+		if closeErr := s.rdb.Close(); closeErr != nil {
+			s.log.WithError(closeErr).Error("failed to close cache connection")
+		}
+	}
+
+	return err
+}
+
+//shutdownAll gracefully shuts down the servers in parallel, so every listener stops
+//accepting at once and shares the deadline, returning the first failure
+func (s *Server) shutdownAll(ctx context.Context, servers []*http.Server, failure string) error {
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		err error
+	)
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+
+			if srvErr := srv.Shutdown(ctx); srvErr != nil {
+				s.log.WithError(srvErr).Errorf(failure, srv.Addr)
+
+				mu.Lock()
+				if err == nil {
+					err = srvErr
+				}
+				mu.Unlock()
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	return err
+}
+
+//async runs fn in the background, tracked so it can be drained during shutdown
+func (s *Server) async(fn func()) {
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+		fn()
+	}()
+}
+
+//drain waits for background tasks to complete or the context to expire
+func (s *Server) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.tasks.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
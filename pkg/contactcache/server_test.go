@@ -0,0 +1,84 @@
+package contactcache
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownDrainsBackgroundTasks(t *testing.T) {
+	srv, _, close, _ := setupTestServer(t, `{}`)
+	defer close()
+
+	var done int32
+	srv.async(func() {
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&done, 1)
+	})
+
+	err := srv.shutdown([]*http.Server{{}}, &http.Server{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&done))
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	srv, _, close, _ := setupTestServer(t, `{}`)
+	defer close()
+
+	srv.cfg().Shutdown.Timeout = 10 * time.Millisecond
+
+	srv.async(func() {
+		time.Sleep(200 * time.Millisecond)
+	})
+
+	err := srv.shutdown([]*http.Server{{}}, &http.Server{})
+	assert.Error(t, err)
+}
+
+func TestShutdownListenersTogether(t *testing.T) {
+	srv, _, stop, _ := setupTestServer(t, `{}`)
+	defer stop()
+
+	srv.cfg().Shutdown.Delay = 0
+
+	serving := make(chan struct{})
+	release := make(chan struct{})
+
+	serve := func(handler http.HandlerFunc) (*http.Server, string) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs := &http.Server{Handler: handler}
+		go hs.Serve(l)
+		return hs, l.Addr().String()
+	}
+
+	slow, slowAddr := serve(func(w http.ResponseWriter, r *http.Request) {
+		close(serving)
+		<-release
+	})
+	other, otherAddr := serve(func(w http.ResponseWriter, r *http.Request) {})
+
+	go http.Get("http://" + slowAddr)
+	<-serving
+
+	done := make(chan error)
+	go func() { done <- srv.shutdown([]*http.Server{slow, other}) }()
+
+	//The other listener stops accepting while the first is still draining
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", otherAddr)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, time.Second, 5*time.Millisecond)
+
+	close(release)
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,387 @@
+package contactcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	shadowHeader = "X-Shadow-Request"
+
+	//maxShadowDiffs differences logged per mismatched response
+	maxShadowDiffs = 20
+	//maxShadowValueLen longest value included in a logged difference
+	maxShadowValueLen = 64
+)
+
+//shadowClient sends mirrored requests outside of the proxy, so they never reach the
+//cache, retries or circuit breaker. Redirects are compared rather than followed
+var shadowClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+//shadowRequest a request being mirrored to the shadow backend, along with the primary
+//response to compare against
+type shadowRequest struct {
+	req     *http.Request
+	body    []byte
+	route   string
+	log     *logrus.Entry
+	primary *teeWriter
+}
+
+//mirror samples the request for shadowing, buffering the body so it can be sent to both
+//backends. Nil if the request isn't mirrored
+func (s *Server) mirror(w http.ResponseWriter, r *http.Request) (*shadowRequest, http.ResponseWriter) {
+	cfg := s.cfg().Shadow
+	if cfg.Address == "" || cfg.Percent <= 0 || rand.Float64()*100 >= cfg.Percent || !cfg.mirrors(r.Method) {
+		return nil, w
+	}
+
+	if atomic.AddInt32(&s.shadowInFlight, 1) > int32(cfg.MaxInFlight) {
+		atomic.AddInt32(&s.shadowInFlight, -1)
+		s.metrics.shadowComparisons.WithLabelValues(routeTemplate(r), "dropped").Inc()
+		return nil, w
+	}
+
+	sr := &shadowRequest{
+		req:   r,
+		route: routeTemplate(r),
+		log:   s.reqLog(r.Context()),
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, cfg.MaxBodySize+1))
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		if err != nil || int64(len(body)) > cfg.MaxBodySize {
+			atomic.AddInt32(&s.shadowInFlight, -1)
+			s.metrics.shadowComparisons.WithLabelValues(sr.route, "dropped").Inc()
+			return nil, w
+		}
+		sr.body = body
+	}
+
+	sr.primary = &teeWriter{ResponseWriter: w, status: http.StatusOK, limit: cfg.MaxBodySize}
+
+	return sr, sr.primary
+}
+
+//mirrors checks if requests with the method are mirrored
+func (c ShadowConfig) mirrors(method string) bool {
+	for _, m := range c.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+//shadow sends the request to the shadow backend in the background once the primary
+//response has been served, comparing the responses
+func (s *Server) shadow(sr *shadowRequest) {
+	//Copy what's needed before the request is finished with
+	req, err := s.shadowRequest(sr)
+	if err != nil {
+		atomic.AddInt32(&s.shadowInFlight, -1)
+		sr.log.WithError(err).Error("failed to create shadow request")
+		return
+	}
+
+	s.async(func() {
+		defer atomic.AddInt32(&s.shadowInFlight, -1)
+		s.compareShadow(sr, req)
+	})
+}
+
+//shadowRequest creates the mirrored request for the shadow backend
+func (s *Server) shadowRequest(sr *shadowRequest) (*http.Request, error) {
+	target, err := url.Parse(s.cfg().Shadow.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	target.Path = singleJoiningSlash(target.Path, sr.req.URL.Path)
+	target.RawQuery = sr.req.URL.RawQuery
+
+	req, err := http.NewRequest(sr.req.Method, target.String(), bytes.NewReader(sr.body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = sr.req.Header.Clone()
+	req.Header.Del("Connection")
+	//Let the client negotiate and decode compression
+	req.Header.Del("Accept-Encoding")
+	req.Header.Set(shadowHeader, "1")
+
+	return req, nil
+}
+
+//compareShadow sends the shadow request and compares its response with the primary
+func (s *Server) compareShadow(sr *shadowRequest, req *http.Request) {
+	cfg := s.cfg().Shadow
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	result := func(r string) {
+		s.metrics.shadowComparisons.WithLabelValues(sr.route, r).Inc()
+	}
+
+	resp, err := shadowClient.Do(req.WithContext(ctx))
+	if err != nil {
+		result("error")
+		sr.log.WithError(err).Warn("shadow request failed")
+		return
+	}
+	defer resp.Body.Close()
+
+	shadowBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, cfg.MaxBodySize+1))
+	if err != nil {
+		result("error")
+		sr.log.WithError(err).Warn("failed to read shadow response")
+		return
+	}
+
+	primaryBody, err := sr.primary.decoded()
+	if err != nil || sr.primary.truncated || int64(len(shadowBody)) > cfg.MaxBodySize {
+		//Too large or undecodable to compare
+		result("dropped")
+		return
+	}
+
+	fields := logrus.Fields{
+		"route":         sr.route,
+		"method":        sr.req.Method,
+		"status":        sr.primary.status,
+		"shadow_status": resp.StatusCode,
+	}
+
+	if sr.primary.status != resp.StatusCode {
+		result("status_mismatch")
+		sr.log.WithFields(fields).Warn("shadow status mismatch")
+		return
+	}
+
+	diffs, total := diffBodies(primaryBody, shadowBody, cfg.IgnoreFields, cfg.RedactFields)
+	if total == 0 {
+		result("match")
+		return
+	}
+
+	result("body_mismatch")
+	fields["diff_count"] = total
+	fields["diffs"] = strings.Join(diffs, "; ")
+	sr.log.WithFields(fields).Warn("shadow body mismatch")
+}
+
+//teeWriter records the status and body written to the client, up to the limit
+type teeWriter struct {
+	http.ResponseWriter
+	status    int
+	limit     int64
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (tw *teeWriter) WriteHeader(status int) {
+	tw.status = status
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *teeWriter) Write(b []byte) (int, error) {
+	if !tw.truncated {
+		if int64(tw.body.Len()+len(b)) > tw.limit {
+			tw.truncated = true
+		} else {
+			tw.body.Write(b)
+		}
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+//Unwrap provides the underlying writer for http.ResponseController
+func (tw *teeWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+//decoded provides the recorded body, decompressing gzip encoded responses
+func (tw *teeWriter) decoded() ([]byte, error) {
+	if tw.Header().Get("Content-Encoding") != "gzip" {
+		return tw.body.Bytes(), nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(tw.body.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+//diffBodies compares the bodies as normalized JSON, ignoring key order, whitespace and
+//the ignored fields. Provides up to maxShadowDiffs differences and the total count.
+//Bodies which aren't JSON are compared byte for byte
+func diffBodies(primary, shadow []byte, ignore, redact []string) ([]string, int) {
+	var a, b interface{}
+	if decodeJSON(primary, &a) != nil || decodeJSON(shadow, &b) != nil {
+		if bytes.Equal(primary, shadow) {
+			return nil, 0
+		}
+		return []string{"body differs"}, 1
+	}
+
+	d := &jsonDiff{
+		ignore: stringSet(ignore),
+		redact: stringSet(redact),
+	}
+	for field := range sensitiveFields {
+		d.redact[strings.ToLower(field)] = true
+	}
+
+	d.compare("", a, b)
+
+	return d.diffs, d.total
+}
+
+func decodeJSON(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[strings.ToLower(v)] = true
+	}
+	return set
+}
+
+//jsonDiff collects differences between decoded JSON values by path
+type jsonDiff struct {
+	ignore map[string]bool
+	redact map[string]bool
+	diffs  []string
+	total  int
+}
+
+func (d *jsonDiff) add(path, kind string, a, b interface{}) {
+	d.total++
+	if len(d.diffs) >= maxShadowDiffs {
+		return
+	}
+
+	if path == "" {
+		path = "."
+	}
+
+	switch kind {
+	case "added":
+		d.diffs = append(d.diffs, fmt.Sprintf("%s added %s", path, d.value(path, b)))
+	case "removed":
+		d.diffs = append(d.diffs, fmt.Sprintf("%s removed %s", path, d.value(path, a)))
+	default:
+		d.diffs = append(d.diffs, fmt.Sprintf("%s changed %s -> %s", path, d.value(path, a), d.value(path, b)))
+	}
+}
+
+func (d *jsonDiff) compare(path string, a, b interface{}) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			d.add(path, "changed", a, b)
+			return
+		}
+
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if d.ignore[strings.ToLower(k)] {
+				continue
+			}
+
+			child := path + "." + k
+			aChild, inA := av[k]
+			bChild, inB := bv[k]
+			switch {
+			case !inB:
+				d.add(child, "removed", aChild, nil)
+			case !inA:
+				d.add(child, "added", nil, bChild)
+			default:
+				d.compare(child, aChild, bChild)
+			}
+		}
+
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			d.add(path, "changed", a, b)
+			return
+		}
+
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			child := path + "[" + strconv.Itoa(i) + "]"
+			switch {
+			case i >= len(bv):
+				d.add(child, "removed", av[i], nil)
+			case i >= len(av):
+				d.add(child, "added", nil, bv[i])
+			default:
+				d.compare(child, av[i], bv[i])
+			}
+		}
+
+	default:
+		if a != b {
+			d.add(path, "changed", a, b)
+		}
+	}
+}
+
+//value formats a value for logging, redacting values within sensitive fields and emails
+func (d *jsonDiff) value(path string, v interface{}) string {
+	for _, field := range strings.Split(path, ".") {
+		if i := strings.Index(field, "["); i >= 0 {
+			field = field[:i]
+		}
+		if d.redact[strings.ToLower(field)] {
+			return "[REDACTED]"
+		}
+	}
+
+	b, _ := json.Marshal(v)
+	s := redactPII(string(b))
+	if len(s) > maxShadowValueLen {
+		s = s[:maxShadowValueLen] + "..."
+	}
+	return s
+}
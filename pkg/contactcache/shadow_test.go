@@ -0,0 +1,104 @@
+package contactcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffBodies(t *testing.T) {
+	primary := `{"contact_id": "person_1", "Email": "chris@autopilothq.com", "lists": [1, 2], "updated_at": 100, "token": "abc", "secret": {"pin": 1}}`
+
+	//Key order and whitespace are ignored
+	diffs, total := diffBodies([]byte(primary), []byte(`{"secret": {"pin": 1}, "token": "abc", "updated_at": 100,
+		"lists": [1, 2], "Email": "chris@autopilothq.com", "contact_id": "person_1"}`), nil, nil)
+	assert.Equal(t, 0, total)
+	assert.Empty(t, diffs)
+
+	shadow := `{"contact_id": "person_1", "Email": "chris.s@autopilothq.com", "lists": [1, 3, 4], "updated_at": 200, "token": "def", "secret": {"pin": 2}, "new": true}`
+	diffs, total = diffBodies([]byte(primary), []byte(shadow), []string{"Updated_At"}, []string{"secret"})
+	assert.Equal(t, 6, total)
+	assert.Equal(t, []string{
+		`.Email changed "` + redactPII("chris@autopilothq.com") + `" -> "` + redactPII("chris.s@autopilothq.com") + `"`,
+		".lists[1] changed 2 -> 3",
+		".lists[2] added 4",
+		".new added true",
+		".secret.pin changed [REDACTED] -> [REDACTED]",
+		".token changed [REDACTED] -> [REDACTED]",
+	}, diffs)
+	assert.NotContains(t, strings.Join(diffs, ";"), "autopilothq.com")
+
+	//Non-JSON bodies are compared as is
+	_, total = diffBodies([]byte("ok"), []byte("ok"), nil, nil)
+	assert.Equal(t, 0, total)
+	diffs, total = diffBodies([]byte("ok"), []byte("not ok"), nil, nil)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, []string{"body differs"}, diffs)
+}
+
+func TestShadowTraffic(t *testing.T) {
+	contact := `{"contact_id": "person_1", "Email": "chris@autopilothq.com"}`
+
+	srv, beReqCount, close, s := setupTestServer(t, contact)
+	defer close()
+
+	var shadowReqs int32
+	shadowBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&shadowReqs, 1)
+		assert.Equal(t, "1", r.Header.Get(shadowHeader))
+
+		switch r.URL.Path {
+		case "/v1/contact/chris@autopilothq.com":
+			fmt.Fprintln(w, `{"Email": "chris@autopilothq.com", "contact_id": "person_2"}`)
+		case "/v1/contacts":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			fmt.Fprintln(w, contact)
+		}
+	}))
+	defer shadowBackend.Close()
+
+	srv.cfg().Shadow.Address = shadowBackend.URL
+	srv.cfg().Shadow.Percent = 100
+
+	handler := srv.httpHandler()
+	apiKey := "1234"
+
+	for _, path := range []string{"/v1/contact/chris@autopilothq.com", "/v1/contacts", "/v1/other"} {
+		req, _ := http.NewRequest("GET", "https://anywhere.local"+path, nil)
+		req.Header.Add(apiKeyHeader, apiKey)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		//Clients always receive the primary response
+		assert.Equal(t, 200, w.Result().StatusCode, path)
+		assert.Equal(t, contact+"\n", w.Body.String(), path)
+	}
+
+	//Only GET requests are mirrored by default
+	req, _ := http.NewRequest("POST", "https://anywhere.local/v1/other", strings.NewReader(`{}`))
+	req.Header.Add(apiKeyHeader, apiKey)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	srv.tasks.Wait()
+
+	assert.Equal(t, 4, *beReqCount)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&shadowReqs))
+
+	//The cache holds the primary response
+	ce, _ := s.Get(srv.prefixKey(apiKey, "chris@autopilothq.com"))
+	assert.Contains(t, ce, contact)
+
+	comparisons := srv.metrics.shadowComparisons
+	assert.Equal(t, float64(1), testutil.ToFloat64(comparisons.WithLabelValues("/v1/contact/{idOrEmail}", "body_mismatch")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(comparisons.WithLabelValues("/v1/contacts", "status_mismatch")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(comparisons.WithLabelValues("/", "match")))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&srv.shadowInFlight))
+}
@@ -0,0 +1,380 @@
+package contactcache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/tidwall/gjson"
+)
+
+//Contact notice types, sent as the SSE event name
+const (
+	noticeInvalidated = "invalidated"
+	noticeCached      = "cached"
+
+	//noticeReset tells a resuming client notices were missed and the contact should be
+	//fetched again
+	noticeReset = "reset"
+)
+
+const (
+	//lastEventIDHeader the last event a reconnecting client received
+	lastEventIDHeader = "Last-Event-ID"
+
+	//streamBuffer notices queued for a stream before it's closed for falling behind
+	streamBuffer = 16
+
+	//routeContactEvents names the event stream route
+	routeContactEvents = "contact_events"
+)
+
+//contactNotice a tenants contact being invalidated or cached, shared between replicas.
+//Keys holds the contact ID and email as far as they are known
+type contactNotice struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	Keys      []string  `json:"keys"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+//contactID provides the contact ID from the notices keys
+func (n *contactNotice) contactID() string {
+	for _, key := range n.Keys {
+		if isPersonKey(key) {
+			return key
+		}
+	}
+	return ""
+}
+
+//noticeStream a client streaming the notices of a contact
+type noticeStream struct {
+	tenant string
+	keys   map[string]bool
+	ch     chan *contactNotice
+}
+
+//matches checks the notice is for the streams contact, learning the contacts other
+//keys so notices by either ID or email are matched
+func (st *noticeStream) matches(n *contactNotice) bool {
+	if n.Tenant != st.tenant {
+		return false
+	}
+
+	match := false
+	for _, key := range n.Keys {
+		if st.keys[key] {
+			match = true
+		}
+	}
+	if match {
+		for _, key := range n.Keys {
+			st.keys[key] = true
+		}
+	}
+	return match
+}
+
+//noticeHub fans out contact notices to the streams on this replica, keeping the most
+//recent notices in a ring buffer so reconnecting clients can resume
+type noticeHub struct {
+	mu      sync.Mutex
+	streams map[*noticeStream]struct{}
+	recent  []*contactNotice
+	next    int
+	closed  bool
+}
+
+func newNoticeHub(replay int) *noticeHub {
+	return &noticeHub{
+		streams: map[*noticeStream]struct{}{},
+		recent:  make([]*contactNotice, 0, replay),
+	}
+}
+
+//dispatch records the notice and sends it to the matching streams. Streams which have
+//fallen behind are closed, the client resumes from the last notice it received
+func (h *noticeHub) dispatch(n *contactNotice) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if cap(h.recent) > 0 {
+		if len(h.recent) < cap(h.recent) {
+			h.recent = append(h.recent, n)
+		} else {
+			h.recent[h.next] = n
+			h.next = (h.next + 1) % cap(h.recent)
+		}
+	}
+
+	for st := range h.streams {
+		if !st.matches(n) {
+			continue
+		}
+
+		select {
+		case st.ch <- n:
+		default:
+			delete(h.streams, st)
+			close(st.ch)
+		}
+	}
+}
+
+//subscribe registers a stream for the contact, providing the notices for it since the
+//last event ID. Resumed is false if the last event is no longer buffered. No stream is
+//provided once closed or at the maximum streams
+func (h *noticeHub) subscribe(tenant string, keys []string, lastID string, max int) (st *noticeStream, missed []*contactNotice, resumed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed || len(h.streams) >= max {
+		return nil, nil, false
+	}
+
+	st = &noticeStream{
+		tenant: tenant,
+		keys:   map[string]bool{},
+		ch:     make(chan *contactNotice, streamBuffer),
+	}
+	for _, key := range keys {
+		st.keys[key] = true
+	}
+	h.streams[st] = struct{}{}
+
+	if lastID == "" {
+		return st, nil, true
+	}
+
+	//Oldest first, learning the contacts keys from the earlier notices
+	recent := append(append([]*contactNotice{}, h.recent[h.next:]...), h.recent[:h.next]...)
+	for _, n := range recent {
+		if st.matches(n) && resumed {
+			missed = append(missed, n)
+		}
+		if n.ID == lastID {
+			resumed = true
+		}
+	}
+
+	return st, missed, resumed
+}
+
+//unsubscribe removes the stream
+func (h *noticeHub) unsubscribe(st *noticeStream) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.streams[st]; ok {
+		delete(h.streams, st)
+		close(st.ch)
+	}
+}
+
+//close ends every stream, refusing new streams
+func (h *noticeHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for st := range h.streams {
+		delete(h.streams, st)
+		close(st.ch)
+	}
+}
+
+//notifyContact shares the contact being invalidated or cached with the streams of every
+//replica over redis pub/sub, only notifying this replicas streams if it can't be published
+func (s *Server) notifyContact(ctx context.Context, tenant string, typ string, keys ...string) {
+	cfg := s.cfg().SSE
+	if !cfg.Enabled {
+		return
+	}
+
+	n := &contactNotice{
+		ID:        newRequestID(),
+		Tenant:    tenant,
+		Type:      typ,
+		Timestamp: time.Now().UTC(),
+	}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if key != "" && !seen[key] {
+			seen[key] = true
+			n.Keys = append(n.Keys, key)
+		}
+	}
+	if len(n.Keys) == 0 {
+		return
+	}
+
+	//Published notices are received back through the subscription
+	if atomic.LoadInt32(&s.noticesSubscribed) == 1 {
+		b, err := json.Marshal(n)
+		if err == nil {
+			err = s.rdb.Publish(ctx, cfg.Channel, b).Err()
+		}
+		if err == nil {
+			s.metrics.contactNotices.WithLabelValues(typ, "published").Inc()
+			return
+		}
+		s.log.WithError(err).Warn("failed to publish contact notice")
+	}
+
+	s.metrics.contactNotices.WithLabelValues(typ, "local").Inc()
+	s.notices.dispatch(n)
+}
+
+//subscribeNotices dispatches the notices published by every replica, including this
+//one, to the streams until the context is done
+func (s *Server) subscribeNotices(ctx context.Context) {
+	channel := s.cfg().SSE.Channel
+
+	for ctx.Err() == nil {
+		sub := s.rdb.Subscribe(ctx, channel)
+		if _, err := sub.Receive(ctx); err != nil {
+			sub.Close()
+			if ctx.Err() == nil {
+				s.log.WithError(err).Warn("failed to subscribe to contact notices")
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		atomic.StoreInt32(&s.noticesSubscribed, 1)
+		s.receiveNotices(ctx, sub.Channel())
+		atomic.StoreInt32(&s.noticesSubscribed, 0)
+		sub.Close()
+	}
+}
+
+//receiveNotices dispatches the received notices until the context is done
+func (s *Server) receiveNotices(ctx context.Context, ch <-chan *redis.Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			var n contactNotice
+			if err := json.Unmarshal([]byte(msg.Payload), &n); err != nil {
+				s.log.WithError(err).Warn("invalid contact notice")
+				continue
+			}
+			s.notices.dispatch(&n)
+		}
+	}
+}
+
+//handleContactEvents streams notices of the contact being invalidated or cached as
+//server-sent events until the client disconnects
+func (s *Server) handleContactEvents(w http.ResponseWriter, r *http.Request) {
+	cfg := s.cfg().SSE
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Add("content-type", "application/json")
+		httpJSONError(w, "Streaming is not supported.", http.StatusInternalServerError)
+		return
+	}
+
+	if !s.allow(w, r, budgetCache) {
+		return
+	}
+
+	tenant := tenantHash(r.Header.Get(apiKeyHeader))
+	idOrEmail := mux.Vars(r)["idOrEmail"]
+
+	st, missed, resumed := s.notices.subscribe(tenant, s.contactKeys(r.Context(), tenant, idOrEmail), r.Header.Get(lastEventIDHeader), cfg.MaxStreams)
+	if st == nil {
+		w.Header().Add("content-type", "application/json")
+		httpJSONError(w, "Event streams are unavailable.", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.notices.unsubscribe(st)
+
+	s.metrics.contactStreams.Inc()
+	defer s.metrics.contactStreams.Dec()
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("x-accel-buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !resumed {
+		fmt.Fprintf(w, "event: %s\ndata: {}\n\n", noticeReset)
+	}
+	for _, n := range missed {
+		writeNotice(w, idOrEmail, n)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(cfg.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case n, ok := <-st.ch:
+			if !ok {
+				return
+			}
+			writeNotice(w, idOrEmail, n)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+//writeNotice writes the notice as an event
+func writeNotice(w http.ResponseWriter, idOrEmail string, n *contactNotice) {
+	event := map[string]interface{}{
+		"contact":   idOrEmail,
+		"type":      n.Type,
+		"timestamp": n.Timestamp,
+	}
+	if id := n.contactID(); id != "" {
+		event["contact_id"] = id
+	}
+
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", n.ID, n.Type, data)
+}
+
+//contactKeys provides the contact ID and email the contact is cached under, as far as
+//they are known
+func (s *Server) contactKeys(ctx context.Context, tenant string, idOrEmail string) []string {
+	keys := []string{idOrEmail}
+
+	val, err := s.cache.Get(ctx, tenantKey(tenant, idOrEmail))
+	if err != nil {
+		return keys
+	}
+
+	if isPersonKey(idOrEmail) {
+		if email := strings.TrimPrefix(val, tenantKey(tenant, "")); email != val {
+			keys = append(keys, email)
+		}
+	} else if id := gjson.Get(val, "contact_id").String(); id != "" {
+		keys = append(keys, id)
+	}
+	return keys
+}
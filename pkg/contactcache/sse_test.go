@@ -0,0 +1,207 @@
+package contactcache
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+//sseEvent a received server-sent event, comments such as heartbeats have no event
+type sseEvent struct {
+	id      string
+	event   string
+	data    string
+	comment string
+}
+
+//readEvents reads the events from the stream until it ends
+func readEvents(body io.Reader) <-chan sseEvent {
+	ch := make(chan sseEvent, 64)
+
+	go func() {
+		defer close(ch)
+
+		var e sseEvent
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				ch <- e
+				e = sseEvent{}
+			case strings.HasPrefix(line, ": "):
+				e.comment = line[2:]
+			case strings.HasPrefix(line, "id: "):
+				e.id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				e.event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				e.data = line[6:]
+			}
+		}
+	}()
+
+	return ch
+}
+
+func TestContactEvents(t *testing.T) {
+	contact := `{"contact_id": "person_1", "Email": "chris@autopilothq.com"}`
+
+	srv, _, close, _ := setupTestServer(t, contact)
+	defer close()
+
+	srv.cfg().SSE.Enabled = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go srv.subscribeNotices(ctx)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&srv.noticesSubscribed) == 1 }, time.Second, 5*time.Millisecond)
+
+	handler := srv.httpHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	apiKey := "1234"
+	channel := srv.cfg().SSE.Channel
+
+	stream := func(lastID string) (<-chan sseEvent, func()) {
+		req, _ := http.NewRequest("GET", ts.URL+"/v1/contact/chris@autopilothq.com/events", nil)
+		req.Header.Add(apiKeyHeader, apiKey)
+		if lastID != "" {
+			req.Header.Set(lastEventIDHeader, lastID)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "text/event-stream", resp.Header.Get("content-type"))
+
+		return readEvents(resp.Body), func() { resp.Body.Close() }
+	}
+
+	next := func(events <-chan sseEvent) sseEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+		return sseEvent{}
+	}
+
+	send := func(method, path string) {
+		req, _ := http.NewRequest(method, "https://anywhere.local"+path, nil)
+		req.Header.Add(apiKeyHeader, apiKey)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	publish := func(n contactNotice) {
+		b, _ := json.Marshal(n)
+		assert.NoError(t, srv.rdb.Publish(ctx, channel, b).Err())
+	}
+
+	events, stop := stream("")
+
+	//Streams are measured by their own gauge rather than as requests in flight
+	assert.Eventually(t, func() bool { return testutil.ToFloat64(srv.metrics.contactStreams) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, float64(0), testutil.ToFloat64(srv.metrics.requestsInFlight))
+
+	//Caching the contact teaches the stream its ID
+	send("GET", "/v1/contact/chris@autopilothq.com")
+	cached := next(events)
+	assert.Equal(t, noticeCached, cached.event)
+	assert.Contains(t, cached.data, `"contact_id":"person_1"`)
+
+	//Notices from other replicas by ID are matched
+	publish(contactNotice{ID: "remote_1", Tenant: tenantHash(apiKey), Keys: []string{"person_1"}, Type: noticeInvalidated})
+	e := next(events)
+	assert.Equal(t, "remote_1", e.id)
+	assert.Equal(t, noticeInvalidated, e.event)
+
+	//Other tenants contacts aren't streamed
+	publish(contactNotice{ID: "other_1", Tenant: tenantHash("4321"), Keys: []string{"chris@autopilothq.com"}, Type: noticeInvalidated})
+
+	send("DELETE", "/v1/contact/chris@autopilothq.com")
+	deleted := next(events)
+	assert.Equal(t, noticeInvalidated, deleted.event)
+	assert.NotEqual(t, "other_1", deleted.id)
+	stop()
+
+	//Reconnecting resumes after the last event received
+	events, stop = stream(cached.id)
+	assert.Equal(t, "remote_1", next(events).id)
+	assert.Equal(t, deleted.id, next(events).id)
+	stop()
+
+	//Clients are told to refetch when the last event is no longer buffered
+	srv.cfg().SSE.Heartbeat = 10 * time.Millisecond
+	events, stop = stream("unknown")
+	assert.Equal(t, noticeReset, next(events).event)
+	assert.Equal(t, "heartbeat", next(events).comment)
+
+	//Streams end on shutdown
+	srv.notices.close()
+	for range events {
+	}
+	stop()
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.contactNotices.WithLabelValues(noticeCached, "published")))
+	assert.Equal(t, uint64(0), sampleCount(t, srv.metrics, "contactcache_request_duration_seconds", map[string]string{
+		"route": "/v1/contact/{idOrEmail}/events",
+	}))
+}
+
+func TestNoticeHub(t *testing.T) {
+	hub := newNoticeHub(2)
+	tenant := tenantHash("1234")
+
+	notice := func(id string) *contactNotice {
+		return &contactNotice{ID: id, Tenant: tenant, Keys: []string{"person_1"}, Type: noticeInvalidated}
+	}
+
+	hub.dispatch(notice("1"))
+	hub.dispatch(notice("2"))
+	hub.dispatch(notice("3"))
+
+	//Only the most recent notices are kept
+	_, missed, resumed := hub.subscribe(tenant, []string{"person_1"}, "1", 10)
+	assert.False(t, resumed)
+	assert.Empty(t, missed)
+
+	_, missed, resumed = hub.subscribe(tenant, []string{"person_1"}, "2", 10)
+	assert.True(t, resumed)
+	if assert.Len(t, missed, 1) {
+		assert.Equal(t, "3", missed[0].ID)
+	}
+
+	//Streams which fall behind are closed
+	st, _, _ := hub.subscribe(tenant, []string{"person_1"}, "", 10)
+	for i := 0; i <= streamBuffer; i++ {
+		hub.dispatch(notice("n"))
+	}
+	n := 0
+	for range st.ch {
+		n++
+	}
+	assert.Equal(t, streamBuffer, n)
+
+	//The stream limit is enforced
+	for i := 0; i < 2; i++ {
+		st, _, _ = hub.subscribe(tenant, []string{"person_1"}, "", 2)
+		assert.NotNil(t, st)
+	}
+	st, _, _ = hub.subscribe(tenant, []string{"person_1"}, "", 2)
+	assert.Nil(t, st)
+}
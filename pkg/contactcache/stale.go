@@ -0,0 +1,90 @@
+package contactcache
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//staleRef references the stale copy of a cache entry which may be served in place of the backend
+type staleRef struct {
+	//key the primary cache key, or alias key if alias is set
+	key    string
+	alias  bool
+	entity string
+}
+
+//staleKey provides the key holding the long lived copy of a cache entry
+func staleKey(cacheKey string) string {
+	parts := strings.SplitN(cacheKey, ":", 2)
+	if len(parts) != 2 {
+		return "stale:" + cacheKey
+	}
+
+	return parts[0] + ":stale:" + parts[1]
+}
+
+//invalidatedTTL how long invalidations are recorded, outlasting any backend request
+const invalidatedTTL = 5 * time.Minute
+
+//listsInvalidated the key invalidations of the tenants list responses are recorded under
+const listsInvalidated = "lists:"
+
+//invalidatedKey provides the key recording when a cache entry was last invalidated
+func invalidatedKey(cacheKey string) string {
+	parts := strings.SplitN(cacheKey, ":", 2)
+	if len(parts) != 2 {
+		return "invalidated:" + cacheKey
+	}
+
+	return parts[0] + ":invalidated:" + parts[1]
+}
+
+//setStale keeps a long lived copy of the cache entry to fall back on when the backend is unavailable
+func (s *Server) setStale(ctx context.Context, cacheKey, value string) error {
+	ttl := s.cfg().Cache.StaleTTL
+	if ttl <= 0 {
+		return nil
+	}
+
+	return s.cache.Set(ctx, staleKey(cacheKey), value, ttl)
+}
+
+//serveStale responds with the stale copy of the requested entry if one exists
+func (s *Server) serveStale(w http.ResponseWriter, r *http.Request) bool {
+	ref, ok := staleRefFromContext(r.Context())
+	if !ok {
+		return false
+	}
+
+	key := staleKey(ref.key)
+	if ref.alias {
+		realKey, err := s.cache.Get(r.Context(), key)
+		if err != nil || realKey == "" {
+			return false
+		}
+		key = staleKey(realKey)
+	}
+
+	val, ttl, err := s.getEntry(r.Context(), key)
+	if err != nil || val == "" {
+		return false
+	}
+
+	if !s.allow(w, r, budgetCache) {
+		return true
+	}
+
+	setCacheDecision(r.Context(), "stale")
+	s.recordEntryAge(r.Context(), key, s.cfg().Cache.StaleTTL, ttl)
+
+	w.Header().Add("content-type", "application/json")
+	w.Header().Add("cached", "stale")
+	w.Header().Add("Warning", `110 - "Response is Stale"`)
+	w.Write([]byte(val))
+
+	s.countCache(r.Header.Get(apiKeyHeader), "stale", ref.entity)
+
+	return true
+}
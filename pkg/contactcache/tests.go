@@ -4,11 +4,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"net/http/httputil"
-	"net/url"
 	"testing"
 
-	"github.com/alicebob/miniredis"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
@@ -39,23 +37,41 @@ func setupTestServerHandleFunc(t *testing.T, handler http.HandlerFunc) (*Server,
 		panic(err)
 	}
 
-	//Set config to test redis
+	//Set config to test redis and backend
 	viper.Set("cache.address", s.Addr())
+	viper.Set("backend.address", ts.URL)
+	viper.Set("listeners", []map[string]interface{}{{"address": "127.0.0.1:0", "protocol": "http"}})
 
-	cache, err := NewRedisCache()
+	cfg, err := LoadConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	beURL, _ := url.Parse(ts.URL)
-	be := httputil.NewSingleHostReverseProxy(beURL)
+	rdb, err := newRedisClient(cfg.Cache)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	srv := &Server{
-		be:    be,
-		cache: cache,
-		log:   logrus.New(),
+		rdb:     rdb,
+		limiter: NewRedisRateLimiter(rdb),
+		log:     logrus.New(),
+		metrics: NewMetrics(),
+	}
+	srv.applyConfig(cfg)
+	srv.cacheHealth = NewHealthCheckedCache(&RedisCache{rdb: rdb}, cacheHealthOpts(cfg.Cache), srv.log, srv.metrics)
+	srv.cache = &tracedCache{next: srv.cacheHealth, tracer: srv.tracer}
+	srv.pool, err = newUpstreamPool(cfg.Backend, srv.metrics, srv.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.be = srv.newReverseProxy()
+	srv.outbox, err = newOutbox(cfg.Outbox, srv.metrics, srv.log)
+	if err != nil {
+		t.Fatal(err)
 	}
-	be.ModifyResponse = srv.handleProxyResponse
+	srv.sink = newChangeSink(cfg.Events, rdb)
+	srv.notices = newNoticeHub(cfg.SSE.Replay)
 
 	closer := func() {
 		ts.Close()
@@ -2,23 +2,140 @@ package contactcache
 
 import (
 	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
 )
 
+//tlsConfig provides the TLS policy for the configured profile and overrides
 func (s *Server) tlsConfig() (*tls.Config, error) {
-	//Based on perfect SSL labs score
-	config := &tls.Config{
-		MinVersion:               tls.VersionTLS12,
-		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-		PreferServerCipherSuites: true,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-		},
-	}
-
-	return config, nil
+	return tlsPolicy(s.cfg().TLS)
+}
+
+//certReloader serves a certificate loaded from files, picking up changes such as
+//rotations without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+	//ocspFile optional DER encoded OCSP response stapled to the certificate
+	ocspFile string
+
+	//interval between checking the files for changes, 0 only reloads when requested
+	interval time.Duration
+
+	metrics *Metrics
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+//newCertReloader loads the initial certificate
+func newCertReloader(certFile, keyFile, ocspFile string, interval time.Duration, metrics *Metrics) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS cert and key are required")
+	}
+
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		ocspFile: ocspFile,
+		interval: interval,
+		metrics:  metrics,
+	}
+
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+//GetCertificate provides the current certificate, reloading it first if the files have changed
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	due := cr.interval > 0 && time.Since(cr.checked) >= cr.interval
+	if due {
+		cr.checked = time.Now()
+	}
+	cr.mu.Unlock()
+
+	if due {
+		if modTime, err := cr.latestModTime(); err == nil && modTime.After(cr.loadedModTime()) {
+			cr.reload()
+		}
+	}
+
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	return cr.cert, nil
+}
+
+//reload loads the certificate, keeping the current certificate if it fails
+func (cr *certReloader) reload() error {
+	err := cr.load()
+	cr.metrics.recordReload("tls", err == nil)
+	return err
+}
+
+func (cr *certReloader) load() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS key pair: %s", err)
+	}
+
+	if cr.ocspFile != "" {
+		staple, err := ioutil.ReadFile(cr.ocspFile)
+		if err != nil {
+			return fmt.Errorf("failed to load OCSP staple: %s", err)
+		}
+		cert.OCSPStaple = staple
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.checked = time.Now()
+
+	return nil
+}
+
+func (cr *certReloader) loadedModTime() time.Time {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	return cr.modTime
+}
+
+//latestModTime the most recent modification of the certificate, key or OCSP staple
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	files := []string{cr.certFile, cr.keyFile}
+	if cr.ocspFile != "" {
+		files = append(files, cr.ocspFile)
+	}
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
 }
@@ -0,0 +1,179 @@
+package contactcache
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+//tlsProfile a named TLS policy, based on the Mozilla server side TLS recommendations
+type tlsProfile struct {
+	minVersion uint16
+	ciphers    []uint16
+	curves     []tls.CurveID
+}
+
+var (
+	//intermediateCiphers forward secret AEAD suites. TLS 1.3 suites are not configurable
+	intermediateCiphers = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	}
+
+	defaultCurves = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+
+	tlsProfiles = map[string]tlsProfile{
+		"modern": {
+			minVersion: tls.VersionTLS13,
+			curves:     defaultCurves,
+		},
+		"intermediate": {
+			minVersion: tls.VersionTLS12,
+			ciphers:    intermediateCiphers,
+			curves:     defaultCurves,
+		},
+		"legacy": {
+			minVersion: tls.VersionTLS10,
+			ciphers: append(append([]uint16{}, intermediateCiphers...),
+				tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+				tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+				tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+				tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+				tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+				tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			),
+			curves: append(append([]tls.CurveID{}, defaultCurves...), tls.CurveP521),
+		},
+	}
+
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	tlsCurves = map[string]tls.CurveID{
+		"X25519": tls.X25519,
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+	}
+)
+
+//tlsPolicy builds the TLS config for the configured profile and overrides
+func tlsPolicy(cfg TLSConfig) (*tls.Config, error) {
+	profile, ok := tlsProfiles[cfg.Profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS profile %q, expected modern, intermediate or legacy", cfg.Profile)
+	}
+
+	config := &tls.Config{
+		MinVersion:       profile.minVersion,
+		CipherSuites:     append([]uint16(nil), profile.ciphers...),
+		CurvePreferences: append([]tls.CurveID(nil), profile.curves...),
+	}
+
+	if cfg.MinVersion != "" {
+		v, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", cfg.MinVersion)
+		}
+		config.MinVersion = v
+	}
+
+	if cfg.MaxVersion != "" {
+		v, ok := tlsVersions[cfg.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", cfg.MaxVersion)
+		}
+		config.MaxVersion = v
+	}
+
+	if config.MaxVersion != 0 && config.MaxVersion < config.MinVersion {
+		return nil, fmt.Errorf("TLS max version is lower than the min version")
+	}
+
+	if len(cfg.CipherSuites) > 0 {
+		ciphers, err := cipherSuiteIDs(cfg.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		config.CipherSuites = ciphers
+	}
+
+	if len(cfg.Curves) > 0 {
+		config.CurvePreferences = nil
+		for _, name := range cfg.Curves {
+			curve, ok := tlsCurves[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown TLS curve %q", name)
+			}
+			config.CurvePreferences = append(config.CurvePreferences, curve)
+		}
+	}
+
+	return config, nil
+}
+
+//cipherSuiteIDs resolves cipher suite names, including those considered insecure
+func cipherSuiteIDs(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+//tlsPolicyFields describes the effective policy for logging
+func tlsPolicyFields(cfg TLSConfig, config *tls.Config) logrus.Fields {
+	versionName := func(v uint16) string {
+		for name, id := range tlsVersions {
+			if id == v {
+				return name
+			}
+		}
+		return "default"
+	}
+
+	ciphers := make([]string, 0, len(config.CipherSuites))
+	for _, id := range config.CipherSuites {
+		ciphers = append(ciphers, tls.CipherSuiteName(id))
+	}
+
+	curves := make([]string, 0, len(config.CurvePreferences))
+	for _, id := range config.CurvePreferences {
+		for name, curve := range tlsCurves {
+			if curve == id {
+				curves = append(curves, name)
+			}
+		}
+	}
+
+	return logrus.Fields{
+		"profile":     cfg.Profile,
+		"min_version": versionName(config.MinVersion),
+		"max_version": versionName(config.MaxVersion),
+		"ciphers":     strings.Join(ciphers, ","),
+		"curves":      strings.Join(curves, ","),
+		"ocsp_staple": cfg.OCSPStaple != "",
+	}
+}
@@ -0,0 +1,138 @@
+package contactcache
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSPolicyProfiles(t *testing.T) {
+	modern, err := tlsPolicy(TLSConfig{Profile: "modern"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(tls.VersionTLS13), modern.MinVersion)
+	}
+
+	intermediate, err := tlsPolicy(TLSConfig{Profile: "intermediate"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(tls.VersionTLS12), intermediate.MinVersion)
+		for _, id := range intermediate.CipherSuites {
+			assert.NotContains(t, tls.CipherSuiteName(id), "TLS_RSA_")
+			assert.NotContains(t, tls.CipherSuiteName(id), "CBC")
+		}
+	}
+
+	//Overrides
+	cfg, err := tlsPolicy(TLSConfig{
+		Profile:      "intermediate",
+		MinVersion:   "1.1",
+		MaxVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		Curves:       []string{"P256"},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(tls.VersionTLS11), cfg.MinVersion)
+		assert.Equal(t, uint16(tls.VersionTLS12), cfg.MaxVersion)
+		assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, cfg.CipherSuites)
+		assert.Equal(t, []tls.CurveID{tls.CurveP256}, cfg.CurvePreferences)
+	}
+
+	for _, invalid := range []TLSConfig{
+		{Profile: "strict"},
+		{Profile: "modern", MinVersion: "1.4"},
+		{Profile: "modern", MaxVersion: "1.2"},
+		{Profile: "modern", CipherSuites: []string{"TLS_NOPE"}},
+		{Profile: "modern", Curves: []string{"P999"}},
+	} {
+		_, err := tlsPolicy(invalid)
+		assert.Error(t, err, "%+v", invalid)
+	}
+}
+
+//startPolicyServer serves over TLS with the policy and a self-signed certificate
+func startPolicyServer(t *testing.T, cfg TLSConfig) *httptest.Server {
+	dir := t.TempDir()
+	cfg.Cert = filepath.Join(dir, "cert.pem")
+	cfg.Key = filepath.Join(dir, "key.pem")
+	writeTestCert(t, cfg.Cert, cfg.Key, "localhost")
+
+	tlsConfig, err := tlsPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := newCertReloader(cfg.Cert, cfg.Key, cfg.OCSPStaple, 0, NewMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig.GetCertificate = certs.GetCertificate
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+
+	return ts
+}
+
+//dialTLS handshakes with the server using the client config. SNI is sent so the test
+//certificate is served rather than the httptest default
+func dialTLS(ts *httptest.Server, config *tls.Config) (tls.ConnectionState, error) {
+	config.ServerName = "localhost"
+	config.InsecureSkipVerify = true
+
+	conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), config)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState(), nil
+}
+
+func TestTLSPolicyModernRejectsLegacyClients(t *testing.T) {
+	ts := startPolicyServer(t, TLSConfig{Profile: "modern"})
+	defer ts.Close()
+
+	_, err := dialTLS(ts, &tls.Config{MaxVersion: tls.VersionTLS12})
+	assert.Error(t, err)
+
+	state, err := dialTLS(ts, &tls.Config{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(tls.VersionTLS13), state.Version)
+	}
+}
+
+func TestTLSPolicyIntermediateRejectsWeakCiphers(t *testing.T) {
+	ts := startPolicyServer(t, TLSConfig{Profile: "intermediate"})
+	defer ts.Close()
+
+	_, err := dialTLS(ts, &tls.Config{
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+	})
+	assert.Error(t, err)
+
+	state, err := dialTLS(ts, &tls.Config{MaxVersion: tls.VersionTLS12})
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(tls.VersionTLS12), state.Version)
+	}
+}
+
+func TestOCSPStapling(t *testing.T) {
+	staple := filepath.Join(t.TempDir(), "ocsp.der")
+	if err := ioutil.WriteFile(staple, []byte("ocsp response"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := startPolicyServer(t, TLSConfig{Profile: "intermediate", OCSPStaple: staple})
+	defer ts.Close()
+
+	state, err := dialTLS(ts, &tls.Config{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("ocsp response"), state.OCSPResponse)
+	}
+}
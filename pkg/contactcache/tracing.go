@@ -1,3 +1,232 @@
 package contactcache
 
-//TODO(tcfw) with a little more time, some tracing handlers can be added i.e. Zipkin/Jaeger
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/tcfw/test-contactcache/pkg/contactcache"
+)
+
+var (
+	//propagator W3C trace context, shared with the backend
+	propagator = propagation.TraceContext{}
+)
+
+//newTracerProvider creates a tracer provider for the configured exporter, or nil if tracing is disabled
+func newTracerProvider(cfg TracingConfig) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch cfg.Exporter {
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if cfg.OTLP.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.OTLP.Endpoint))
+		}
+		if cfg.OTLP.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %s", cfg.Exporter, err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(cfg.ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	), nil
+}
+
+//tracer provides the servers tracer, a noop tracer if tracing is disabled
+func (s *Server) tracer() trace.Tracer {
+	if s.tp == nil {
+		return trace.NewNoopTracerProvider().Tracer(tracerName)
+	}
+
+	return s.tp.Tracer(tracerName)
+}
+
+//shutdownTracing flushes any buffered spans
+func (s *Server) shutdownTracing(ctx context.Context) error {
+	if tp, ok := s.tp.(interface{ Shutdown(context.Context) error }); ok {
+		return tp.Shutdown(ctx)
+	}
+
+	return nil
+}
+
+//tracing starts a span for each inbound request, continuing any propagated trace
+func (s *Server) tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := s.tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(r.Method),
+				semconv.HTTPRouteKey.String(route),
+			),
+		)
+		defer span.End()
+
+		wRec := &statusRecorder{
+			ResponseWriter: w,
+			Status:         200,
+		}
+
+		next.ServeHTTP(wRec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(wRec.Status))
+		if wRec.Status >= 500 {
+			span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(wRec.Status))
+		}
+	})
+}
+
+//tracingTransport traces each backend round trip, propagating the trace context to the backend
+type tracingTransport struct {
+	next   http.RoundTripper
+	tracer func() trace.Tracer
+}
+
+//RoundTrip sends the request within a client span
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := t.tracer().Start(req.Context(), "upstream "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.NetPeerNameKey.String(req.URL.Hostname()),
+		),
+	)
+	defer span.End()
+
+	//Don't modify the callers request
+	req = req.Clone(ctx)
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(resp.StatusCode))
+	}
+
+	return resp, nil
+}
+
+//tracedCache traces each cache operation. Keys are not recorded as they may contain emails
+type tracedCache struct {
+	next   Cacher
+	tracer func() trace.Tracer
+}
+
+//Set sets a cache key
+func (tc *tracedCache) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	ctx, span := tc.start(ctx, "SET")
+	defer span.End()
+
+	err := tc.next.Set(ctx, key, value, ttl)
+	tc.end(span, err)
+	return err
+}
+
+//Get gets a cache key
+func (tc *tracedCache) Get(ctx context.Context, key string) (string, error) {
+	ctx, span := tc.start(ctx, "GET")
+	defer span.End()
+
+	val, err := tc.next.Get(ctx, key)
+	span.SetAttributes(attribute.Bool("cache.hit", err == nil))
+	tc.end(span, err)
+	return val, err
+}
+
+//Delete deletes a cache key
+func (tc *tracedCache) Delete(ctx context.Context, key string) error {
+	ctx, span := tc.start(ctx, "DEL")
+	defer span.End()
+
+	err := tc.next.Delete(ctx, key)
+	tc.end(span, err)
+	return err
+}
+
+//GetWithTTL gets a cache key along with its remaining TTL
+func (tc *tracedCache) GetWithTTL(ctx context.Context, key string) (string, time.Duration, error) {
+	g, ok := tc.next.(ttlGetter)
+	if !ok {
+		val, err := tc.Get(ctx, key)
+		return val, -1, err
+	}
+
+	ctx, span := tc.start(ctx, "GET")
+	defer span.End()
+
+	val, ttl, err := g.GetWithTTL(ctx, key)
+	span.SetAttributes(attribute.Bool("cache.hit", err == nil))
+	tc.end(span, err)
+	return val, ttl, err
+}
+
+//TTL provides the remaining TTL of a cache key
+func (tc *tracedCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	t, ok := tc.next.(ttler)
+	if !ok {
+		return 0, ErrCacheMiss
+	}
+
+	ctx, span := tc.start(ctx, "TTL")
+	defer span.End()
+
+	ttl, err := t.TTL(ctx, key)
+	tc.end(span, err)
+	return ttl, err
+}
+
+func (tc *tracedCache) start(ctx context.Context, op string) (context.Context, trace.Span) {
+	return tc.tracer().Start(ctx, "cache "+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemRedis,
+			semconv.DBOperationKey.String(op),
+		),
+	)
+}
+
+//end records failures, misses are not considered errors
+func (tc *tracedCache) end(span trace.Span, err error) {
+	if err == nil || errors.Is(err, ErrCacheMiss) {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
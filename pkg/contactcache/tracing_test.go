@@ -0,0 +1,78 @@
+package contactcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//spansByName indexes recorded spans by name, keeping the last of each
+func spansByName(spans tracetest.SpanStubs) map[string]tracetest.SpanStub {
+	byName := map[string]tracetest.SpanStub{}
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	return byName
+}
+
+func TestTracing(t *testing.T) {
+	contact := `{"contact_id": "person_1234", "Email": "chris@autopilothq.com"}`
+
+	var traceparent string
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		fmt.Fprintln(w, contact)
+	})
+	defer close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	srv.tp = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	handler := srv.httpHandler()
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contact/chris@autopilothq.com", nil)
+	req.Header.Add(apiKeyHeader, "1234")
+	req.Header.Add("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	spans := spansByName(exporter.GetSpans())
+	for _, name := range []string{"GET /v1/contact/{idOrEmail}", "cache GET", "upstream GET", "cache populate", "cache SET"} {
+		if assert.Contains(t, spans, name) {
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[name].SpanContext.TraceID().String(), name)
+		}
+	}
+
+	//Continues the inbound trace
+	inbound := spans["GET /v1/contact/{idOrEmail}"]
+	assert.Equal(t, "00f067aa0ba902b7", inbound.Parent.SpanID().String())
+	assert.Equal(t, trace.SpanKindServer, inbound.SpanKind)
+
+	//Propagates to the backend from the upstream span
+	upstream := spans["upstream GET"]
+	assert.Equal(t, inbound.SpanContext.SpanID(), upstream.Parent.SpanID())
+	assert.Equal(t, fmt.Sprintf("00-4bf92f3577b34da6a3ce929d0e0e4736-%s-01", upstream.SpanContext.SpanID()), traceparent)
+
+	//Cache population continues after the response
+	populate := spans["cache populate"]
+	assert.Equal(t, populate.SpanContext.SpanID(), spans["cache SET"].Parent.SpanID())
+
+	//Cache hits don't reach the backend
+	exporter.Reset()
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "yes", w.Result().Header.Get("cached"))
+
+	spans = spansByName(exporter.GetSpans())
+	assert.Contains(t, spans, "cache GET")
+	assert.NotContains(t, spans, "upstream GET")
+}
@@ -0,0 +1,229 @@
+package contactcache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+//newReverseProxy creates the reverse proxy to the backend pool using the configured upstream transport
+func (s *Server) newReverseProxy() *httputil.ReverseProxy {
+	cfg := s.cfg().Upstream
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.Timeout.Dial,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       cfg.Timeout.Idle,
+		TLSHandshakeTimeout:   cfg.Timeout.TLSHandshake,
+		ResponseHeaderTimeout: cfg.Timeout.ResponseHeader,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	s.pool.useTransport(transport)
+
+	transport = &instrumentedTransport{next: transport, metrics: s.metrics}
+
+	//Trace each attempt
+	transport = &tracingTransport{next: transport, tracer: s.tracer}
+
+	//Pick an upstream for each attempt, each with its own breaker
+	if cfg.Breaker.Enabled {
+		s.pool.useBreakers(breakerOpts{
+			Window:           cfg.Breaker.Window,
+			MinRequests:      cfg.Breaker.MinRequests,
+			ErrorRate:        cfg.Breaker.ErrorRate,
+			OpenDuration:     cfg.Breaker.OpenDuration,
+			HalfOpenRequests: cfg.Breaker.HalfOpenRequests,
+		})
+	}
+	transport = &poolTransport{next: transport, pool: s.pool}
+
+	transport = &retryTransport{
+		next:       transport,
+		maxRetries: cfg.Retry.Max,
+		backoff:    cfg.Retry.Backoff,
+		maxBackoff: cfg.Retry.MaxBackoff,
+		timeout:    cfg.Timeout.Overall,
+		metrics:    s.metrics,
+	}
+
+	//The pool transport sets the upstream host and path prefix
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{})
+	proxy.Transport = transport
+	proxy.ModifyResponse = s.handleProxyResponse
+	proxy.ErrorHandler = s.handleProxyError
+
+	return proxy
+}
+
+//handleProxyError serves stale cache entries if available when the backend fails, otherwise responding
+//with a JSON error
+func (s *Server) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	endUpstream(r.Context())
+
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		//Client went away
+		return
+	}
+
+	if s.serveStale(w, r) {
+		s.metrics.upstreamErrors.WithLabelValues("stale").Add(1)
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		s.metrics.upstreamErrors.WithLabelValues("circuit_open").Add(1)
+		httpJSONError(w, "Backend unavailable.", http.StatusServiceUnavailable)
+	case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+		s.metrics.upstreamErrors.WithLabelValues("timeout").Add(1)
+		s.reqLog(r.Context()).WithError(err).Error("backend request timed out")
+		httpJSONError(w, "Backend timed out.", http.StatusGatewayTimeout)
+	default:
+		s.metrics.upstreamErrors.WithLabelValues("error").Add(1)
+		s.reqLog(r.Context()).WithError(err).Error("backend request failed")
+		httpJSONError(w, "Backend request failed.", http.StatusBadGateway)
+	}
+}
+
+//isTimeout checks if the error is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+//retryTransport retries idempotent requests with exponential backoff and bounds
+//the overall time spent on a request
+type retryTransport struct {
+	next       http.RoundTripper
+	maxRetries int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	timeout    time.Duration
+	metrics    *Metrics
+}
+
+//RoundTrip sends the request, retrying failed attempts when safe to do so
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cancel := func() {}
+	if rt.timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), rt.timeout)
+		req = req.WithContext(ctx)
+	}
+
+	//Attempts fail over to upstreams in the pool which haven't been tried
+	req = req.WithContext(withTriedUpstreams(req.Context()))
+
+	retries := 0
+	if isIdempotent(req) {
+		retries = rt.maxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := rt.next.RoundTrip(req)
+
+		if attempt >= retries || !shouldRetry(req, resp, err) {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		rt.metrics.upstreamRetries.Add(1)
+
+		t := time.NewTimer(rt.backoffFor(attempt))
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			cancel()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+//backoffFor provides the exponential backoff with jitter for an attempt
+func (rt *retryTransport) backoffFor(attempt int) time.Duration {
+	backoff := rt.backoff << uint(attempt)
+	if backoff <= 0 || (rt.maxBackoff > 0 && backoff > rt.maxBackoff) {
+		backoff = rt.maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+//isIdempotent checks if a request can safely be retried
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+//shouldRetry checks if the attempt failed in a way that is worth retrying
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil || errors.Is(err, errCircuitOpen) {
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+//cancelBody releases the requests context once the response body has been consumed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cb *cancelBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
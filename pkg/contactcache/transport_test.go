@@ -0,0 +1,150 @@
+package contactcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	now := time.Now()
+
+	cb := newCircuitBreaker("api2.autopilothq.com", breakerOpts{
+		Window:       10 * time.Second,
+		MinRequests:  4,
+		ErrorRate:    0.5,
+		OpenDuration: 5 * time.Second,
+	}, NewMetrics())
+	cb.now = func() time.Time { return now }
+
+	//Not enough requests to trip
+	for i := 0; i < 3; i++ {
+		assert.True(t, cb.allow())
+		cb.record(outcomeFailure)
+	}
+	assert.Equal(t, breakerClosed, cb.State())
+
+	assert.True(t, cb.allow())
+	cb.record(outcomeFailure)
+	assert.Equal(t, breakerOpen, cb.State())
+	assert.False(t, cb.allow())
+
+	//Single probe allowed once open duration passes
+	now = now.Add(6 * time.Second)
+	assert.Equal(t, breakerHalfOpen, cb.State())
+	assert.True(t, cb.allow())
+	assert.False(t, cb.allow())
+
+	//Failed probe reopens
+	cb.record(outcomeFailure)
+	assert.Equal(t, breakerOpen, cb.State())
+
+	//Successful probe closes
+	now = now.Add(6 * time.Second)
+	assert.True(t, cb.allow())
+	cb.record(outcomeSuccess)
+	assert.Equal(t, breakerClosed, cb.State())
+}
+
+func TestRetryIdempotentRequests(t *testing.T) {
+	var beReqCount int32
+
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&beReqCount, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, `{}`)
+	})
+	defer close()
+
+	handler := srv.httpHandler()
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/other", nil)
+	req.Header.Add(apiKeyHeader, "1234")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&beReqCount))
+
+	//Non-idempotent requests are not retried
+	req, _ = http.NewRequest("POST", "https://anywhere.local/v1/other", nil)
+	req.Header.Add(apiKeyHeader, "1234")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&beReqCount))
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	viper.Set("upstream.timeout.response_header", 50*time.Millisecond)
+	viper.Set("upstream.retry.max", 0)
+	defer viper.Set("upstream.timeout.response_header", "10s")
+	defer viper.Set("upstream.retry.max", 2)
+
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprintln(w, `{}`)
+	})
+	defer close()
+
+	handler := srv.httpHandler()
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/other", nil)
+	req.Header.Add(apiKeyHeader, "1234")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "Backend timed out.")
+}
+
+func TestCircuitOpenServesStale(t *testing.T) {
+	var beReqCount int32
+
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&beReqCount, 1)
+		fmt.Fprintln(w, `{"contact_id": "person_1234", "Email": "chris@autopilothq.com"}`)
+	})
+	defer close()
+
+	handler := srv.httpHandler()
+	apiKey := "1234"
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contact/chris@autopilothq.com", nil)
+	req.Header.Add(apiKeyHeader, apiKey)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	//Expire the fresh entry and trip the breaker
+	srv.cache.Delete(req.Context(), srv.prefixKey(apiKey, "chris@autopilothq.com"))
+	srv.pool.primary().breaker.transition(breakerOpen)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, "stale", w.Result().Header.Get("cached"))
+	assert.Equal(t, "STALE", w.Result().Header.Get(cacheStatusHeader))
+	assert.Equal(t, "0", w.Result().Header.Get("Age"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&beReqCount))
+
+	//No stale entry to fall back on
+	req, _ = http.NewRequest("GET", "https://anywhere.local/v1/contact/someone@autopilothq.com", nil)
+	req.Header.Add(apiKeyHeader, apiKey)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "Backend unavailable.")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&beReqCount))
+}
@@ -0,0 +1,150 @@
+package contactcache
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//upstreamLimits tracks the backends rate limit windows per tenant
+type upstreamLimits struct {
+	mu     sync.Mutex
+	until  map[string]time.Time
+	queued int
+}
+
+//limit records that the backend has rate limited the tenant until the given time
+func (ul *upstreamLimits) limit(tenant string, until time.Time) {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	if ul.until == nil {
+		ul.until = map[string]time.Time{}
+	}
+
+	if current, ok := ul.until[tenant]; !ok || until.After(current) {
+		ul.until[tenant] = until
+	}
+}
+
+//remaining provides how long the tenant is still rate limited by the backend
+func (ul *upstreamLimits) remaining(tenant string) time.Duration {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	until, ok := ul.until[tenant]
+	if !ok {
+		return 0
+	}
+
+	wait := time.Until(until)
+	if wait <= 0 {
+		delete(ul.until, tenant)
+		return 0
+	}
+
+	return wait
+}
+
+//enqueue reserves a place in the bounded wait queue
+func (ul *upstreamLimits) enqueue(max int) bool {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	if ul.queued >= max {
+		return false
+	}
+	ul.queued++
+
+	return true
+}
+
+//dequeue releases a place in the wait queue
+func (ul *upstreamLimits) dequeue() {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	ul.queued--
+}
+
+//observeUpstreamLimit records the backends rate limit window from a 429 response
+func (s *Server) observeUpstreamLimit(r *http.Response) {
+	if r.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+
+	wait, ok := parseRetryAfter(r.Header.Get("Retry-After"))
+	if !ok {
+		wait = s.cfg().Upstream.RateLimit.DefaultRetryAfter
+	}
+
+	tenant := tenantHash(r.Request.Header.Get(apiKeyHeader))
+	s.upstreamLimits.limit(tenant, time.Now().Add(wait))
+
+	s.metrics.upstreamRateLimited.Add(1)
+	s.reqLog(r.Request.Context()).WithField("retry_after", wait).Warn("backend rate limited tenant")
+}
+
+//parseRetryAfter parses either form of the Retry-After header
+func parseRetryAfter(val string) (time.Duration, bool) {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(val); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(val); err == nil {
+		wait := time.Until(at)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+
+	return 0, false
+}
+
+//awaitUpstreamLimit handles a request for a tenant currently rate limited by the backend. Stale entries are
+//served if available, otherwise the request is queued until the window expires or rejected if the wait is
+//too long. Returns true if the request should continue to the backend.
+func (s *Server) awaitUpstreamLimit(w http.ResponseWriter, r *http.Request, wait time.Duration) bool {
+	cfg := s.cfg().Upstream.RateLimit
+
+	if cfg.ServeStale && s.serveStale(w, r) {
+		s.metrics.upstreamRateLimitDecisions.WithLabelValues("stale").Add(1)
+		return false
+	}
+
+	if wait <= cfg.MaxWait && s.upstreamLimits.enqueue(cfg.MaxQueue) {
+		defer s.upstreamLimits.dequeue()
+
+		t := time.NewTimer(wait)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+			s.metrics.upstreamRateLimitDecisions.WithLabelValues("queued").Add(1)
+			return true
+		case <-r.Context().Done():
+			s.metrics.upstreamRateLimitDecisions.WithLabelValues("cancelled").Add(1)
+			return false
+		}
+	}
+
+	s.metrics.upstreamRateLimitDecisions.WithLabelValues("rejected").Add(1)
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.Header().Add("content-type", "application/json")
+	httpJSONError(w, "Backend rate limit exceeded.", http.StatusTooManyRequests)
+
+	return false
+}
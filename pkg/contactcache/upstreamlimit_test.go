@@ -0,0 +1,126 @@
+package contactcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	wait, ok := parseRetryAfter("120")
+	assert.True(t, ok)
+	assert.Equal(t, 120*time.Second, wait)
+
+	wait, ok = parseRetryAfter(time.Now().Add(1 * time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.InDelta(t, float64(time.Minute), float64(wait), float64(2*time.Second))
+
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok)
+}
+
+//setupRateLimitedBackend provides a test server whose backend responds with 429s once limited is set
+func setupRateLimitedBackend(t *testing.T, resp string, retryAfter string) (*Server, *int32, *int32, func()) {
+	var beReqCount, limited int32
+
+	srv, closer, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&beReqCount, 1)
+		if atomic.LoadInt32(&limited) == 1 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprintln(w, resp)
+	})
+
+	return srv, &beReqCount, &limited, closer
+}
+
+func TestUpstreamLimitServesStale(t *testing.T) {
+	contact := `{"contact_id": "person_1234", "Email": "chris@autopilothq.com"}`
+
+	srv, beReqCount, limited, close := setupRateLimitedBackend(t, contact, "120")
+	defer close()
+
+	handler := srv.httpHandler()
+	apiKey := "1234"
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contact/person_1234", nil)
+	req.Header.Add(apiKeyHeader, apiKey)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+
+	//Expire the fresh entries
+	srv.cache.Delete(req.Context(), srv.prefixKey(apiKey, "chris@autopilothq.com"))
+	srv.cache.Delete(req.Context(), srv.prefixKey(apiKey, "person_1234"))
+
+	atomic.StoreInt32(limited, 1)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Result().StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(beReqCount))
+
+	//Backend should not be called while limited
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, "stale", w.Result().Header.Get("cached"))
+	assert.Contains(t, w.Body.String(), "chris@autopilothq.com")
+	assert.Equal(t, int32(2), atomic.LoadInt32(beReqCount))
+}
+
+func TestUpstreamLimitRejectsLongWaits(t *testing.T) {
+	srv, beReqCount, limited, close := setupRateLimitedBackend(t, `{}`, "120")
+	defer close()
+
+	handler := srv.httpHandler()
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/other", nil)
+	req.Header.Add(apiKeyHeader, "1234")
+
+	atomic.StoreInt32(limited, 1)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Result().StatusCode)
+	assert.NotEmpty(t, w.Result().Header.Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "Backend rate limit exceeded.")
+	assert.Equal(t, int32(1), atomic.LoadInt32(beReqCount))
+}
+
+func TestUpstreamLimitQueues(t *testing.T) {
+	srv, beReqCount, limited, close := setupRateLimitedBackend(t, `{}`, "1")
+	defer close()
+
+	handler := srv.httpHandler()
+
+	req, _ := http.NewRequest("GET", "https://anywhere.local/v1/other", nil)
+	req.Header.Add(apiKeyHeader, "1234")
+
+	atomic.StoreInt32(limited, 1)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Result().StatusCode)
+
+	atomic.StoreInt32(limited, 0)
+
+	start := time.Now()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.True(t, time.Since(start) > 500*time.Millisecond, "expected request to be queued")
+	assert.Equal(t, int32(2), atomic.LoadInt32(beReqCount))
+}
@@ -0,0 +1,183 @@
+package contactcache
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+//Cache verification results
+const (
+	verifyFresh   = "fresh"
+	verifyStale   = "stale"
+	verifyError   = "error"
+	verifyDropped = "dropped"
+)
+
+//verifyHit a cache hit sampled for comparison against the live backend
+type verifyHit struct {
+	method   string
+	uri      string
+	apiKey   string
+	entity   string
+	cacheKey string
+	cached   string
+	age      time.Duration
+	hasAge   bool
+	log      *logrus.Entry
+
+	//idOrEmail the requested contact, invalidated if stale
+	idOrEmail string
+}
+
+//sampleHit samples a served cache hit, fetching the live response from the backend in
+//the background to measure how often cached entries are stale
+func (s *Server) sampleHit(r *http.Request, entity, cacheKey, cached string) {
+	cfg := s.cfg().Cache.Verify
+	if cfg.SampleRatio <= 0 || rand.Float64() >= cfg.SampleRatio {
+		return
+	}
+
+	apiKey := r.Header.Get(apiKeyHeader)
+
+	//Don't add to the backend load while it's rate limiting the tenant
+	if s.upstreamLimits.remaining(tenantHash(apiKey)) > 0 {
+		s.metrics.cacheVerifications.WithLabelValues(entity, verifyDropped).Inc()
+		return
+	}
+
+	if atomic.AddInt32(&s.verifyInFlight, 1) > int32(cfg.MaxInFlight) {
+		atomic.AddInt32(&s.verifyInFlight, -1)
+		s.metrics.cacheVerifications.WithLabelValues(entity, verifyDropped).Inc()
+		return
+	}
+
+	//The live request counts against the tenants backend budget like any other
+	if !s.spend(r.Context(), budgetBackend) {
+		atomic.AddInt32(&s.verifyInFlight, -1)
+		s.metrics.cacheVerifications.WithLabelValues(entity, verifyDropped).Inc()
+		return
+	}
+
+	hit := &verifyHit{
+		method:    r.Method,
+		uri:       r.URL.RequestURI(),
+		apiKey:    apiKey,
+		entity:    entity,
+		cacheKey:  cacheKey,
+		cached:    cached,
+		log:       s.reqLog(r.Context()),
+		idOrEmail: mux.Vars(r)["idOrEmail"],
+	}
+	if info, ok := requestInfoFromContext(r.Context()); ok && info.hasTTL {
+		hit.age, hit.hasAge = info.age, true
+	}
+
+	s.async(func() {
+		defer atomic.AddInt32(&s.verifyInFlight, -1)
+		s.verifyHit(hit)
+	})
+}
+
+//verifyHit compares the cached response with the live backend response, invalidating
+//stale entries if enabled
+func (s *Server) verifyHit(hit *verifyHit) {
+	cfg := s.cfg().Cache.Verify
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	//Only debug requests look up the age while serving
+	if !hit.hasAge {
+		hit.age, _, hit.hasAge = s.entryAge(ctx, hit.cacheKey, s.cfg().Cache.TTL)
+	}
+
+	status, live, err := s.fetchLive(ctx, hit)
+	if err != nil {
+		s.metrics.cacheVerifications.WithLabelValues(hit.entity, verifyError).Inc()
+		hit.log.WithError(err).Warn("failed to verify cache entry")
+		return
+	}
+
+	result := verifyFresh
+	fields := logrus.Fields{"entity": hit.entity}
+	switch status {
+	case http.StatusOK:
+		diffs, total := diffBodies([]byte(hit.cached), live, nil, nil)
+		if total > 0 {
+			result = verifyStale
+			fields["diff_count"] = total
+			fields["diffs"] = strings.Join(diffs, "; ")
+		}
+	case http.StatusNotFound:
+		//Deleted without passing through the proxy
+		result = verifyStale
+		fields["status"] = status
+	default:
+		s.metrics.cacheVerifications.WithLabelValues(hit.entity, verifyError).Inc()
+		hit.log.WithField("status", status).Warn("failed to verify cache entry")
+		return
+	}
+
+	s.metrics.cacheVerifications.WithLabelValues(hit.entity, result).Inc()
+	if hit.hasAge {
+		s.metrics.cacheVerifiedAge.WithLabelValues(hit.entity, result).Observe(hit.age.Seconds())
+		fields["age_ms"] = durationMs(hit.age)
+	}
+
+	if result == verifyFresh {
+		return
+	}
+
+	hit.log.WithFields(fields).Warn("stale cache entry served")
+
+	if cfg.Invalidate {
+		s.invalidateStale(ctx, hit)
+	}
+}
+
+//fetchLive requests the cached resource directly from the backend, bypassing the cache
+func (s *Server) fetchLive(ctx context.Context, hit *verifyHit) (int, []byte, error) {
+	//The upstream host is set by the pool transport
+	req, err := http.NewRequest(hit.method, hit.uri, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set(apiKeyHeader, hit.apiKey)
+
+	client := &http.Client{Transport: s.be.Transport}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	s.observeUpstreamLimit(resp)
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return resp.StatusCode, b, nil
+}
+
+//invalidateStale removes the stale entry so the next request is served from the backend
+func (s *Server) invalidateStale(ctx context.Context, hit *verifyHit) {
+	if hit.entity == "contact" {
+		s.invalidate(ctx, hit.apiKey, hit.idOrEmail)
+		return
+	}
+
+	s.cache.Delete(ctx, hit.cacheKey)
+	s.cache.Delete(ctx, staleKey(hit.cacheKey))
+	s.countCache(hit.apiKey, "invalidate", hit.entity)
+}
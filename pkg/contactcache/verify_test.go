@@ -0,0 +1,146 @@
+package contactcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyCacheHits(t *testing.T) {
+	var live atomic.Value
+	live.Store(`{"contact_id": "person_1", "Email": "chris@autopilothq.com", "FirstName": "Chris"}`)
+
+	var beReqCount int32
+	srv, close, s := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&beReqCount, 1)
+		fmt.Fprintln(w, live.Load().(string))
+	})
+	defer close()
+
+	srv.cfg().Cache.Verify.SampleRatio = 1
+
+	handler := srv.httpHandler()
+	apiKey := "1234"
+
+	get := func() string {
+		req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contact/chris@autopilothq.com", nil)
+		req.Header.Add(apiKeyHeader, apiKey)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		srv.tasks.Wait()
+
+		return w.Body.String()
+	}
+
+	//Populate the cache, misses aren't sampled
+	get()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&beReqCount))
+
+	//Hits are compared ignoring key order and whitespace
+	live.Store(`{"FirstName": "Chris", "Email": "chris@autopilothq.com", "contact_id": "person_1"}`)
+	get()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&beReqCount))
+
+	verifications := srv.metrics.cacheVerifications
+	assert.Equal(t, float64(1), testutil.ToFloat64(verifications.WithLabelValues("contact", verifyFresh)))
+
+	//The age of sampled hits is looked up in the background
+	assert.Equal(t, uint64(1), sampleCount(t, srv.metrics, "contactcache_cache_verified_age_seconds", map[string]string{
+		"entity": "contact", "result": verifyFresh,
+	}))
+
+	//Changes made outside the proxy are detected, the stale entry is still served
+	live.Store(`{"contact_id": "person_1", "Email": "chris@autopilothq.com", "FirstName": "Christopher"}`)
+	assert.Contains(t, get(), `"FirstName": "Chris"`)
+	assert.Equal(t, float64(1), testutil.ToFloat64(verifications.WithLabelValues("contact", verifyStale)))
+	assert.True(t, s.Exists(srv.prefixKey(apiKey, "chris@autopilothq.com")))
+
+	//Stale entries are invalidated when enabled
+	srv.cfg().Cache.Verify.Invalidate = true
+	get()
+	assert.Equal(t, float64(2), testutil.ToFloat64(verifications.WithLabelValues("contact", verifyStale)))
+	assert.False(t, s.Exists(srv.prefixKey(apiKey, "chris@autopilothq.com")))
+
+	assert.Contains(t, get(), `"FirstName": "Christopher"`)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&srv.verifyInFlight))
+}
+
+func TestVerifyBackendBudget(t *testing.T) {
+	var beReqCount int32
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&beReqCount, 1)
+		fmt.Fprintln(w, `{"contact_id": "person_1", "Email": "chris@autopilothq.com"}`)
+	})
+	defer close()
+
+	srv.cfg().Cache.Verify.SampleRatio = 1
+	srv.cfg().RateLimit.Enabled = true
+	srv.cfg().RateLimit.Backend = LimitConfig{Rate: 0.001, Burst: 2}
+
+	handler := srv.httpHandler()
+
+	get := func() int {
+		req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contact/chris@autopilothq.com", nil)
+		req.Header.Add(apiKeyHeader, "1234")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		srv.tasks.Wait()
+
+		return w.Code
+	}
+
+	//The miss and the first sampled hit take the tenants whole backend budget
+	assert.Equal(t, http.StatusOK, get())
+	assert.Equal(t, http.StatusOK, get())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&beReqCount))
+
+	//Later hits are still served but not verified
+	assert.Equal(t, http.StatusOK, get())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&beReqCount))
+
+	verifications := srv.metrics.cacheVerifications
+	assert.Equal(t, float64(1), testutil.ToFloat64(verifications.WithLabelValues("contact", verifyFresh)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(verifications.WithLabelValues("contact", verifyDropped)))
+}
+
+func TestVerifyObservesUpstreamLimit(t *testing.T) {
+	var limited int32
+	srv, close, _ := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&limited) == 1 {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprintln(w, `{"contact_id": "person_1", "Email": "chris@autopilothq.com"}`)
+	})
+	defer close()
+
+	srv.cfg().Cache.Verify.SampleRatio = 1
+
+	handler := srv.httpHandler()
+
+	get := func() {
+		req, _ := http.NewRequest("GET", "https://anywhere.local/v1/contact/chris@autopilothq.com", nil)
+		req.Header.Add(apiKeyHeader, "1234")
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		srv.tasks.Wait()
+	}
+
+	get()
+
+	//A 429 to a verification limits the tenant so later samples are dropped
+	atomic.StoreInt32(&limited, 1)
+	get()
+	assert.True(t, srv.upstreamLimits.remaining(tenantHash("1234")) > 0)
+
+	get()
+	assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.cacheVerifications.WithLabelValues("contact", verifyDropped)))
+}
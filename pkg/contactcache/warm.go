@@ -0,0 +1,92 @@
+package contactcache
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+//Warm pre-populates the tenants cache by walking the backends contact list bookmarks,
+//caching each list page and contact. Walking stops after maxPages if greater than 0
+func (s *Server) Warm(ctx context.Context, apiKey string, maxPages int) (pages int, contacts int, err error) {
+	path := "/v1/contacts"
+
+	for maxPages <= 0 || pages < maxPages {
+		//The upstream host is set by the pool transport
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			return pages, contacts, err
+		}
+		req.Header.Set(apiKeyHeader, apiKey)
+		req = req.WithContext(ctx)
+
+		started := time.Now()
+		body, err := s.fetchBackend(req)
+		if err != nil {
+			return pages, contacts, err
+		}
+
+		page := gjson.Get(body, "contacts").Array()
+
+		//Cache as if requested through the proxy
+		listReq, _ := http.NewRequest(http.MethodGet, path, nil)
+		if err := s.cacheList(ctx, listReq, apiKey, body, started); err != nil {
+			return pages, contacts, err
+		}
+		if len(page) != 0 {
+			if err := s.cacheContact(ctx, apiKey, body); err != nil {
+				return pages, contacts, err
+			}
+		}
+
+		pages++
+		contacts += len(page)
+
+		bookmark := gjson.Get(body, "bookmark").String()
+		if bookmark == "" || len(page) == 0 {
+			break
+		}
+		path = "/v1/contacts/" + bookmark
+	}
+
+	return pages, contacts, nil
+}
+
+//fetchBackend requests directly from the backend using the upstream transport
+func (s *Server) fetchBackend(req *http.Request) (string, error) {
+	client := &http.Client{Transport: s.be.Transport}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("backend responded with %d", resp.StatusCode)
+	}
+
+	return string(b), nil
+}
+
+//singleJoiningSlash joins URL paths in the same way as the reverse proxy
+func singleJoiningSlash(a, b string) string {
+	switch {
+	case a == "" || a == "/":
+		return b
+	case a[len(a)-1] == '/' && b[0] == '/':
+		return a + b[1:]
+	case a[len(a)-1] != '/' && b[0] != '/':
+		return a + "/" + b
+	}
+	return a + b
+}
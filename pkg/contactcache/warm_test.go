@@ -0,0 +1,48 @@
+package contactcache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarm(t *testing.T) {
+	var paths []string
+
+	srv, close, s := setupTestServerHandleFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+
+		switch r.URL.Path {
+		case "/v1/contacts":
+			fmt.Fprintln(w, `{"contacts": [{"contact_id": "person_1", "Email": "one@autopilothq.com"}], "bookmark": "person_1"}`)
+		case "/v1/contacts/person_1":
+			fmt.Fprintln(w, `{"contacts": [{"contact_id": "person_2", "Email": "two@autopilothq.com"}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer close()
+
+	apiKey := "1234"
+
+	pages, contacts, err := srv.Warm(context.Background(), apiKey, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pages)
+	assert.Equal(t, 2, contacts)
+	assert.Equal(t, []string{"/v1/contacts", "/v1/contacts/person_1"}, paths)
+
+	assert.True(t, s.Exists(srv.prefixKey(apiKey, "lists:")))
+	assert.True(t, s.Exists(srv.prefixKey(apiKey, "lists:person_1")))
+	assert.True(t, s.Exists(srv.prefixKey(apiKey, "one@autopilothq.com")))
+	assert.True(t, s.Exists(srv.prefixKey(apiKey, "person_2")))
+
+	//Page limit
+	paths = nil
+	pages, _, err = srv.Warm(context.Background(), apiKey, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pages)
+	assert.Len(t, paths, 1)
+}
@@ -0,0 +1,221 @@
+package contactcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	//webhookSecretHeader carries the shared webhook secret, alternatively the secret
+	//query parameter can be used where headers can't be configured
+	webhookSecretHeader = "X-Webhook-Secret"
+
+	maxWebhookBodySize = 1 << 20
+)
+
+//Webhook event results
+const (
+	webhookProcessed = "processed"
+	webhookDuplicate = "duplicate"
+	webhookIgnored   = "ignored"
+	webhookRejected  = "rejected"
+	webhookError     = "error"
+)
+
+//webhookEvents Autopilot contact events which invalidate the contact
+var webhookEvents = map[string]bool{
+	"contact_added":        true,
+	"contact_updated":      true,
+	"contact_unsubscribed": true,
+	"contact_deleted":      true,
+}
+
+//webhookEvent a contact event delivered by Autopilot
+type webhookEvent struct {
+	name     string
+	id       string
+	email    string
+	endpoint WebhookEndpointConfig
+}
+
+//handleWebhook invalidates, or refreshes, the contact and list entries affected by an
+//Autopilot contact event
+func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	cfg := s.cfg().Webhooks
+
+	w.Header().Add("content-type", "application/json")
+
+	if r.Method != http.MethodPost {
+		httpJSONError(w, "Webhooks must be POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	endpoint, ok := cfg.endpoint(webhookSecret(r))
+	if !ok {
+		s.metrics.webhookEvents.WithLabelValues("unknown", webhookRejected).Inc()
+		httpJSONError(w, "Invalid webhook secret.", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookBodySize+1))
+	if err != nil || len(body) > maxWebhookBodySize || !gjson.ValidBytes(body) {
+		s.metrics.webhookEvents.WithLabelValues("unknown", webhookRejected).Inc()
+		httpJSONError(w, "Invalid webhook payload.", http.StatusBadRequest)
+		return
+	}
+
+	event := &webhookEvent{
+		name:     gjson.GetBytes(body, "event").String(),
+		id:       gjson.GetBytes(body, "contact.contact_id").String(),
+		email:    gjson.GetBytes(body, "contact.Email").String(),
+		endpoint: endpoint,
+	}
+
+	if !webhookEvents[event.name] {
+		s.metrics.webhookEvents.WithLabelValues("other", webhookIgnored).Inc()
+		webhookResult(w, webhookIgnored)
+		return
+	}
+
+	if event.id == "" && event.email == "" {
+		s.metrics.webhookEvents.WithLabelValues(event.name, webhookRejected).Inc()
+		httpJSONError(w, "Webhook payload has no contact.", http.StatusBadRequest)
+		return
+	}
+
+	seenKey := webhookSeenKey(endpoint.tenant(), body)
+	if s.webhookSeen(r.Context(), seenKey, cfg.DedupeTTL) {
+		s.metrics.webhookEvents.WithLabelValues(event.name, webhookDuplicate).Inc()
+		webhookResult(w, webhookDuplicate)
+		return
+	}
+
+	if err := s.applyWebhook(r.Context(), event, cfg.Refresh); err != nil {
+		//Allow the redelivery to be processed
+		if cfg.DedupeTTL > 0 {
+			s.rdb.Del(r.Context(), seenKey)
+		}
+
+		s.metrics.webhookEvents.WithLabelValues(event.name, webhookError).Inc()
+		s.reqLog(r.Context()).WithError(err).Error("failed to invalidate contact from webhook")
+		httpJSONError(w, "Failed to invalidate contact.", http.StatusInternalServerError)
+		return
+	}
+
+	s.metrics.webhookEvents.WithLabelValues(event.name, webhookProcessed).Inc()
+	webhookResult(w, webhookProcessed)
+}
+
+func webhookResult(w http.ResponseWriter, result string) {
+	json.NewEncoder(w).Encode(map[string]string{"result": result})
+}
+
+//endpoint finds the endpoint with the secret, comparing every secret in constant time
+func (c WebhooksConfig) endpoint(secret string) (WebhookEndpointConfig, bool) {
+	var (
+		match WebhookEndpointConfig
+		found bool
+	)
+	for _, e := range c.Endpoints {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(e.Secret)) == 1 && !found {
+			match, found = e, true
+		}
+	}
+	return match, found && secret != ""
+}
+
+//webhookSecret provides the secret from the header or query
+func webhookSecret(r *http.Request) string {
+	if secret := r.Header.Get(webhookSecretHeader); secret != "" {
+		return secret
+	}
+	return r.URL.Query().Get("secret")
+}
+
+//webhookSeenKey the dedupe key of a delivery
+func webhookSeenKey(tenant string, body []byte) string {
+	return fmt.Sprintf("webhooks:seen:%x", sha256.Sum256(append([]byte(tenant+":"), body...)))
+}
+
+//webhookSeen records the delivery, checking if it was already seen within the TTL. Failing
+//to check processes the delivery again as invalidation is idempotent
+func (s *Server) webhookSeen(ctx context.Context, key string, ttl time.Duration) bool {
+	if ttl <= 0 {
+		return false
+	}
+
+	first, err := s.rdb.SetNX(ctx, key, time.Now().Unix(), ttl).Result()
+	if err != nil {
+		s.log.WithError(err).Warn("failed to dedupe webhook")
+		return false
+	}
+	return !first
+}
+
+//applyWebhook invalidates the contact by ID and email along with the tenants lists,
+//refreshing the contact from the backend in the background unless it was deleted
+func (s *Server) applyWebhook(ctx context.Context, event *webhookEvent, refresh bool) error {
+	tenant := event.endpoint.tenant()
+
+	if err := s.markInvalidated(ctx, tenant, event.id, event.email, listsInvalidated); err != nil {
+		return err
+	}
+
+	for _, key := range []string{event.id, event.email} {
+		if key == "" {
+			continue
+		}
+		if _, err := s.manager().PurgeContact(ctx, tenant, key); err != nil {
+			return err
+		}
+	}
+	s.notifyContact(ctx, tenant, noticeInvalidated, event.id, event.email)
+
+	if !refresh || event.name == "contact_deleted" || event.endpoint.APIKey == "" {
+		return nil
+	}
+
+	idOrEmail := event.id
+	if idOrEmail == "" {
+		idOrEmail = event.email
+	}
+
+	apiKey := event.endpoint.APIKey
+	s.async(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg().Upstream.Timeout.Overall)
+		defer cancel()
+
+		if err := s.refreshContact(ctx, apiKey, idOrEmail); err != nil {
+			s.log.WithError(err).Warn("failed to refresh contact from webhook")
+		}
+	})
+
+	return nil
+}
+
+//refreshContact fetches the contact from the backend, caching the response
+func (s *Server) refreshContact(ctx context.Context, apiKey, idOrEmail string) error {
+	//The upstream host is set by the pool transport
+	req, err := http.NewRequest(http.MethodGet, "/v1/contact/"+url.PathEscape(idOrEmail), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(apiKeyHeader, apiKey)
+
+	body, err := s.fetchBackend(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	return s.cacheContact(ctx, apiKey, body)
+}
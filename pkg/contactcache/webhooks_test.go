@@ -0,0 +1,95 @@
+package contactcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookInvalidation(t *testing.T) {
+	contact := `{"contact_id": "person_1", "Email": "chris@autopilothq.com"}`
+
+	srv, beReqCount, close, s := setupTestServer(t, contact)
+	defer close()
+
+	apiKey := "1234"
+	secret := "0123456789abcdef"
+
+	srv.cfg().Webhooks.Path = "/webhooks/autopilot"
+	srv.cfg().Webhooks.Endpoints = []WebhookEndpointConfig{{Secret: secret, APIKey: apiKey}}
+
+	handler := srv.httpHandler()
+
+	get := func(path string) {
+		req, _ := http.NewRequest("GET", "https://anywhere.local"+path, nil)
+		req.Header.Add(apiKeyHeader, apiKey)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		srv.tasks.Wait()
+	}
+
+	deliver := func(secret, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "https://anywhere.local/webhooks/autopilot?secret="+secret, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		srv.tasks.Wait()
+		return w
+	}
+
+	contactKey := srv.prefixKey(apiKey, "chris@autopilothq.com")
+	aliasKey := srv.prefixKey(apiKey, "person_1")
+	listKey := srv.prefixKey(apiKey, "lists:")
+
+	get("/v1/contact/chris@autopilothq.com")
+	get("/v1/contacts")
+	assert.True(t, s.Exists(contactKey))
+	assert.True(t, s.Exists(listKey))
+
+	updated := `{"hook_id": "hook_1", "event": "contact_updated", "contact": {"contact_id": "person_1", "Email": "chris@autopilothq.com"}}`
+
+	//Webhooks don't require an API key, only the secret
+	w := deliver("wrong-secret-value", updated)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.True(t, s.Exists(contactKey))
+
+	w = deliver(secret, updated)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), webhookProcessed)
+	assert.False(t, s.Exists(contactKey))
+	assert.False(t, s.Exists(aliasKey))
+	assert.False(t, s.Exists(listKey))
+	assert.False(t, s.Exists(staleKey(contactKey)))
+
+	//Repeated deliveries are ignored
+	w = deliver(secret, updated)
+	assert.Contains(t, w.Body.String(), webhookDuplicate)
+
+	w = deliver(secret, `{"event": "journey_started"}`)
+	assert.Contains(t, w.Body.String(), webhookIgnored)
+
+	w = deliver(secret, `{"event": "contact_updated"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	//Refreshing caches the contact again from the backend
+	srv.cfg().Webhooks.Refresh = true
+	reqs := *beReqCount
+	w = deliver(secret, `{"event": "contact_added", "contact": {"contact_id": "person_1", "Email": "chris@autopilothq.com"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, reqs+1, *beReqCount)
+	assert.True(t, s.Exists(contactKey))
+	assert.True(t, s.Exists(aliasKey))
+
+	//Deleted contacts aren't refreshed
+	w = deliver(secret, `{"event": "contact_deleted", "contact": {"contact_id": "person_1"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, reqs+1, *beReqCount)
+	assert.False(t, s.Exists(contactKey))
+
+	events := srv.metrics.webhookEvents
+	assert.Equal(t, float64(1), testutil.ToFloat64(events.WithLabelValues("contact_updated", webhookProcessed)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(events.WithLabelValues("contact_updated", webhookDuplicate)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(events.WithLabelValues("unknown", webhookRejected)))
+}